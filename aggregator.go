@@ -1,12 +1,14 @@
 package statsd
 
 import (
-	"fmt"
+	"math/rand"
 	"strconv"
 	"strings"
 	"time"
 
 	"github.com/coder-van/v-stats/metrics"
+	"github.com/coder-van/v-stats/parser"
+	"github.com/coder-van/v-stats/point"
 	"github.com/coder-van/v-util/log"
 )
 
@@ -17,31 +19,47 @@ const Prefix = ""
 
 var Percentiles = []float64{0.5, 0.75, 0.95, 0.99, 0.999}
 
-func NewAggregator(flushSeconds int,
+func NewAggregator(conf *Config,
 	r metrics.Registry,
 	in chan []byte,
-	out chan metrics.MetricDataPoint) *aggregator {
+	out chan point.Point) *aggregator {
 
-	return &aggregator{
+	newSet, err := newSetFunc(conf.SetMode, uint8(conf.SetHLLPrecision))
+	if err != nil {
+		panic(err)
+	}
+	agg := &aggregator{
 		exit:            make(chan bool),
-		FlushSeconds:    flushSeconds,
+		FlushSeconds:    conf.FlushSeconds,
+		FlushAlign:      conf.FlushAlign,
+		FlushJitter:     time.Duration(conf.FlushJitterMillis) * time.Millisecond,
 		metricsRegister: r,
+		stat:            NewBaseStat("statsd", r),
 		chanOut:         out,
 		chanIn:          in,
 		logger:          log.GetLogger("statsd", log.RotateModeMonth),
 	}
+	agg.shards = make([]*shard, conf.AggregatorWorkers)
+	for i := range agg.shards {
+		agg.shards[i] = newShard(agg.stat, newSet, conf.DeleteIdleCounters, agg.logger)
+	}
+	return agg
 }
 
 type aggregator struct {
 	exit            chan bool
 	FlushSeconds    int
+	FlushAlign      bool
+	FlushJitter     time.Duration
 	metricsRegister metrics.Registry
-	chanOut         chan metrics.MetricDataPoint
+	shards          []*shard
+	stat            *BaseStat
+	chanOut         chan point.Point
 	chanIn          chan []byte
 	logger          *log.Vlogger
 }
 
-func (agg *aggregator) HandlePackets(packet string) {
+func (agg *aggregator) HandlePackets(packet []byte) {
 	/*
 	 收到的 packets格式 由\n符分隔的多项数据
 	 <metric>\n[metric...]
@@ -50,155 +68,188 @@ func (agg *aggregator) HandlePackets(packet string) {
 	 section:
 	 <value>|<type>|@<rate>[|#<tag1_name=tag1_value>,[tag2_name=tag2_value]]
 	*/
-	_metricLines := strings.Split(packet, "\n")
-	for _, metricLine := range _metricLines {
-		metricLineTmp := strings.TrimSpace(metricLine)
-		if metricLineTmp != "" {
-			err := agg.parseMetricLine(metricLine)
-			if err != nil {
-				//log.Error("Error occurred when parsing packet:", err)
-				continue
-			}
+	batches := make([][][]byte, len(agg.shards))
+	for line, rest := parser.NextLine(packet); line != nil; line, rest = parser.NextLine(rest) {
+		i := shardIndex(line, len(agg.shards))
+		batches[i] = append(batches[i], line)
+	}
+	for i, lines := range batches {
+		if len(lines) == 0 {
+			continue
+		}
+		// shard 的队列满时丢弃这批数据, 不能阻塞接收和刷新
+		select {
+		case agg.shards[i].in <- shardMsg{lines: lines}:
+		default:
+			agg.stat.CounterInc("shard_dropped_lines", len(lines))
 		}
 	}
 }
 
-func (agg *aggregator) parseMetricLine(packet string) error {
-	/*
-	 parse metric to
-	*/
-	bits := strings.SplitN(packet, ":", 2)
-	if len(bits) != 2 {
-		//log.Infof("Error: splitting ':', Unable to parse metric: %s", packet)
-		return fmt.Errorf("Error Parsing statsd packet")
-	}
-
-	key := bits[0]
-	metadata := bits[1]
+type flushJob struct {
+	// 每个 shard 一个, 回复各自的快照
+	snapshots []chan shardSnapshot
+	bucket    time.Time
+	// elapsed 是距离上一次交换的时间, 跳过刷新时会大于刷新周期, counter 的 rate 按它计算
+	elapsed time.Duration
+}
 
-	data := []string{}
-	sections := strings.Split(metadata, ":")
-	for _, token := range sections {
-		data = append(data, token)
+// swap sends a flush marker to every shard, it does not wait for the shards
+// to reply. Markers are never dropped.
+func (agg *aggregator) swap(bucket time.Time, elapsed time.Duration) flushJob {
+	job := flushJob{
+		snapshots: make([]chan shardSnapshot, len(agg.shards)),
+		bucket:    bucket,
+		elapsed:   elapsed,
 	}
-
-	agg.parseSections(key, data)
-	return nil
+	for i, sh := range agg.shards {
+		job.snapshots[i] = make(chan shardSnapshot, 1)
+		sh.in <- shardMsg{swap: job.snapshots[i]}
+	}
+	return job
 }
 
-func (agg *aggregator) parseSections(key string, data []string) {
-	// 将同一个key下的数据整理成数据数组
-	for _, datum := range data {
-		// Validate splitting the bit on "|"
-		fields := strings.Split(datum, "|")
-		if len(fields) < 2 {
-			agg.logger.Printf("Error parsing packet Key: %s, data: %s", key, data)
-		}
-
-		// Set allows value of strings.
-		metric_type := fields[1]
-		value_str   := fields[0]
-
-		switch metric_type {
-		case "c":
-			c := metrics.NewCounter()
-			c = agg.metricsRegister.GetOrRegister(key, c).(metrics.Counter)
-			value, err := strconv.ParseInt(fields[0], 10, 64)
-			if err != nil {
-				agg.logger.Printf("parse int %s, %s", key, err)
-			}
-			c.Inc(value)
-		case "g":
-			if strings.Index(value_str, ".") > 0 {
-				value, err := strconv.ParseFloat(fields[0], 64)
-				if err != nil {
-					agg.logger.Printf("parse int %s, %s", key, err)
-				}
-				g := metrics.NewGaugeFloat64()
-				g = agg.metricsRegister.GetOrRegister(key, g).(metrics.GaugeFloat64)
-				g.Update(value)
-			} else {
-				value, err := strconv.ParseInt(fields[0], 10, 64)
-				if err != nil {
-					agg.logger.Printf("parse int %s, %s", key, err)
-				}
-				g := metrics.NewGauge()
-				g = agg.metricsRegister.GetOrRegister(key, g).(metrics.Gauge)
-				g.Update(value)
-			}
-		case "ms", "h":
-			value, err := strconv.ParseInt(fields[0], 10, 64)
-			if err != nil {
-				agg.logger.Printf("parse int %s, %s", key, err)
-			}
-			t := metrics.NewTimer()
-			t = agg.metricsRegister.GetOrRegister(key, t).(metrics.Timer)
-			t.Update(time.Duration(value * int64(time.Millisecond)))
+func (agg *aggregator) flushLoop(jobs chan flushJob, done chan bool) {
+	defer close(done)
+	for job := range jobs {
+		snapshots := make([]shardSnapshot, len(job.snapshots))
+		for i, ch := range job.snapshots {
+			snapshots[i] = <-ch
 		}
+		agg.Flush(snapshots, job.bucket, job.elapsed)
 	}
+}
 
+// Flush 将各 shard 的快照以及共享的 metricsRegister 合并输出,
+// bucket 为本次刷新对应的时间点, 作为所有数据点的时间戳, elapsed 为这些数据累计的时长
+func (agg *aggregator) Flush(snapshots []shardSnapshot, bucket time.Time, elapsed time.Duration) {
+	now := bucket.Unix()
+	seconds := elapsed.Seconds()
+	if seconds <= 0 {
+		seconds = float64(agg.FlushSeconds)
+	}
+	for _, s := range snapshots {
+		agg.flushRegistry(s.interval, now, seconds)
+		agg.flushRegistry(s.persistent, now, seconds)
+	}
+	agg.flushRegistry(agg.metricsRegister, now, seconds)
 }
 
-func (agg *aggregator) Flush() {
+func (agg *aggregator) flushRegistry(r metrics.Registry, now int64, seconds float64) {
 	du := float64(time.Nanosecond)
-	now := time.Now().Unix()
-	seconds := agg.FlushSeconds
-	agg.metricsRegister.Each(func(name string, i interface{}) {
+	r.Each(func(key string, i interface{}) {
+		name, tags := splitSeriesKey(key)
+		if Prefix != "" {
+			name = Prefix + "." + name
+		}
+		emit := func(field string, value float64, kind point.Kind) {
+			agg.chanOut <- point.New(name, field, tags, value, now, kind)
+		}
 		switch metric := i.(type) {
+		case set:
+			emit("count", float64(metric.Count()), point.Set)
+			metric.Clear()
 		case metrics.Counter:
-			agg.chanOut <- metrics.NewMetricDataPoint(name+".count", metric.Count(), now)
+			count := float64(metric.Count())
+			emit("count", count, point.Counter)
 			// 计算每秒速度
-			agg.chanOut <- metrics.NewMetricDataPoint(name+".rate", metric.Count()/int64(seconds), now)
+			emit("rate", count/seconds, point.Counter)
 			metric.Clear()
+		case *stampedGauge:
+			agg.chanOut <- point.New(name, "value", tags, metric.Value(), metric.Timestamp(), point.Gauge)
 		case metrics.Gauge:
-			agg.chanOut <- metrics.NewMetricDataPoint(name+".value", metric.Value(), now)
+			emit("value", float64(metric.Value()), point.Gauge)
 		case metrics.GaugeFloat64:
-			agg.chanOut <- metrics.NewMetricDataPoint(name+".value", metric.Value(), now)
+			emit("value", metric.Value(), point.Gauge)
 		case metrics.Histogram:
 			h := metric.Snapshot()
 			ps := h.Percentiles(Percentiles)
-			agg.chanOut <- metrics.NewMetricDataPoint(name+".count", h.Count(), now)
-			agg.chanOut <- metrics.NewMetricDataPoint(name+".min", h.Min(), now)
-			agg.chanOut <- metrics.NewMetricDataPoint(name+".max", h.Max(), now)
-			agg.chanOut <- metrics.NewMetricDataPoint(name+".mean", h.Mean(), now)
-			agg.chanOut <- metrics.NewMetricDataPoint(name+".std-dev", h.StdDev(), now)
-
-			for j, key := range Percentiles {
-				key := strings.Replace(strconv.FormatFloat(key*100.0, 'f', -1, 64), ".", "", 1)
-				agg.chanOut <- metrics.NewMetricDataPoint(name+"-percentile"+key, ps[j], now)
+			emit("count", float64(h.Count()), point.Histogram)
+			emit("min", float64(h.Min()), point.Histogram)
+			emit("max", float64(h.Max()), point.Histogram)
+			emit("mean", h.Mean(), point.Histogram)
+			emit("std-dev", h.StdDev(), point.Histogram)
+
+			for j, p := range Percentiles {
+				emit(percentileField(p), ps[j], point.Histogram)
 			}
 		case metrics.Timer:
 			t := metric.Snapshot()
 			ps := t.Percentiles(Percentiles)
-			agg.chanOut <- metrics.NewMetricDataPoint(fmt.Sprintf("%s.%s.count", Prefix, name), t.Count(), now)
-			// rate
-			agg.chanOut <- metrics.NewMetricDataPoint(fmt.Sprintf("%s.%s.min", Prefix, name), t.Min()/int64(du), now)
-			agg.chanOut <- metrics.NewMetricDataPoint(fmt.Sprintf("%s.%s.max", Prefix, name), t.Max()/int64(du), now)
-			agg.chanOut <- metrics.NewMetricDataPoint(fmt.Sprintf("%s.%s.mean", Prefix, name), t.Mean()/du, now)
-			agg.chanOut <- metrics.NewMetricDataPoint(fmt.Sprintf("%s.%s.std-dev", Prefix, name), t.StdDev()/du, now)
-
-			agg.chanOut <- metrics.NewMetricDataPoint(name+"count", t.Count(), now)
+			// 按采样率还原真实的事件数和速率
+			count, scale := t.Count(), 1.0
+			if st, ok := metric.(*sampledTimer); ok {
+				count, scale = st.WeightedCount(), st.Scale()
+			}
+			emit("count", float64(count), point.Timer)
+			emit("min", float64(t.Min())/du, point.Timer)
+			emit("max", float64(t.Max())/du, point.Timer)
+			emit("mean", t.Mean()/du, point.Timer)
+			emit("std-dev", t.StdDev()/du, point.Timer)
 
-			for j, key := range Percentiles {
-				key := strings.Replace(strconv.FormatFloat(key*100.0, 'f', -1, 64), ".", "", 1)
-				k := fmt.Sprintf("%s.%s-percentile %.2f", Prefix, name, key)
-				agg.chanOut <- metrics.NewMetricDataPoint(k, ps[j], now)
+			for j, p := range Percentiles {
+				emit(percentileField(p), ps[j]/du, point.Timer)
 			}
-			agg.chanOut <- metrics.NewMetricDataPoint(fmt.Sprintf("%s.%s.1-minute", Prefix, name), t.Rate1(), now)
-			agg.chanOut <- metrics.NewMetricDataPoint(fmt.Sprintf("%s.%s.5-minute", Prefix, name), t.Rate5(), now)
-			agg.chanOut <- metrics.NewMetricDataPoint(fmt.Sprintf("%s.%s.15-minute", Prefix, name), t.Rate15(), now)
-			agg.chanOut <- metrics.NewMetricDataPoint(fmt.Sprintf("%s.%s.mean-rate", Prefix, name), t.RateMean(), now)
+			// rate
+			emit("1-minute", t.Rate1()*scale, point.Timer)
+			emit("5-minute", t.Rate5()*scale, point.Timer)
+			emit("15-minute", t.Rate15()*scale, point.Timer)
+			emit("mean-rate", t.RateMean()*scale, point.Timer)
 		}
 
 	})
 
 }
 
+// percentileField names a percentile by its percent, '_' stands for the
+// decimal point: 0.5 -> p50, 0.05 -> p5, 0.999 -> p99_9, 1 -> p100.
+func percentileField(p float64) string {
+	/*
+	 小数点左移两位得到百分数, 直接在十进制字符串上移动, 避免 p*100 引入的浮点误差
+	 不能像以前一样去掉小数点, 0.05 和 0.5 会同为 p5, 1 会变成 p100 而被解析为 0.1
+	*/
+	s := strconv.FormatFloat(p, 'f', -1, 64)
+	whole, frac := s, ""
+	if i := strings.IndexByte(s, '.'); i >= 0 {
+		whole, frac = s[:i], s[i+1:]
+	}
+	for len(frac) < 2 {
+		frac += "0"
+	}
+	whole = strings.TrimLeft(whole+frac[:2], "0")
+	if whole == "" {
+		whole = "0"
+	}
+	if frac = frac[2:]; frac != "" {
+		return "p" + whole + "_" + frac
+	}
+	return "p" + whole
+}
+
 func (agg *aggregator) run(shutdown chan bool, interval time.Duration) {
 	defer close(agg.exit)
 
-	ticker := time.NewTicker(time.Second * 5)
-	defer ticker.Stop()
+	for _, sh := range agg.shards {
+		go sh.run()
+	}
+	jobs := make(chan flushJob, 1)
+	flushDone := make(chan bool)
+	go agg.flushLoop(jobs, flushDone)
+	defer func() {
+		// 等待未完成的刷新, 然后停止各 shard
+		close(jobs)
+		<-flushDone
+		for _, sh := range agg.shards {
+			close(sh.in)
+			<-sh.exit
+		}
+	}()
+
+	// swapped 是上一次交换 registry 对应的时间点
+	swapped := time.Now()
+	bucket := nextFlush(swapped, interval, agg.FlushAlign)
+	timer := time.NewTimer(agg.untilFlush(bucket))
+	defer timer.Stop()
 	agg.logger.Println("Statsd aggregator started")
 	var packet []byte
 	for {
@@ -206,14 +257,54 @@ func (agg *aggregator) run(shutdown chan bool, interval time.Duration) {
 		case <-shutdown:
 			agg.logger.Println("Statsd aggregator stoped")
 			return
-		case <-ticker.C:
-			agg.Flush()
+		case <-timer.C:
+			swapped = agg.flushAt(jobs, bucket, swapped)
+			bucket = bucket.Add(interval)
+			// 刷新耗时超过一个周期时跳过错过的时间点
+			if now := time.Now(); bucket.Before(now) {
+				bucket = nextFlush(now, interval, agg.FlushAlign)
+			}
+			timer.Reset(agg.untilFlush(bucket))
 		case packet = <-agg.chanIn:
-			agg.HandlePackets(string(packet))
+			agg.HandlePackets(packet)
 		}
 	}
 }
 
+// flushAt queues the flush of bucket and returns the time of the last swap.
+// swapped is the time of the previous swap.
+func (agg *aggregator) flushAt(jobs chan flushJob, bucket, swapped time.Time) time.Time {
+	// 上一次刷新还没完成时不交换 registry, 数据留到下一个周期一起输出
+	if len(jobs) == cap(jobs) {
+		agg.logger.Printf("ERROR: statsd flush is falling behind, skip flush at %s", bucket)
+		return swapped
+	}
+	jobs <- agg.swap(bucket, bucket.Sub(swapped))
+	return bucket
+}
+
+// nextFlush returns the first flush time after t, aligned to a multiple of
+// interval on the wall clock when align is set.
+func nextFlush(t time.Time, interval time.Duration, align bool) time.Time {
+	if align {
+		return t.Truncate(interval).Add(interval)
+	}
+	return t.Add(interval)
+}
+
+// untilFlush returns how long to wait for bucket, plus a random jitter so
+// that many instances don't flush to backends at the same moment.
+func (agg *aggregator) untilFlush(bucket time.Time) time.Duration {
+	d := time.Until(bucket)
+	if agg.FlushJitter > 0 {
+		d += time.Duration(rand.Int63n(int64(agg.FlushJitter)))
+	}
+	if d < 0 {
+		d = 0
+	}
+	return d
+}
+
 func (agg *aggregator) Start() {
 	agg.logger.Println("Statsd aggregator starting")
 	go agg.run(agg.exit, time.Duration(1e9*agg.FlushSeconds))
@@ -222,4 +313,6 @@ func (agg *aggregator) Start() {
 func (agg *aggregator) Stop() {
 	agg.logger.Println("Statsd aggregator stoping")
 	agg.exit <- true
+	// run 退出时关闭 exit
+	<-agg.exit
 }
@@ -0,0 +1,84 @@
+package statsd
+
+import (
+	"testing"
+	"time"
+
+	"github.com/coder-van/v-stats/point"
+)
+
+func TestPercentileField(t *testing.T) {
+	tests := []struct {
+		p     float64
+		field string
+	}{
+		{0.5, "p50"},
+		{0.05, "p5"},
+		{0.75, "p75"},
+		{0.999, "p99_9"},
+		{0.0005, "p0_05"},
+		{1, "p100"},
+		{0, "p0"},
+	}
+	for _, tt := range tests {
+		field := percentileField(tt.p)
+		if field != tt.field {
+			t.Errorf("percentileField(%v) = %q, want %q", tt.p, field, tt.field)
+		}
+		if q, ok := point.Quantile(field); !ok || q != tt.p {
+			t.Errorf("Quantile(%q) = %v, %v, want %v", field, q, ok, tt.p)
+		}
+	}
+}
+
+func TestNextFlush(t *testing.T) {
+	now := time.Date(2020, 1, 1, 12, 0, 3, 500e6, time.UTC)
+	if got := nextFlush(now, 10*time.Second, true); !got.Equal(time.Date(2020, 1, 1, 12, 0, 10, 0, time.UTC)) {
+		t.Errorf("aligned: got %s", got)
+	}
+	if got := nextFlush(now, 10*time.Second, false); !got.Equal(now.Add(10 * time.Second)) {
+		t.Errorf("not aligned: got %s", got)
+	}
+	// 正好在对齐的时间点上时等到下一个
+	aligned := time.Date(2020, 1, 1, 12, 0, 10, 0, time.UTC)
+	if got := nextFlush(aligned, 10*time.Second, true); !got.Equal(aligned.Add(10 * time.Second)) {
+		t.Errorf("on a boundary: got %s", got)
+	}
+}
+
+func TestUntilFlush(t *testing.T) {
+	agg := &aggregator{FlushJitter: 100 * time.Millisecond}
+	for i := 0; i < 1000; i++ {
+		if d := agg.untilFlush(time.Now()); d < 0 || d >= agg.FlushJitter {
+			t.Fatalf("got %s, want [0, %s)", d, agg.FlushJitter)
+		}
+	}
+	if d := agg.untilFlush(time.Now().Add(-time.Hour)); d != 0 {
+		t.Errorf("got %s for a past flush", d)
+	}
+	agg.FlushJitter = 0
+	if d := agg.untilFlush(time.Now().Add(time.Second)); d <= 0 || d > time.Second {
+		t.Errorf("got %s without jitter", d)
+	}
+}
+
+func TestFlushSkip(t *testing.T) {
+	agg := newTestAggregator(1, SetModeExact)
+	jobs := make(chan flushJob, 1)
+	start := time.Unix(1000, 0)
+	interval := 10 * time.Second
+
+	swapped := agg.flushAt(jobs, start.Add(interval), start)
+	// 上一次刷新还没有完成, 跳过这一次
+	if got := agg.flushAt(jobs, start.Add(2*interval), swapped); !got.Equal(swapped) {
+		t.Fatalf("the skipped flush swapped at %s", got)
+	}
+	if job := <-jobs; job.elapsed != interval {
+		t.Errorf("first flush covers %s, want %s", job.elapsed, interval)
+	}
+	agg.flushAt(jobs, start.Add(3*interval), swapped)
+	// counter 的 rate 按包含跳过的周期在内的时长计算
+	if job := <-jobs; job.elapsed != 2*interval {
+		t.Errorf("the flush after a skip covers %s, want %s", job.elapsed, 2*interval)
+	}
+}
@@ -1,20 +1,28 @@
 package backends
 
 import (
+	ci "github.com/coder-van/v-stats/backends/cloudinsight"
+	"github.com/coder-van/v-stats/backends/console"
 	gb "github.com/coder-van/v-stats/backends/graghite"
-	"github.com/coder-van/v-stats/metrics"
+	"github.com/coder-van/v-stats/backends/influxdb"
+	"github.com/coder-van/v-stats/backends/opentsdb"
+	"github.com/coder-van/v-stats/backends/otlp"
+	"github.com/coder-van/v-stats/backends/prometheus"
+	"github.com/coder-van/v-stats/point"
 	"github.com/coder-van/v-util/log"
-	"strings"
+	"io"
 	"sync"
 	"time"
 )
 
+// InterfaceBackend receives flushed data points, each backend encodes them
+// into its own wire format.
 type InterfaceBackend interface {
-	Flush(batch []byte) error
+	Flush(batch []point.Point) error
 }
 
 func NewBackendManger(seconds int,
-	dataPointCh chan metrics.MetricDataPoint, bufSize int) *BackendManger {
+	dataPointCh chan point.Point, bufSize int) *BackendManger {
 
 	b := &BackendManger{
 		exit:               make(chan bool),
@@ -34,7 +42,7 @@ type BackendManger struct {
 	metricsBuffer      *Buffer
 	metricsBufferSize  int
 	FlushInterval      time.Duration
-	dataPointCh        chan metrics.MetricDataPoint
+	dataPointCh        chan point.Point
 	logger             *log.Vlogger
 }
 
@@ -45,12 +53,50 @@ func (b *BackendManger) RegisterBackend(name string, backend InterfaceBackend) {
 	b.RegisteredBackends[name] = backend
 }
 
-func (b *BackendManger) RegisterGraphite(addr string) {
-	// address, _ := net.ResolveTCPAddr("net", addr)
-	g := gb.NewGraphite(addr)
+func (b *BackendManger) RegisterGraphite(addr string, opts gb.Options) {
+	g := gb.NewGraphite(addr, opts)
 	b.RegisterBackend("graghite:"+addr, g)
 }
 
+func (b *BackendManger) RegisterCloudInsight(conf *ci.CiConfig) {
+	c := ci.NewCiBackend(conf)
+	b.RegisterBackend("cloudinsight:"+conf.URL, c)
+}
+
+func (b *BackendManger) RegisterInfluxDB(conf *influxdb.Config) {
+	i := influxdb.NewInfluxDB(conf)
+	b.RegisterBackend("influxdb:"+conf.URL, i)
+}
+
+func (b *BackendManger) RegisterPrometheus(conf *prometheus.Config) {
+	p := prometheus.NewPrometheus(conf)
+	if err := p.Start(); err != nil {
+		b.logger.Printf("Error starting prometheus backend on %s: %s", conf.ListenAddr, err)
+		return
+	}
+	b.RegisterBackend("prometheus:"+conf.ListenAddr, p)
+}
+
+func (b *BackendManger) RegisterPrometheusRemoteWrite(conf *prometheus.RemoteWriteConfig) {
+	rw := prometheus.NewRemoteWrite(conf)
+	b.RegisterBackend("prometheus_remote_write:"+conf.URL, rw)
+}
+
+func (b *BackendManger) RegisterOTLP(conf *otlp.Config) {
+	o := otlp.NewOTLP(conf)
+	b.RegisterBackend("otlp:"+conf.URL, o)
+}
+
+func (b *BackendManger) RegisterOpenTSDB(conf *opentsdb.Config) {
+	t := opentsdb.NewOpenTSDB(conf)
+	b.RegisterBackend("opentsdb:"+conf.Addr, t)
+}
+
+func (b *BackendManger) RegisterConsole(conf *console.Config) {
+	c := console.NewConsole(conf)
+	b.RegisterBackend("console:"+conf.Output, c)
+}
+
 func (b *BackendManger) run(shutdown chan bool, interval time.Duration) {
 	defer close(b.exit)
 
@@ -63,6 +109,7 @@ func (b *BackendManger) run(shutdown chan bool, interval time.Duration) {
 		case <-shutdown:
 			b.logger.Println("Hang on, Flush before shutdown")
 			b.Flush()
+			b.close()
 			b.logger.Println("Statsd BackendManger stoped")
 			return
 		case <-ticker.C:
@@ -81,14 +128,22 @@ func (b *BackendManger) Start() {
 func (b *BackendManger) Stop() {
 	b.logger.Println("Statsd BackendManger stoping")
 	b.exit <- true
+	// run 最后一次刷新并关闭 backend 的连接之后关闭 exit
+	<-b.exit
 }
 
-func (b *BackendManger) add(dp metrics.MetricDataPoint) {
-	// fmt.Printf("add datapoint %s", dp.String())
-	d := dp.String()
-	if strings.Index(d, "cpu.cpu-total.idle") >= 0 {
-		b.logger.Println(d)
+// close releases backends that hold listeners or connections.
+func (b *BackendManger) close() {
+	for name, bm := range b.RegisteredBackends {
+		if c, ok := bm.(io.Closer); ok {
+			if err := c.Close(); err != nil {
+				b.logger.Printf("Error closing backend %s: %s", name, err)
+			}
+		}
 	}
+}
+
+func (b *BackendManger) add(dp point.Point) {
 	b.metricsBuffer.Add(dp)
 	// 当缓存到了50%的时候就刷新缓存了
 	if b.metricsBuffer.Len() >= int(b.metricsBufferSize) {
@@ -99,17 +154,20 @@ func (b *BackendManger) add(dp metrics.MetricDataPoint) {
 func (b *BackendManger) Flush() {
 	var wg sync.WaitGroup
 	batch := b.metricsBuffer.Batch(b.metricsBufferSize)
+	if len(batch) == 0 {
+		return
+	}
 
 	wg.Add(len(b.RegisteredBackends))
-	for _, bm := range b.RegisteredBackends {
-		go func() {
+	for name, bm := range b.RegisteredBackends {
+		go func(name string, bm InterfaceBackend) {
 			defer wg.Done()
 			err := bm.Flush(batch)
 			if err != nil {
-				b.logger.Printf("Error occurred when posting to Forwarder API: %s \n", err.Error())
+				b.logger.Printf("Error occurred when flushing to backend %s: %s \n", name, err.Error())
 			}
 
-		}()
+		}(name, bm)
 	}
 
 	wg.Wait()
@@ -1,12 +1,12 @@
 package backends
 
 import (
-	"github.com/coder-van/v-stats/metrics"
+	"github.com/coder-van/v-stats/point"
 )
 
 // Buffer is an object for storing metrics in a circular buffer.
 type Buffer struct {
-	buf chan metrics.MetricDataPoint
+	buf chan point.Point
 	// total dropped metrics
 	drops int
 	// total metrics added
@@ -18,7 +18,7 @@ type Buffer struct {
 //   called when the buffer is full, then the oldest metric(s) will be dropped.
 func NewBuffer(size int) *Buffer {
 	return &Buffer{
-		buf: make(chan metrics.MetricDataPoint, size),
+		buf: make(chan point.Point, size),
 	}
 }
 
@@ -44,15 +44,15 @@ func (b *Buffer) Total() int {
 }
 
 // Add adds metrics to the buffer.
-func (b *Buffer) Add(metrics ...metrics.MetricDataPoint) {
-	for i := range metrics {
+func (b *Buffer) Add(points ...point.Point) {
+	for i := range points {
 		b.total++
 		select {
-		case b.buf <- metrics[i]:
+		case b.buf <- points[i]:
 		default:
 			b.drops++
 			<-b.buf
-			b.buf <- metrics[i]
+			b.buf <- points[i]
 		}
 	}
 }
@@ -60,16 +60,13 @@ func (b *Buffer) Add(metrics ...metrics.MetricDataPoint) {
 // Batch returns a batch of metrics of size batchSize.
 // the batch will be of maximum length batchSize. It can be less than batchSize,
 // if the length of Buffer is less than batchSize.
-func (b *Buffer) Batch(batchSize int) []byte {
+func (b *Buffer) Batch(batchSize int) []point.Point {
 	n := min(len(b.buf), batchSize)
-	// out := make([]metrics.MetricDataPoint, n)
-
-	bs := make([]byte, 0, 128*n)
+	out := make([]point.Point, n)
 	for i := 0; i < n; i++ {
-		dp := <-b.buf
-		bs = append(bs, []byte(dp.String())...)
+		out[i] = <-b.buf
 	}
-	return bs
+	return out
 }
 
 func min(a, b int) int {
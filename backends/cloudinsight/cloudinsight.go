@@ -5,13 +5,14 @@ import (
 	"compress/zlib"
 	"encoding/json"
 	"fmt"
-	"net/http"
 	"time"
+
+	"github.com/coder-van/v-stats/point"
 )
 
 func NewCiBackend(conf *CiConfig) *CiBackend {
 	return &CiBackend{
-		api:    NewAPI(conf.ciURL, conf.licenseKey, conf.timeout, conf.proxy),
+		api:    NewAPI(conf.URL, conf.LicenseKey, conf.Timeout(), conf.Proxy),
 		config: conf,
 	}
 }
@@ -22,23 +23,73 @@ type CiBackend struct {
 }
 
 type Payload struct {
-	Series []interface{} `json:"series"`
+	Series []Metric `json:"series"`
+}
+
+// Metric is one point of the series payload.
+type Metric struct {
+	Metric string          `json:"metric"`
+	Points [][]interface{} `json:"points"`
+	Type   string          `json:"type"`
+	Tags   []string        `json:"tags,omitempty"`
+}
+
+func newMetric(p point.Point) Metric {
+	var tags []string
+	if len(p.Tags) > 0 {
+		tags = make([]string, len(p.Tags))
+		for i, tag := range p.Tags {
+			k, v := point.SplitTag(tag)
+			if v == "" {
+				tags[i] = k
+			} else {
+				tags[i] = k + ":" + v
+			}
+		}
+	}
+	// cloudinsight 只区分 gauge 和 counter
+	typ := "gauge"
+	if p.Kind == point.Counter {
+		typ = "counter"
+	}
+	return Metric{
+		Metric: p.Path(),
+		Points: [][]interface{}{{p.Timestamp, p.Value}},
+		Type:   typ,
+		Tags:   tags,
+	}
 }
 
+// CiConfig is the [backends.cloudinsight] section of the config file.
 type CiConfig struct {
-	forwarderAddr string
-	ciURL         string
-	licenseKey    string
-	version       string
-	timeout       time.Duration
-	proxy         string
-	client        *http.Client
+	ForwarderAddr  string `toml:"forwarder_addr"`
+	URL            string `toml:"url"`
+	LicenseKey     string `toml:"license_key"`
+	TimeoutSeconds int    `toml:"timeout_seconds"`
+	Proxy          string `toml:"proxy"`
 }
 
-func (b *CiBackend) Flush(metrics []interface{}) error {
+func (c *CiConfig) Check() {
+	if c.URL == "" || c.LicenseKey == "" {
+		panic("config backends.cloudinsight url and license_key are required")
+	}
+	if c.TimeoutSeconds < 1 {
+		fmt.Println("warn config backends.cloudinsight timeout_seconds can't smaller than 1, set to 10")
+		c.TimeoutSeconds = 10
+	}
+}
+
+func (c *CiConfig) Timeout() time.Duration {
+	return time.Duration(c.TimeoutSeconds) * time.Second
+}
+
+func (b *CiBackend) Flush(points []point.Point) error {
 	start := time.Now()
 	payload := Payload{}
-	payload.Series = metrics
+	payload.Series = make([]Metric, len(points))
+	for i, p := range points {
+		payload.Series[i] = newMetric(p)
+	}
 
 	dataBytes, err := json.Marshal(&payload)
 	if err != nil {
@@ -47,9 +98,9 @@ func (b *CiBackend) Flush(metrics []interface{}) error {
 	compressed := compress(dataBytes)
 	elapsed := time.Since(start)
 
-	err = b.api.Post(b.api.GetURL("metrics"), &compressed)
+	err = b.api.Post(b.api.GetURL("series"), &compressed)
 	if err == nil {
-		fmt.Printf("Post batch of %d metrics in %s \n", len(metrics), elapsed)
+		fmt.Printf("Post batch of %d metrics in %s \n", len(points), elapsed)
 	}
 	return err
 }
@@ -0,0 +1,64 @@
+package cloudinsight
+
+import (
+	"compress/zlib"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/coder-van/v-stats/point"
+)
+
+func TestFlush(t *testing.T) {
+	var body string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" || r.URL.Path != "/infrastructure/series" || r.URL.Query().Get("license_key") != "key" {
+			t.Errorf("got %s %s", r.Method, r.URL)
+		}
+		if r.Header.Get("Content-Type") != "application/json" || r.Header.Get("Content-Encoding") != "deflate" {
+			t.Errorf("got headers %v", r.Header)
+		}
+		zr, err := zlib.NewReader(r.Body)
+		if err != nil {
+			t.Errorf("body is not deflate compressed, %s", err)
+			return
+		}
+		b, _ := ioutil.ReadAll(zr)
+		body = string(b)
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer srv.Close()
+
+	conf := &CiConfig{URL: srv.URL + "/", LicenseKey: "key"}
+	conf.Check()
+	b := NewCiBackend(conf)
+	err := b.Flush([]point.Point{
+		point.New("hits", "count", []string{"host=a", "canary"}, 3, 10, point.Counter),
+		point.New("api", "p99", nil, 1.5, 10, point.Timer),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `{"series":[` +
+		`{"metric":"hits.count","points":[[10,3]],"type":"counter","tags":["host:a","canary"]},` +
+		`{"metric":"api.p99","points":[[10,1.5]],"type":"gauge"}]}`
+	if body != want {
+		t.Errorf("got  %s\nwant %s", body, want)
+	}
+}
+
+func TestFlushError(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+	}))
+	defer srv.Close()
+
+	conf := &CiConfig{URL: srv.URL, LicenseKey: "key"}
+	conf.Check()
+	err := NewCiBackend(conf).Flush([]point.Point{point.New("a", "value", nil, 1, 10, point.Gauge)})
+	if err == nil || !strings.Contains(err.Error(), "403") {
+		t.Fatalf("got %v", err)
+	}
+}
@@ -11,7 +11,7 @@ import (
 
 func NewForwarder(conf *CiConfig) *Forwarder {
 	return &Forwarder{
-		api:    NewAPI(conf.ciURL, conf.licenseKey, conf.timeout, conf.proxy),
+		api:    NewAPI(conf.URL, conf.LicenseKey, conf.Timeout(), conf.Proxy),
 		config: conf,
 	}
 }
@@ -58,7 +58,7 @@ func (f *Forwarder) Run(shutdown chan struct{}) error {
 		MaxHeaderBytes: 1 << 20,
 	}
 
-	addr := f.config.forwarderAddr
+	addr := f.config.ForwarderAddr
 
 	l, err := net.Listen("tcp", addr)
 	if err != nil {
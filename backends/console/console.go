@@ -1 +1,148 @@
 package console
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/coder-van/v-stats/point"
+)
+
+/*
+ 调试用的 backend, 把每次刷新的数据点打印到 stdout 或 stderr
+ format: graphite(plaintext 协议的行), json(每行一个 JSON 对象), table(对齐的表格)
+ filter 是 glob 形式的名字过滤, 和 name 或者 name.field 匹配, 例如 cpu.*.idle 或 cpu.cpu-total.idle.value
+*/
+const (
+	OutputStdout = "stdout"
+	OutputStderr = "stderr"
+
+	FormatGraphite = "graphite"
+	FormatJSON     = "json"
+	FormatTable    = "table"
+)
+
+// Config is the [backends.console] section of the config file.
+type Config struct {
+	Output string `toml:"output"`
+	Format string `toml:"format"`
+	Filter string `toml:"filter"`
+}
+
+func (c *Config) Check() {
+	switch c.Output {
+	case OutputStdout, OutputStderr:
+	case "":
+		c.Output = OutputStdout
+	default:
+		panic("config backends.console output must be stdout or stderr")
+	}
+	switch c.Format {
+	case FormatGraphite, FormatJSON, FormatTable:
+	case "":
+		c.Format = FormatGraphite
+	default:
+		panic("config backends.console format must be graphite, json or table")
+	}
+	if _, err := path.Match(c.Filter, ""); err != nil {
+		panic("config backends.console filter is invail, " + err.Error())
+	}
+}
+
+func NewConsole(conf *Config) *Console {
+	var w io.Writer = os.Stdout
+	if conf.Output == OutputStderr {
+		w = os.Stderr
+	}
+	return &Console{config: conf, out: w}
+}
+
+type Console struct {
+	config *Config
+	out    io.Writer
+}
+
+func (c *Console) Flush(points []point.Point) error {
+	w := bufio.NewWriter(c.out)
+	n := 0
+	switch c.config.Format {
+	case FormatJSON:
+		enc := json.NewEncoder(w)
+		for _, p := range points {
+			if c.match(p) {
+				enc.Encode(newJSONPoint(p))
+				n++
+			}
+		}
+	case FormatTable:
+		tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "NAME\tFIELD\tKIND\tVALUE\tTIMESTAMP\tTAGS")
+		for _, p := range points {
+			if c.match(p) {
+				fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\n", p.Name, p.Field, p.Kind,
+					point.FormatValue(p.Value), time.Unix(p.Timestamp, 0).Format("15:04:05"),
+					strings.Join(p.Tags, ","))
+				n++
+			}
+		}
+		if n == 0 {
+			// 没有匹配的数据点时不打印表头
+			return nil
+		}
+		tw.Flush()
+		fmt.Fprintf(w, "-- %d points\n\n", n)
+	default:
+		for _, p := range points {
+			if c.match(p) {
+				w.WriteString(p.String())
+				n++
+			}
+		}
+	}
+	return w.Flush()
+}
+
+// match tells whether p passes the filter, an empty filter matches all.
+func (c *Console) match(p point.Point) bool {
+	if c.config.Filter == "" {
+		return true
+	}
+	if ok, _ := path.Match(c.config.Filter, p.Name); ok {
+		return true
+	}
+	ok, _ := path.Match(c.config.Filter, p.Path())
+	return ok
+}
+
+type jsonPoint struct {
+	Name      string            `json:"name"`
+	Field     string            `json:"field"`
+	Kind      string            `json:"kind"`
+	Value     float64           `json:"value"`
+	Timestamp int64             `json:"timestamp"`
+	Tags      map[string]string `json:"tags,omitempty"`
+}
+
+func newJSONPoint(p point.Point) jsonPoint {
+	jp := jsonPoint{
+		Name:      p.Name,
+		Field:     p.Field,
+		Kind:      p.Kind.String(),
+		Value:     p.Value,
+		Timestamp: p.Timestamp,
+	}
+	if len(p.Tags) > 0 {
+		jp.Tags = make(map[string]string, len(p.Tags))
+		for _, tag := range p.Tags {
+			k, v := point.SplitTag(tag)
+			jp.Tags[k] = v
+		}
+	}
+	return jp
+}
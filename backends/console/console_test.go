@@ -0,0 +1,85 @@
+package console
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/coder-van/v-stats/point"
+)
+
+var testPoints = []point.Point{
+	point.New("cpu.cpu-total", "idle", []string{"host=a"}, 97.5, 100, point.Gauge),
+	point.New("hits", "count", nil, 3, 100, point.Counter),
+	point.New("hits", "rate", nil, 0.3, 100, point.Counter),
+}
+
+func flush(t *testing.T, conf *Config, points []point.Point) string {
+	conf.Check()
+	var buf bytes.Buffer
+	c := NewConsole(conf)
+	c.out = &buf
+	if err := c.Flush(points); err != nil {
+		t.Fatal(err)
+	}
+	return buf.String()
+}
+
+func TestGraphiteFormat(t *testing.T) {
+	got := flush(t, &Config{}, testPoints)
+	want := "cpu.cpu-total.idle;host=a 97.5 100\nhits.count 3 100\nhits.rate 0.3 100\n"
+	if got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestJSONFormat(t *testing.T) {
+	got := flush(t, &Config{Format: FormatJSON}, testPoints[:1])
+	var jp jsonPoint
+	if err := json.Unmarshal([]byte(got), &jp); err != nil {
+		t.Fatalf("%q: %s", got, err)
+	}
+	if jp.Name != "cpu.cpu-total" || jp.Field != "idle" || jp.Kind != "gauge" ||
+		jp.Value != 97.5 || jp.Timestamp != 100 || jp.Tags["host"] != "a" {
+		t.Errorf("got %+v", jp)
+	}
+}
+
+func TestTableFormat(t *testing.T) {
+	got := flush(t, &Config{Format: FormatTable}, testPoints)
+	lines := strings.Split(strings.TrimRight(got, "\n"), "\n")
+	if len(lines) != 5 {
+		t.Fatalf("got %d lines: %q", len(lines), got)
+	}
+	if !strings.HasPrefix(lines[0], "NAME") || !strings.Contains(lines[1], "host=a") {
+		t.Errorf("got %q", got)
+	}
+	// 各列对齐
+	if strings.Index(lines[0], "FIELD") != strings.Index(lines[1], "idle") {
+		t.Errorf("columns are not aligned: %q", got)
+	}
+	if lines[4] != "-- 3 points" {
+		t.Errorf("got footer %q", lines[4])
+	}
+
+	if got := flush(t, &Config{Format: FormatTable, Filter: "nothing"}, testPoints); got != "" {
+		t.Errorf("got %q without matching points", got)
+	}
+}
+
+func TestFilter(t *testing.T) {
+	for _, c := range []struct {
+		filter string
+		want   string
+	}{
+		{"hits", "hits.count 3 100\nhits.rate 0.3 100\n"},
+		{"hits.rate", "hits.rate 0.3 100\n"},
+		{"cpu.*.idle", "cpu.cpu-total.idle;host=a 97.5 100\n"},
+		{"mem.*", ""},
+	} {
+		if got := flush(t, &Config{Filter: c.filter}, testPoints); got != c.want {
+			t.Errorf("filter %q: got %q, want %q", c.filter, got, c.want)
+		}
+	}
+}
@@ -1,28 +1,246 @@
 package graghite
 
 import (
-	"bufio"
+	"fmt"
 	"net"
+	"sync"
+	"time"
+
+	"github.com/coder-van/v-stats/point"
+)
+
+const (
+	DefaultTimeout = 10 * time.Second
+	// 重连等待时间从 minBackoff 开始每次失败翻倍, 最长 maxBackoff
+	minBackoff = time.Second
+	maxBackoff = time.Minute
+	// 轮询模式下重新解析域名的间隔
+	resolveInterval = time.Minute
 )
 
+type Options struct {
+	// Protocol is one of plaintext, pickle or udp
+	Protocol string
+	// Timeout bounds dialing and writing a batch
+	Timeout time.Duration
+	// RoundRobin resolves the host of Addr and spreads batches over all of
+	// its addresses, one connection per address
+	RoundRobin bool
+	// TagMode is tagged or legacy, see tags.go
+	TagMode string
+	// TagOrder is the order of tags folded into the path in legacy mode
+	TagOrder []string
+}
+
 type Graphite struct {
 	Addr string // Network address to connect to
+	opts Options
+
+	mu    sync.Mutex
+	conns []*conn
+	next  int
+	// 轮询模式下上次解析域名的时间
+	resolved time.Time
+	// 发送失败的 batch, 在下一次 Flush 时重发一次
+	retry []point.Point
 }
 
-func NewGraphite(addr string) *Graphite {
+func NewGraphite(addr string, opts Options) *Graphite {
+	if opts.Protocol == "" {
+		opts.Protocol = ProtocolPlaintext
+	}
+	if opts.TagMode == "" {
+		opts.TagMode = TagModeTagged
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = DefaultTimeout
+	}
 	return &Graphite{
 		Addr: addr,
+		opts: opts,
+	}
+}
+
+// Flush writes points over a long lived connection. A batch that fails is
+// kept and sent again, once, before the next batch.
+func (g *Graphite) Flush(points []point.Point) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	var errs []error
+	if retry := g.retry; len(retry) > 0 {
+		g.retry = nil
+		if err := g.send(retry); err != nil {
+			errs = append(errs, fmt.Errorf("dropped %d points after retry, %s", len(retry), err))
+		}
+	}
+	if err := g.send(points); err != nil {
+		if g.opts.Protocol == ProtocolUDP {
+			// udp 不重发
+			errs = append(errs, fmt.Errorf("dropped %d points, %s", len(points), err))
+		} else {
+			g.retry = points
+			errs = append(errs, fmt.Errorf("%d points queued for retry, %s", len(points), err))
+		}
+	}
+
+	switch len(errs) {
+	case 0:
+		return nil
+	case 1:
+		return fmt.Errorf("graphite %s: %s", g.Addr, errs[0])
+	default:
+		return fmt.Errorf("graphite %s: %s; %s", g.Addr, errs[0], errs[1])
+	}
+}
+
+// Close closes the connections, BackendManger calls it on shutdown after
+// the last Flush. A batch still waiting for its retry is dropped.
+func (g *Graphite) Close() error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for _, c := range g.conns {
+		c.close()
+	}
+	g.conns = nil
+	if n := len(g.retry); n > 0 {
+		g.retry = nil
+		return fmt.Errorf("graphite %s: dropped %d points queued for retry", g.Addr, n)
+	}
+	return nil
+}
+
+func (g *Graphite) send(points []point.Point) error {
+	if len(points) == 0 {
+		return nil
+	}
+	c, err := g.pick()
+	if err != nil {
+		return err
+	}
+	return c.write(points)
+}
+
+// pick returns the connection for the next batch.
+func (g *Graphite) pick() (*conn, error) {
+	if err := g.resolve(); err != nil {
+		return nil, err
+	}
+	// 跳过还在等待重连的地址
+	for i := 0; i < len(g.conns); i++ {
+		c := g.conns[g.next%len(g.conns)]
+		g.next++
+		if c.ready() {
+			return c, nil
+		}
+	}
+	c := g.conns[g.next%len(g.conns)]
+	return nil, fmt.Errorf("no reachable address, next reconnect to %s in %s",
+		c.addr, time.Until(c.retryAt).Truncate(time.Millisecond))
+}
+
+// resolve builds the connection list, in round robin mode it is refreshed
+// every resolveInterval so that DNS changes are picked up.
+func (g *Graphite) resolve() error {
+	if !g.opts.RoundRobin {
+		if g.conns == nil {
+			g.conns = []*conn{{addr: g.Addr, opts: &g.opts}}
+		}
+		return nil
+	}
+	if g.conns != nil && time.Since(g.resolved) < resolveInterval {
+		return nil
+	}
+
+	host, port, err := net.SplitHostPort(g.Addr)
+	if err != nil {
+		return err
+	}
+	addrs, err := net.LookupHost(host)
+	if err != nil {
+		if g.conns != nil {
+			// 解析失败时继续使用旧的地址
+			return nil
+		}
+		return err
 	}
+	g.resolved = time.Now()
+
+	old := make(map[string]*conn, len(g.conns))
+	for _, c := range g.conns {
+		old[c.addr] = c
+	}
+	conns := make([]*conn, 0, len(addrs))
+	for _, a := range addrs {
+		addr := net.JoinHostPort(a, port)
+		if c, ok := old[addr]; ok {
+			conns = append(conns, c)
+			delete(old, addr)
+		} else {
+			conns = append(conns, &conn{addr: addr, opts: &g.opts})
+		}
+	}
+	for _, c := range old {
+		c.close()
+	}
+	g.conns = conns
+	return nil
+}
+
+// conn is a connection to one address with exponential reconnect backoff.
+type conn struct {
+	addr    string
+	opts    *Options
+	c       net.Conn
+	backoff time.Duration
+	retryAt time.Time
 }
 
-func (g *Graphite) Flush(bs []byte) error {
-	conn, err := net.Dial("tcp", g.Addr)
-	if nil != err {
+func (c *conn) ready() bool {
+	return c.c != nil || !time.Now().Before(c.retryAt)
+}
+
+func (c *conn) dial() error {
+	nc, err := net.DialTimeout(network(c.opts.Protocol), c.addr, c.opts.Timeout)
+	if err != nil {
+		c.fail()
+		return err
+	}
+	c.c = nc
+	c.backoff = 0
+	return nil
+}
+
+func (c *conn) fail() {
+	c.close()
+	if c.backoff == 0 {
+		c.backoff = minBackoff
+	} else if c.backoff *= 2; c.backoff > maxBackoff {
+		c.backoff = maxBackoff
+	}
+	c.retryAt = time.Now().Add(c.backoff)
+}
+
+func (c *conn) close() {
+	if c.c != nil {
+		c.c.Close()
+		c.c = nil
+	}
+}
+
+func (c *conn) write(points []point.Point) error {
+	if c.c == nil {
+		if err := c.dial(); err != nil {
+			return err
+		}
+	}
+	if err := c.c.SetWriteDeadline(time.Now().Add(c.opts.Timeout)); err != nil {
+		c.fail()
+		return err
+	}
+	if err := c.opts.writePoints(c.c, points); err != nil {
+		c.fail()
 		return err
 	}
-	defer conn.Close()
-	w := bufio.NewWriter(conn)
-	w.Write(bs)
-	w.Flush()
 	return nil
 }
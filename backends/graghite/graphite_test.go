@@ -0,0 +1,222 @@
+package graghite
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coder-van/v-stats/point"
+)
+
+func TestClose(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	lines := make(chan string, 2)
+	closed := make(chan bool)
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		r := bufio.NewReader(c)
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				close(closed)
+				return
+			}
+			lines <- line
+		}
+	}()
+
+	g := NewGraphite(l.Addr().String(), Options{})
+	if err := g.Flush([]point.Point{point.New("a", "value", nil, 1, 10, point.Gauge)}); err != nil {
+		t.Fatal(err)
+	}
+	if line := <-lines; line != "a.value 1 10\n" {
+		t.Fatalf("got %q", line)
+	}
+	if err := g.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// 连接被关闭, 对端读到 EOF
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Fatal("connection is still open after Close")
+	}
+}
+
+// lineServer collects the plaintext lines sent to it.
+type lineServer struct {
+	l     net.Listener
+	lines chan string
+}
+
+func listenLines(t *testing.T, addr string) *lineServer {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &lineServer{l: l, lines: make(chan string, 100)}
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				r := bufio.NewReader(c)
+				for {
+					line, err := r.ReadString('\n')
+					if err != nil {
+						return
+					}
+					s.lines <- line
+				}
+			}()
+		}
+	}()
+	return s
+}
+
+func (s *lineServer) next(t *testing.T) string {
+	select {
+	case line := <-s.lines:
+		return line
+	case <-time.After(time.Second):
+		t.Fatal("no line received")
+		return ""
+	}
+}
+
+func gauge(name string, v float64) []point.Point {
+	return []point.Point{point.New(name, "value", nil, v, 10, point.Gauge)}
+}
+
+func TestReconnectBackoff(t *testing.T) {
+	s := listenLines(t, "127.0.0.1:0")
+	addr := s.l.Addr().String()
+	s.l.Close()
+
+	g := NewGraphite(addr, Options{Timeout: time.Second})
+	err := g.Flush(gauge("a", 1))
+	if err == nil || !strings.Contains(err.Error(), "1 points queued for retry") {
+		t.Fatalf("got %v", err)
+	}
+	c := g.conns[0]
+	if c.backoff != minBackoff {
+		t.Fatalf("backoff is %s after one failure, want %s", c.backoff, minBackoff)
+	}
+
+	// 等待重连期间不连接, 等待重试的 batch 被丢弃, 新的 batch 占用重试的位置
+	retryAt := c.retryAt
+	err = g.Flush(gauge("b", 2))
+	if err == nil || !strings.Contains(err.Error(), "dropped 1 points after retry") ||
+		!strings.Contains(err.Error(), "no reachable address") {
+		t.Fatalf("got %v", err)
+	}
+	if !c.retryAt.Equal(retryAt) || len(g.retry) != 1 || g.retry[0].Name != "b" {
+		t.Fatal("the flush during the backoff dialed or lost the new batch")
+	}
+
+	s = listenLines(t, addr)
+	defer s.l.Close()
+	c.retryAt = time.Time{}
+	if err := g.Flush(gauge("c", 3)); err != nil {
+		t.Fatal(err)
+	}
+	// 先发送重试的 batch
+	if line := s.next(t); line != "b.value 2 10\n" {
+		t.Fatalf("got %q, want the retried batch first", line)
+	}
+	if line := s.next(t); line != "c.value 3 10\n" {
+		t.Fatalf("got %q", line)
+	}
+	if c.backoff != 0 || len(g.retry) != 0 {
+		t.Fatalf("backoff %s and %d points to retry after reconnecting", c.backoff, len(g.retry))
+	}
+	g.Close()
+}
+
+func TestBackoffLimit(t *testing.T) {
+	c := &conn{}
+	want := []time.Duration{time.Second, 2 * time.Second, 4 * time.Second}
+	for _, d := range want {
+		c.fail()
+		if c.backoff != d {
+			t.Fatalf("got backoff %s, want %s", c.backoff, d)
+		}
+	}
+	for i := 0; i < 10; i++ {
+		c.fail()
+	}
+	if c.backoff != maxBackoff {
+		t.Fatalf("got backoff %s, want %s", c.backoff, maxBackoff)
+	}
+	if c.ready() {
+		t.Fatal("a conn waiting for its backoff is ready")
+	}
+}
+
+func TestRoundRobin(t *testing.T) {
+	s1 := listenLines(t, "127.0.0.1:0")
+	defer s1.l.Close()
+	s2 := listenLines(t, "127.0.0.1:0")
+	defer s2.l.Close()
+
+	// 两个地址代替域名解析出的结果
+	g := NewGraphite(s1.l.Addr().String(), Options{RoundRobin: true, Timeout: time.Second})
+	g.conns = []*conn{
+		{addr: s1.l.Addr().String(), opts: &g.opts},
+		{addr: s2.l.Addr().String(), opts: &g.opts},
+	}
+	g.resolved = time.Now()
+	for i := 0; i < 4; i++ {
+		if err := g.Flush(gauge("a", float64(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, want := range []string{"a.value 0 10\n", "a.value 2 10\n"} {
+		if line := s1.next(t); line != want {
+			t.Fatalf("first address got %q, want %q", line, want)
+		}
+	}
+	for _, want := range []string{"a.value 1 10\n", "a.value 3 10\n"} {
+		if line := s2.next(t); line != want {
+			t.Fatalf("second address got %q, want %q", line, want)
+		}
+	}
+
+	// 等待重连的地址被跳过
+	g.conns[1].close()
+	g.conns[1].retryAt = time.Now().Add(time.Minute)
+	for i := 4; i < 6; i++ {
+		if err := g.Flush(gauge("a", float64(i))); err != nil {
+			t.Fatal(err)
+		}
+		if line := s1.next(t); line != "a.value "+string(rune('0'+i))+" 10\n" {
+			t.Fatalf("got %q", line)
+		}
+	}
+
+	// 重新解析后保留仍然存在的地址的连接, 关闭消失的
+	kept, dropped := g.conns[0], g.conns[1]
+	g.resolved = time.Time{}
+	if err := g.resolve(); err != nil {
+		t.Fatal(err)
+	}
+	if len(g.conns) != 1 || g.conns[0] != kept || kept.c == nil {
+		t.Fatalf("got %d conns after resolving, want the open one kept", len(g.conns))
+	}
+	if dropped.c != nil {
+		t.Fatal("the conn of a vanished address is open")
+	}
+	g.Close()
+}
@@ -0,0 +1,162 @@
+package graghite
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"strconv"
+
+	"github.com/coder-van/v-stats/point"
+)
+
+/*
+ graphite 支持的发送协议
+ plaintext: TCP 上逐行发送 <path> <value> <timestamp>\n, 默认端口 2003
+ pickle:    TCP 上发送 4 字节长度前缀加 pickle 序列化的 [(path, (timestamp, value)), ...], 默认端口 2004,
+ carbon 解析 pickle 的开销比逐行解析小很多
+ udp:       UDP 上发送 plaintext, 不等待也不重发, 适合允许丢数据的边缘节点
+*/
+const (
+	ProtocolPlaintext = "plaintext"
+	ProtocolPickle    = "pickle"
+	ProtocolUDP       = "udp"
+)
+
+const (
+	// carbon 默认 MAX_DATAPOINTS_PER_MESSAGE
+	pickleMaxPoints = 500
+	// 保证 UDP 包不会在常见的 1500 MTU 网络上分片
+	udpMaxPayload = 1432
+)
+
+func CheckProtocol(protocol string) error {
+	switch protocol {
+	case ProtocolPlaintext, ProtocolPickle, ProtocolUDP:
+		return nil
+	default:
+		return fmt.Errorf("unknown graphite protocol %q", protocol)
+	}
+}
+
+func network(protocol string) string {
+	if protocol == ProtocolUDP {
+		return "udp"
+	}
+	return "tcp"
+}
+
+func (o *Options) writePoints(c net.Conn, points []point.Point) error {
+	points = withLegacyCounts(points)
+	switch o.Protocol {
+	case ProtocolPickle:
+		return o.writePickle(c, points)
+	case ProtocolUDP:
+		return o.writeUDP(c, points)
+	default:
+		return o.writePlaintext(c, points)
+	}
+}
+
+func (o *Options) writePlaintext(c io.Writer, points []point.Point) error {
+	w := bufio.NewWriter(c)
+	for _, p := range points {
+		if _, err := w.WriteString(o.formatLine(p)); err != nil {
+			return err
+		}
+	}
+	return w.Flush()
+}
+
+// writeUDP packs lines into datagrams, a line is never split.
+func (o *Options) writeUDP(c io.Writer, points []point.Point) error {
+	buf := make([]byte, 0, udpMaxPayload)
+	for _, p := range points {
+		line := o.formatLine(p)
+		if len(buf) > 0 && len(buf)+len(line) > udpMaxPayload {
+			if _, err := c.Write(buf); err != nil {
+				return err
+			}
+			buf = buf[:0]
+		}
+		buf = append(buf, line...)
+	}
+	if len(buf) > 0 {
+		_, err := c.Write(buf)
+		return err
+	}
+	return nil
+}
+
+func (o *Options) writePickle(c io.Writer, points []point.Point) error {
+	w := bufio.NewWriter(c)
+	var msg bytes.Buffer
+	for start := 0; start < len(points); start += pickleMaxPoints {
+		end := start + pickleMaxPoints
+		if end > len(points) {
+			end = len(points)
+		}
+		msg.Reset()
+		o.encodePickle(&msg, points[start:end])
+
+		var size [4]byte
+		binary.BigEndian.PutUint32(size[:], uint32(msg.Len()))
+		if _, err := w.Write(size[:]); err != nil {
+			return err
+		}
+		if _, err := w.Write(msg.Bytes()); err != nil {
+			return err
+		}
+	}
+	return w.Flush()
+}
+
+// pickle protocol 2 opcodes
+const (
+	pickleProto     = 0x80
+	pickleEmptyList = ']'
+	pickleMark      = '('
+	pickleUnicode   = 'X'
+	pickleInt       = 'J'
+	pickleFloat     = 'G'
+	pickleTuple2    = 0x86
+	pickleAppends   = 'e'
+	pickleStop      = '.'
+)
+
+// encodePickle writes [(path, (timestamp, value)), ...] the way python's
+// pickle.dumps(..., protocol=2) does.
+func (o *Options) encodePickle(buf *bytes.Buffer, points []point.Point) {
+	var b [8]byte
+	buf.WriteByte(pickleProto)
+	buf.WriteByte(2)
+	buf.WriteByte(pickleEmptyList)
+	buf.WriteByte(pickleMark)
+	for _, p := range points {
+		path := o.seriesPath(p)
+		buf.WriteByte(pickleUnicode)
+		binary.LittleEndian.PutUint32(b[:4], uint32(len(path)))
+		buf.Write(b[:4])
+		buf.WriteString(path)
+
+		buf.WriteByte(pickleInt)
+		binary.LittleEndian.PutUint32(b[:4], uint32(int32(p.Timestamp)))
+		buf.Write(b[:4])
+
+		buf.WriteByte(pickleFloat)
+		binary.BigEndian.PutUint64(b[:], math.Float64bits(p.Value))
+		buf.Write(b[:])
+
+		buf.WriteByte(pickleTuple2)
+		buf.WriteByte(pickleTuple2)
+	}
+	buf.WriteByte(pickleAppends)
+	buf.WriteByte(pickleStop)
+}
+
+func (o *Options) formatLine(p point.Point) string {
+	return o.seriesPath(p) + " " + point.FormatValue(p.Value) + " " + strconv.FormatInt(p.Timestamp, 10) + "\n"
+}
@@ -0,0 +1,116 @@
+package graghite
+
+import (
+	"bytes"
+	"encoding/binary"
+	"strings"
+	"testing"
+
+	"github.com/coder-van/v-stats/point"
+)
+
+// goldenPickle is
+// pickletools.optimize(pickle.dumps([("a.b", (1700000000, 1.5)), ("c;host=x", (1700000010, -2.0))], protocol=2))
+// from python 3, optimize only drops the memo opcodes carbon ignores.
+const goldenPickle = "\x80\x02](X\x03\x00\x00\x00a.bJ\x00\xf1SeG?\xf8\x00\x00\x00\x00\x00\x00\x86\x86" +
+	"X\x08\x00\x00\x00c;host=xJ\n\xf1SeG\xc0\x00\x00\x00\x00\x00\x00\x00\x86\x86e."
+
+func TestPickleFraming(t *testing.T) {
+	o := Options{Protocol: ProtocolPickle, TagMode: TagModeTagged}
+	var buf bytes.Buffer
+	err := o.writePickle(&buf, []point.Point{
+		point.New("a", "b", nil, 1.5, 1700000000, point.Gauge),
+		point.New("c", "", []string{"host=x"}, -2, 1700000010, point.Gauge),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "\x00\x00\x00\x3b" + goldenPickle
+	if buf.String() != want {
+		t.Fatalf("got  %q\nwant %q", buf.String(), want)
+	}
+}
+
+func TestPickleMaxPoints(t *testing.T) {
+	o := Options{Protocol: ProtocolPickle, TagMode: TagModeTagged}
+	points := make([]point.Point, pickleMaxPoints+1)
+	for i := range points {
+		points[i] = point.New("a", "b", nil, 1.5, 1700000000, point.Gauge)
+	}
+	var buf bytes.Buffer
+	if err := o.writePickle(&buf, points); err != nil {
+		t.Fatal(err)
+	}
+
+	// 每个消息最多 pickleMaxPoints 个数据点, 各自带长度前缀
+	const pointBytes = 24
+	b := buf.Bytes()
+	for _, n := range []int{pickleMaxPoints, 1} {
+		if len(b) < 4 {
+			t.Fatal("missing length prefix")
+		}
+		size := int(binary.BigEndian.Uint32(b))
+		if size != 6+n*pointBytes || len(b) < 4+size {
+			t.Fatalf("got a message of %d bytes, want %d points", size, n)
+		}
+		msg := b[4 : 4+size]
+		if !bytes.HasPrefix(msg, []byte("\x80\x02](")) || !bytes.HasSuffix(msg, []byte("e.")) {
+			t.Fatalf("message %q is not a protocol 2 list", msg)
+		}
+		b = b[4+size:]
+	}
+	if len(b) != 0 {
+		t.Fatalf("%d bytes after the last message", len(b))
+	}
+}
+
+// datagrams records every Write as one datagram.
+type datagrams [][]byte
+
+func (d *datagrams) Write(b []byte) (int, error) {
+	*d = append(*d, append([]byte(nil), b...))
+	return len(b), nil
+}
+
+func TestUDPPacking(t *testing.T) {
+	o := Options{Protocol: ProtocolUDP, TagMode: TagModeTagged}
+	var points []point.Point
+	var want strings.Builder
+	for i := 0; i < 200; i++ {
+		p := point.New(strings.Repeat("x", i%50+1), "value", nil, float64(i), 10, point.Gauge)
+		points = append(points, p)
+		want.WriteString(o.formatLine(p))
+	}
+
+	var d datagrams
+	if err := o.writeUDP(&d, points); err != nil {
+		t.Fatal(err)
+	}
+	if len(d) < 2 {
+		t.Fatalf("got %d datagrams, want the lines split", len(d))
+	}
+	var got strings.Builder
+	for _, dg := range d {
+		if len(dg) > udpMaxPayload {
+			t.Errorf("datagram of %d bytes is over the mtu", len(dg))
+		}
+		// 一行不会被拆到两个包中
+		if dg[len(dg)-1] != '\n' {
+			t.Errorf("datagram ends inside a line: %q", dg[len(dg)-20:])
+		}
+		got.Write(dg)
+	}
+	if got.String() != want.String() {
+		t.Error("the datagrams don't hold every line in order")
+	}
+
+	// 超过上限的单行单独发送
+	d = nil
+	long := point.New(strings.Repeat("y", udpMaxPayload), "value", nil, 1, 10, point.Gauge)
+	if err := o.writeUDP(&d, []point.Point{points[0], long, points[1]}); err != nil {
+		t.Fatal(err)
+	}
+	if len(d) != 3 {
+		t.Fatalf("got %d datagrams, want the long line on its own", len(d))
+	}
+}
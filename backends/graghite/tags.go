@@ -0,0 +1,139 @@
+package graghite
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/coder-van/v-stats/point"
+)
+
+/*
+ tags 的输出方式
+ tagged: graphite 1.1 的 tagged series, <path>;<tag1>=<v1>;<tag2>=<v2>
+ legacy: 把 tags 折叠进路径, <name>.<tag1>.<v1>.<tag2>.<v2>.<field>,
+ tag 的顺序由 tag_order 决定, 不在其中的 tag 按名字排在后面
+*/
+const (
+	TagModeTagged = "tagged"
+	TagModeLegacy = "legacy"
+)
+
+var (
+	// graphite 不接受 tag 中出现空格, ';', '~' 和 '='
+	tagReplacer = strings.NewReplacer(" ", "_", ";", "_", "~", "_", "=", "_")
+	// legacy 模式下 '.' 是路径分隔符
+	legacyReplacer = strings.NewReplacer(" ", "_", ";", "_", "~", "_", "=", "_", ".", "_")
+	pathReplacer   = strings.NewReplacer(" ", "_", ";", "_")
+)
+
+func CheckTagMode(mode string) error {
+	switch mode {
+	case TagModeTagged, TagModeLegacy:
+		return nil
+	default:
+		return fmt.Errorf("unknown graphite tag mode %q", mode)
+	}
+}
+
+type tag struct {
+	key, value string
+}
+
+// seriesPath is the name of p as graphite sees it, tags included.
+func (o *Options) seriesPath(p point.Point) string {
+	p = legacyName(p)
+	path := pathReplacer.Replace(p.Path())
+	if len(p.Tags) == 0 {
+		return path
+	}
+
+	if o.TagMode != TagModeLegacy {
+		parts := make([]string, 0, len(p.Tags)+1)
+		parts = append(parts, path)
+		for _, t := range p.Tags {
+			k, v := point.SplitTag(t)
+			if k = tagReplacer.Replace(k); k == "" {
+				continue
+			}
+			if v = tagReplacer.Replace(v); v == "" {
+				// graphite 要求 tag 有值
+				v = "true"
+			}
+			parts = append(parts, k+"="+v)
+		}
+		return strings.Join(parts, ";")
+	}
+
+	tags := make([]tag, 0, len(p.Tags))
+	for _, t := range p.Tags {
+		k, v := point.SplitTag(t)
+		tags = append(tags, tag{key: legacyReplacer.Replace(k), value: legacyReplacer.Replace(v)})
+	}
+	sort.SliceStable(tags, func(i, j int) bool {
+		return o.tagRank(tags[i].key) < o.tagRank(tags[j].key)
+	})
+	parts := make([]string, 0, 2*len(tags)+2)
+	parts = append(parts, pathReplacer.Replace(p.Name))
+	for _, t := range tags {
+		parts = append(parts, t.key)
+		if t.value != "" {
+			parts = append(parts, t.value)
+		}
+	}
+	if p.Field != "" {
+		parts = append(parts, p.Field)
+	}
+	return strings.Join(parts, ".")
+}
+
+/*
+ 保持改为结构化数据点之前的 graphite 名字, 已有的 dashboard 依赖它们
+ 百分位: <name>-percentile50, <name>-percentile999
+ timer 的 count 除 <name>.count 之外还有一份 <name>count
+*/
+
+// legacyName moves the percentile of p into its name the way graphite
+// paths were built before.
+func legacyName(p point.Point) point.Point {
+	if q, ok := point.Quantile(p.Field); ok {
+		p.Name += "-percentile" + strings.Replace(strconv.FormatFloat(q*100, 'f', -1, 64), ".", "", 1)
+		p.Field = ""
+	}
+	return p
+}
+
+// withLegacyCounts appends the <name>count copy of every timer count.
+func withLegacyCounts(points []point.Point) []point.Point {
+	n := 0
+	for _, p := range points {
+		if p.Kind == point.Timer && p.Field == "count" {
+			n++
+		}
+	}
+	if n == 0 {
+		return points
+	}
+	out := make([]point.Point, 0, len(points)+n)
+	for _, p := range points {
+		out = append(out, p)
+		if p.Kind == point.Timer && p.Field == "count" {
+			p.Name += "count"
+			p.Field = ""
+			out = append(out, p)
+		}
+	}
+	return out
+}
+
+// tagRank orders tags listed in TagOrder before the others, which keep
+// their sorted order.
+func (o *Options) tagRank(key string) int {
+	for i, k := range o.TagOrder {
+		if k == key {
+			return i
+		}
+	}
+	return len(o.TagOrder)
+}
@@ -0,0 +1,45 @@
+package graghite
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/coder-van/v-stats/point"
+)
+
+func TestSeriesPath(t *testing.T) {
+	tests := []struct {
+		mode string
+		p    point.Point
+		path string
+	}{
+		{TagModeTagged, point.New("api", "count", nil, 1, 0, point.Counter), "api.count"},
+		{TagModeTagged, point.New("api", "p50", []string{"host=a"}, 1, 0, point.Timer), "api-percentile50;host=a"},
+		{TagModeTagged, point.New("api", "p99_9", nil, 1, 0, point.Histogram), "api-percentile999"},
+		{TagModeTagged, point.New("a b", "value", []string{"x=1 2", "flag"}, 1, 0, point.Gauge), "a_b.value;x=1_2;flag=true"},
+		{TagModeLegacy, point.New("api", "max", []string{"env=prod", "host=a.b"}, 1, 0, point.Timer), "api.env.prod.host.a_b.max"},
+		{TagModeLegacy, point.New("api", "p75", []string{"host=a"}, 1, 0, point.Timer), "api-percentile75.host.a"},
+	}
+	for _, tt := range tests {
+		o := Options{TagMode: tt.mode}
+		if path := o.seriesPath(tt.p); path != tt.path {
+			t.Errorf("%s %s.%s: got %q, want %q", tt.mode, tt.p.Name, tt.p.Field, path, tt.path)
+		}
+	}
+}
+
+func TestLegacyTimerCount(t *testing.T) {
+	o := Options{TagMode: TagModeTagged}
+	points := []point.Point{
+		point.New("api", "count", nil, 3, 10, point.Timer),
+		point.New("hits", "count", nil, 5, 10, point.Counter),
+	}
+	var buf bytes.Buffer
+	if err := o.writePlaintext(&buf, withLegacyCounts(points)); err != nil {
+		t.Fatal(err)
+	}
+	want := "api.count 3 10\napicount 3 10\nhits.count 5 10\n"
+	if buf.String() != want {
+		t.Fatalf("got %q, want %q", buf.String(), want)
+	}
+}
@@ -0,0 +1,197 @@
+package influxdb
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coder-van/v-stats/backends/push"
+	"github.com/coder-van/v-stats/point"
+)
+
+/*
+ 把数据点编码成 line protocol 写入 InfluxDB
+ 同一个 series 在同一时间点的多个值(例如 timer 的 count, min, max, p99)作为同一个 measurement 的多个 field 写入一行:
+ <name>,<tag1>=<v1> count=10,min=1,max=20,p99=18 <timestamp>
+ NaN 和 Inf 不能用 line protocol 表示, 一个这样的值会让整个请求被拒绝, 编码时跳过
+ 失败的请求按 backends/push 的规则重试, 5xx 和 429 重试, 其他错误直接丢弃
+*/
+
+// Config is the [backends.influxdb] section of the config file.
+type Config struct {
+	URL string `toml:"url"`
+	// Version is 1 for /write or 2 for /api/v2/write
+	Version int `toml:"version"`
+	// v1
+	Database        string `toml:"database"`
+	RetentionPolicy string `toml:"retention_policy"`
+	Username        string `toml:"username"`
+	Password        string `toml:"password"`
+	// v2
+	Org    string `toml:"org"`
+	Bucket string `toml:"bucket"`
+	Token  string `toml:"token"`
+
+	TimeoutSeconds int `toml:"timeout_seconds"`
+	MaxRetries     int `toml:"max_retries"`
+}
+
+func (c *Config) Check() {
+	if c.URL == "" {
+		panic("config backends.influxdb url is required")
+	}
+	switch c.Version {
+	case 0, 1:
+		c.Version = 1
+		if c.Database == "" {
+			panic("config backends.influxdb database is required for version 1")
+		}
+	case 2:
+		if c.Org == "" || c.Bucket == "" || c.Token == "" {
+			panic("config backends.influxdb org, bucket and token are required for version 2")
+		}
+	default:
+		panic("config backends.influxdb version must be 1 or 2")
+	}
+	if c.TimeoutSeconds < 1 {
+		fmt.Println("warn config backends.influxdb timeout_seconds can't smaller than 1, set to 10")
+		c.TimeoutSeconds = 10
+	}
+	if c.MaxRetries < 1 {
+		fmt.Println("warn config backends.influxdb max_retries can't smaller than 1, set to 3")
+		c.MaxRetries = 3
+	}
+}
+
+// WriteURL returns the write endpoint for the configured version.
+func (c *Config) WriteURL() string {
+	base := strings.TrimSuffix(c.URL, "/")
+	q := url.Values{"precision": []string{"s"}}
+	if c.Version == 2 {
+		q.Set("org", c.Org)
+		q.Set("bucket", c.Bucket)
+		return base + "/api/v2/write?" + q.Encode()
+	}
+	q.Set("db", c.Database)
+	if c.RetentionPolicy != "" {
+		q.Set("rp", c.RetentionPolicy)
+	}
+	return base + "/write?" + q.Encode()
+}
+
+func NewInfluxDB(conf *Config) *InfluxDB {
+	return &InfluxDB{
+		config:   conf,
+		writeURL: conf.WriteURL(),
+		client:   &http.Client{Timeout: time.Duration(conf.TimeoutSeconds) * time.Second},
+		queue:    push.Queue{MaxRetries: conf.MaxRetries, Unit: "points"},
+	}
+}
+
+type InfluxDB struct {
+	config   *Config
+	writeURL string
+	client   *http.Client
+
+	mu    sync.Mutex
+	queue push.Queue
+}
+
+func (b *InfluxDB) Flush(points []point.Point) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if lines := Encode(points); len(lines) > 0 {
+		body, err := push.Gzip(lines)
+		if err != nil {
+			return fmt.Errorf("unable to compress batch, %s", err.Error())
+		}
+		b.queue.Add(body, len(points))
+	}
+	return b.queue.Send(b.post)
+}
+
+func (b *InfluxDB) post(body []byte) error {
+	req, err := http.NewRequest("POST", b.writeURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	req.Header.Set("Content-Encoding", "gzip")
+	if b.config.Version == 2 {
+		req.Header.Set("Authorization", "Token "+b.config.Token)
+	} else if b.config.Username != "" {
+		req.SetBasicAuth(b.config.Username, b.config.Password)
+	}
+	return push.Do(b.client, req, "influxdb")
+}
+
+var (
+	measurementEscaper = strings.NewReplacer(",", `\,`, " ", `\ `)
+	keyEscaper         = strings.NewReplacer(",", `\,`, "=", `\=`, " ", `\ `)
+)
+
+// Encode renders points as line protocol, points of the same series and
+// timestamp become the fields of a single line.
+func Encode(points []point.Point) []byte {
+	var buf bytes.Buffer
+	lines := make(map[string]int, len(points))
+	var order []string
+	var fields [][]string
+	var timestamps []int64
+
+	for _, p := range points {
+		if math.IsNaN(p.Value) || math.IsInf(p.Value, 0) {
+			continue
+		}
+		series := seriesKey(p)
+		k := series + " " + strconv.FormatInt(p.Timestamp, 10)
+		i, ok := lines[k]
+		if !ok {
+			i = len(order)
+			lines[k] = i
+			order = append(order, series)
+			fields = append(fields, nil)
+			timestamps = append(timestamps, p.Timestamp)
+		}
+		field := p.Field
+		if field == "" {
+			field = "value"
+		}
+		fields[i] = append(fields[i], keyEscaper.Replace(field)+"="+point.FormatValue(p.Value))
+	}
+
+	for i, series := range order {
+		buf.WriteString(series)
+		buf.WriteByte(' ')
+		buf.WriteString(strings.Join(fields[i], ","))
+		buf.WriteByte(' ')
+		buf.WriteString(strconv.FormatInt(timestamps[i], 10))
+		buf.WriteByte('\n')
+	}
+	return buf.Bytes()
+}
+
+// seriesKey is the measurement and tag set part of a line.
+func seriesKey(p point.Point) string {
+	var buf bytes.Buffer
+	buf.WriteString(measurementEscaper.Replace(p.Name))
+	for _, tag := range p.Tags {
+		k, v := point.SplitTag(tag)
+		if k == "" || v == "" {
+			// line protocol 不允许空的 tag 值
+			continue
+		}
+		buf.WriteByte(',')
+		buf.WriteString(keyEscaper.Replace(k))
+		buf.WriteByte('=')
+		buf.WriteString(keyEscaper.Replace(v))
+	}
+	return buf.String()
+}
@@ -0,0 +1,66 @@
+package influxdb
+
+import (
+	"compress/gzip"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/coder-van/v-stats/point"
+)
+
+func TestEncode(t *testing.T) {
+	points := []point.Point{
+		point.New("api lat", "count", []string{"host=a,b", "flag"}, 10, 100, point.Timer),
+		point.New("api lat", "max", []string{"host=a,b", "flag"}, 20, 100, point.Timer),
+		point.New("api lat", "mean", []string{"host=a,b", "flag"}, math.NaN(), 100, point.Timer),
+		point.New("api lat", "std-dev", []string{"host=a,b", "flag"}, math.Inf(1), 100, point.Timer),
+		point.New("temp", "", nil, -1.5, 100, point.Gauge),
+		point.New("bad", "value", nil, math.Inf(-1), 100, point.Gauge),
+	}
+	want := "api\\ lat,host=a\\,b count=10,max=20 100\ntemp value=-1.5 100\n"
+	if got := string(Encode(points)); got != want {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+}
+
+func TestFlush(t *testing.T) {
+	var body, auth string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		zr, err := gzip.NewReader(r.Body)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		b, _ := ioutil.ReadAll(zr)
+		body, auth = string(b), r.Header.Get("Authorization")
+		if r.URL.Path != "/api/v2/write" || r.URL.Query().Get("bucket") != "b" {
+			t.Errorf("got url %s", r.URL)
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+
+	conf := &Config{URL: srv.URL, Version: 2, Org: "o", Bucket: "b", Token: "t"}
+	conf.Check()
+	if err := NewInfluxDB(conf).Flush([]point.Point{point.New("a", "value", nil, 1, 1, point.Gauge)}); err != nil {
+		t.Fatal(err)
+	}
+	if body != "a value=1 1\n" || auth != "Token t" {
+		t.Errorf("got body %q, authorization %q", body, auth)
+	}
+}
+
+func TestFlushNonFinite(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("unexpected request")
+	}))
+	defer srv.Close()
+	conf := &Config{URL: srv.URL, Database: "db"}
+	conf.Check()
+	if err := NewInfluxDB(conf).Flush([]point.Point{point.New("a", "value", nil, math.NaN(), 1, point.Gauge)}); err != nil {
+		t.Fatal(err)
+	}
+}
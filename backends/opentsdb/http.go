@@ -0,0 +1,137 @@
+package opentsdb
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/coder-van/v-stats/point"
+)
+
+type jsonPoint struct {
+	Metric    string            `json:"metric"`
+	Timestamp int64             `json:"timestamp"`
+	Value     float64           `json:"value"`
+	Tags      map[string]string `json:"tags"`
+}
+
+// putResponse is the body returned by /api/put?details.
+type putResponse struct {
+	Success int `json:"success"`
+	Failed  int `json:"failed"`
+	Errors  []struct {
+		Error string `json:"error"`
+	} `json:"errors"`
+}
+
+func newHTTPWriter(conf *Config) *httpWriter {
+	return &httpWriter{
+		config: conf,
+		url:    strings.TrimSuffix(conf.Addr, "/") + "/api/put?details",
+		client: &http.Client{Timeout: conf.Timeout()},
+	}
+}
+
+type httpWriter struct {
+	config *Config
+	url    string
+	client *http.Client
+}
+
+func (w *httpWriter) close() {}
+
+// write posts points as JSON arrays no larger than MaxRequestBytes.
+func (w *httpWriter) write(points []point.Point) error {
+	var errs []string
+	failed := 0
+	body := bytes.NewBufferString("[")
+	n := 0
+	flush := func() {
+		if n == 0 {
+			return
+		}
+		body.WriteByte(']')
+		if f, err := w.post(body.Bytes(), n); err != nil {
+			failed += f
+			errs = append(errs, err.Error())
+		}
+		body.Reset()
+		body.WriteByte('[')
+		n = 0
+	}
+
+	for _, p := range points {
+		if !finite(p) {
+			continue
+		}
+		jp := jsonPoint{
+			Metric:    metricName(p),
+			Timestamp: p.Timestamp,
+			Value:     p.Value,
+			Tags:      make(map[string]string),
+		}
+		for _, tag := range tags(p, w.config.DefaultHost) {
+			jp.Tags[tag[0]] = tag[1]
+		}
+		b, err := json.Marshal(jp)
+		if err != nil {
+			failed++
+			errs = append(errs, err.Error())
+			continue
+		}
+		if len(b)+2 > w.config.MaxRequestBytes {
+			failed++
+			errs = append(errs, fmt.Sprintf("%s is larger than max_request_bytes", jp.Metric))
+			continue
+		}
+		// 加上逗号和结尾的 ] 之后超出限制就先发送
+		if body.Len()+len(b)+2 > w.config.MaxRequestBytes {
+			flush()
+		}
+		if n > 0 {
+			body.WriteByte(',')
+		}
+		body.Write(b)
+		n++
+	}
+	flush()
+
+	if failed == 0 {
+		return nil
+	}
+	if len(errs) == 0 {
+		return fmt.Errorf("opentsdb %s: dropped %d of %d points", w.config.Addr, failed, len(points))
+	}
+	return fmt.Errorf("opentsdb %s: dropped %d of %d points, %s", w.config.Addr, failed, len(points), errs[0])
+}
+
+// post sends one request of n points, it returns how many of them failed.
+func (w *httpWriter) post(body []byte, n int) (int, error) {
+	resp, err := w.client.Post(w.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return n, err
+	}
+	defer resp.Body.Close()
+	msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	if resp.StatusCode/100 == 2 {
+		return 0, nil
+	}
+
+	var pr putResponse
+	if err := json.Unmarshal(msg, &pr); err == nil && pr.Failed > 0 {
+		// 部分失败时 OpenTSDB 返回 400 和每个失败数据点的原因
+		reason := ""
+		if len(pr.Errors) > 0 {
+			reason = ", " + pr.Errors[0].Error
+		}
+		return pr.Failed, fmt.Errorf("%d points failed%s", pr.Failed, reason)
+	}
+	if len(msg) > 1024 {
+		msg = msg[:1024]
+	}
+	return n, fmt.Errorf("responded %d: %s", resp.StatusCode, strings.TrimSpace(string(msg)))
+}
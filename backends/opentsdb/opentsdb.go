@@ -0,0 +1,163 @@
+package opentsdb
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"net/url"
+	"os"
+	"time"
+
+	"github.com/coder-van/v-stats/point"
+)
+
+/*
+ 写入 OpenTSDB, 两种协议:
+ telnet: 在长连接上写 put <metric> <timestamp> <value> <tagk1=tagv1 ...>
+ http: POST JSON 数组到 /api/put?details, 按 max_request_bytes 切分成多个请求,
+ OpenTSDB 默认不接受超过 4096 字节的请求(tsd.http.request.max_chunk)
+ OpenTSDB 要求每个数据点至少有一个 tag, 没有 host tag 的数据点会加上 host=<default_host>
+ metric 名和 tag 只允许 a-z A-Z 0-9 - _ . /, 其他字符替换成 _
+ OpenTSDB 不接受 NaN 和 Inf, 这样的数据点直接跳过
+*/
+const (
+	ProtocolTelnet = "telnet"
+	ProtocolHTTP   = "http"
+
+	// telnet 模式下 OpenTSDB 按行读取, 超过 1024 字节的行会被拒绝
+	maxLineBytes = 1024
+
+	// 重连等待时间从 minBackoff 开始每次失败翻倍, 最长 maxBackoff
+	minBackoff = time.Second
+	maxBackoff = time.Minute
+)
+
+// Config is the [backends.opentsdb] section of the config file.
+type Config struct {
+	Protocol string `toml:"protocol"`
+	// Addr is host:port for telnet, the base URL for http
+	Addr            string `toml:"addr"`
+	DefaultHost     string `toml:"default_host"`
+	MaxRequestBytes int    `toml:"max_request_bytes"`
+	TimeoutSeconds  int    `toml:"timeout_seconds"`
+}
+
+func (c *Config) Check() {
+	switch c.Protocol {
+	case ProtocolTelnet, ProtocolHTTP:
+	case "":
+		c.Protocol = ProtocolTelnet
+	default:
+		panic("config backends.opentsdb protocol must be telnet or http")
+	}
+	if c.Addr == "" {
+		panic("config backends.opentsdb addr is required")
+	}
+	if c.Protocol == ProtocolTelnet {
+		if _, _, err := net.SplitHostPort(c.Addr); err != nil {
+			panic("config backends.opentsdb addr must be host:port in telnet protocol")
+		}
+	} else {
+		u, err := url.Parse(c.Addr)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			panic("config backends.opentsdb addr must be an http or https url in http protocol")
+		}
+	}
+	if c.DefaultHost == "" {
+		host, err := os.Hostname()
+		if err != nil {
+			host = "unknown"
+		}
+		fmt.Println("warn config backends.opentsdb default_host is empty, set to " + host)
+		c.DefaultHost = host
+	}
+	if c.MaxRequestBytes < 1 {
+		fmt.Println("warn config backends.opentsdb max_request_bytes can't smaller than 1, set to 4096")
+		c.MaxRequestBytes = 4096
+	}
+	if c.TimeoutSeconds < 1 {
+		fmt.Println("warn config backends.opentsdb timeout_seconds can't smaller than 1, set to 10")
+		c.TimeoutSeconds = 10
+	}
+}
+
+func (c *Config) Timeout() time.Duration {
+	return time.Duration(c.TimeoutSeconds) * time.Second
+}
+
+type writer interface {
+	write(points []point.Point) error
+	close()
+}
+
+func NewOpenTSDB(conf *Config) *OpenTSDB {
+	t := &OpenTSDB{config: conf}
+	if conf.Protocol == ProtocolHTTP {
+		t.w = newHTTPWriter(conf)
+	} else {
+		t.w = newTelnetWriter(conf)
+	}
+	return t
+}
+
+type OpenTSDB struct {
+	config *Config
+	w      writer
+}
+
+func (t *OpenTSDB) Flush(points []point.Point) error {
+	if len(points) == 0 {
+		return nil
+	}
+	return t.w.write(points)
+}
+
+func (t *OpenTSDB) Close() error {
+	t.w.close()
+	return nil
+}
+
+// finite tells whether OpenTSDB accepts the value of p.
+func finite(p point.Point) bool {
+	return !math.IsNaN(p.Value) && !math.IsInf(p.Value, 0)
+}
+
+// metricName returns the OpenTSDB metric of a point, "<name>.<field>".
+func metricName(p point.Point) string {
+	return sanitize(p.Path())
+}
+
+// tags returns the sanitized tags of p, with host added when missing.
+func tags(p point.Point, defaultHost string) [][2]string {
+	ts := make([][2]string, 0, len(p.Tags)+1)
+	hasHost := false
+	for _, tag := range p.Tags {
+		k, v := point.SplitTag(tag)
+		k, v = sanitize(k), sanitize(v)
+		if k == "" || v == "" {
+			// OpenTSDB 不允许空的 tag 值
+			continue
+		}
+		if k == "host" {
+			hasHost = true
+		}
+		ts = append(ts, [2]string{k, v})
+	}
+	if !hasHost {
+		ts = append(ts, [2]string{"host", sanitize(defaultHost)})
+	}
+	return ts
+}
+
+func sanitize(s string) string {
+	b := []byte(s)
+	for i, c := range b {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case c == '-', c == '_', c == '.', c == '/':
+		default:
+			b[i] = '_'
+		}
+	}
+	return string(b)
+}
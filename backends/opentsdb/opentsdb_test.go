@@ -0,0 +1,285 @@
+package opentsdb
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"math"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/coder-van/v-stats/point"
+)
+
+func testConfig(protocol, addr string) *Config {
+	c := &Config{Protocol: protocol, Addr: addr, DefaultHost: "h1", MaxRequestBytes: 4096, TimeoutSeconds: 1}
+	c.Check()
+	return c
+}
+
+func TestTelnetEncode(t *testing.T) {
+	w := newTelnetWriter(testConfig(ProtocolTelnet, "127.0.0.1:4242"))
+	buf, skipped := w.encode([]point.Point{
+		point.New("api.lat ms", "p99", []string{"dc=eu west"}, 1.5, 10, point.Timer),
+		point.New("hits", "count", []string{"host=web1", "empty="}, 3, 10, point.Counter),
+		point.New("nan", "value", nil, math.NaN(), 10, point.Gauge),
+		point.New("inf", "value", nil, math.Inf(-1), 10, point.Gauge),
+		point.New("long", "value", []string{"k=" + strings.Repeat("v", maxLineBytes)}, 1, 10, point.Gauge),
+	})
+	want := "put api.lat_ms.p99 10 1.5 dc=eu_west host=h1\n" +
+		"put hits.count 10 3 host=web1\n"
+	if string(buf) != want {
+		t.Errorf("got\n%s\nwant\n%s", buf, want)
+	}
+	// NaN 和 Inf 不算作被跳过的长行
+	if skipped != 1 {
+		t.Errorf("skipped %d lines, want 1", skipped)
+	}
+}
+
+// lineServer accepts telnet connections and collects the lines they send.
+type lineServer struct {
+	l     net.Listener
+	lines chan string
+	mu    sync.Mutex
+	conns []net.Conn
+}
+
+func newLineServer(t *testing.T) *lineServer {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &lineServer{l: l, lines: make(chan string, 100)}
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			s.mu.Lock()
+			s.conns = append(s.conns, c)
+			s.mu.Unlock()
+			go func() {
+				r := bufio.NewReader(c)
+				for {
+					line, err := r.ReadString('\n')
+					if err != nil {
+						return
+					}
+					s.lines <- line
+				}
+			}()
+		}
+	}()
+	return s
+}
+
+// dropConns closes the server side of every connection.
+func (s *lineServer) dropConns() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, c := range s.conns {
+		c.Close()
+	}
+	s.conns = nil
+}
+
+func (s *lineServer) next(t *testing.T) string {
+	select {
+	case line := <-s.lines:
+		return line
+	case <-time.After(time.Second):
+		t.Fatal("no line received")
+		return ""
+	}
+}
+
+func TestTelnetReconnect(t *testing.T) {
+	s := newLineServer(t)
+	defer s.l.Close()
+	db := NewOpenTSDB(testConfig(ProtocolTelnet, s.l.Addr().String()))
+	defer db.Close()
+
+	p := []point.Point{point.New("a", "value", nil, 1, 10, point.Gauge)}
+	if err := db.Flush(p); err != nil {
+		t.Fatal(err)
+	}
+	if line := s.next(t); line != "put a.value 10 1 host=h1\n" {
+		t.Fatalf("got %q", line)
+	}
+
+	// 对端关闭了连接, 第一次写入可能还会成功, 之后的写入失败并在新的连接上重发
+	s.dropConns()
+	w := db.w.(*telnetWriter)
+	deadline := time.Now().Add(time.Second)
+	for {
+		if err := db.Flush(p); err != nil {
+			t.Fatal(err)
+		}
+		if w.backoff != 0 {
+			t.Fatalf("reconnecting a dropped connection backed off %s", w.backoff)
+		}
+		s.mu.Lock()
+		n := len(s.conns)
+		s.mu.Unlock()
+		if n > 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the writer did not reconnect")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if line := s.next(t); line != "put a.value 10 1 host=h1\n" {
+		t.Fatalf("got %q on the new connection", line)
+	}
+}
+
+func TestTelnetBackoff(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	w := newTelnetWriter(testConfig(ProtocolTelnet, addr))
+	p := []point.Point{point.New("a", "value", nil, 1, 10, point.Gauge)}
+	if err := w.write(p); err == nil {
+		t.Fatal("writing to a closed port succeeded")
+	}
+	if w.backoff != minBackoff {
+		t.Fatalf("backoff is %s after one failure, want %s", w.backoff, minBackoff)
+	}
+	// 等待期间不再连接
+	retryAt := w.retryAt
+	if err := w.write(p); err == nil || !strings.Contains(err.Error(), "next reconnect") {
+		t.Fatalf("got %v during the backoff", err)
+	}
+	if !w.retryAt.Equal(retryAt) || w.backoff != minBackoff {
+		t.Fatal("a write during the backoff dialed again")
+	}
+
+	// 每次失败翻倍, 不超过 maxBackoff
+	for i := 0; i < 10; i++ {
+		w.retryAt = time.Time{}
+		w.write(p)
+	}
+	if w.backoff != maxBackoff {
+		t.Fatalf("backoff is %s after many failures, want %s", w.backoff, maxBackoff)
+	}
+}
+
+func TestHTTPWrite(t *testing.T) {
+	var mu sync.Mutex
+	var bodies [][]jsonPoint
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" || r.URL.Path != "/api/put" || r.URL.RawQuery != "details" {
+			t.Errorf("got %s %s", r.Method, r.URL)
+		}
+		if ct := r.Header.Get("Content-Type"); ct != "application/json" {
+			t.Errorf("content type %q", ct)
+		}
+		b, _ := ioutil.ReadAll(r.Body)
+		var ps []jsonPoint
+		if err := json.Unmarshal(b, &ps); err != nil {
+			t.Errorf("body %q: %s", b, err)
+		}
+		mu.Lock()
+		bodies = append(bodies, ps)
+		mu.Unlock()
+		rw.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+
+	conf := testConfig(ProtocolHTTP, srv.URL+"/")
+	conf.MaxRequestBytes = 200
+	db := NewOpenTSDB(conf)
+	var points []point.Point
+	for i := 0; i < 5; i++ {
+		points = append(points, point.New("cpu", "value", []string{"core=" + string(rune('0'+i))}, float64(i), 10, point.Gauge))
+	}
+	points = append(points, point.New("nan", "value", nil, math.NaN(), 10, point.Gauge))
+	if err := db.Flush(points); err != nil {
+		t.Fatal(err)
+	}
+
+	// 每个请求不超过 max_request_bytes, 被分成多个请求
+	if len(bodies) < 2 {
+		t.Fatalf("got %d requests, want the batch split", len(bodies))
+	}
+	n := 0
+	for _, ps := range bodies {
+		for _, p := range ps {
+			if p.Metric != "cpu.value" || p.Timestamp != 10 || p.Tags["host"] != "h1" || p.Tags["core"] == "" {
+				t.Errorf("got %+v", p)
+			}
+			n++
+		}
+	}
+	if n != 5 {
+		t.Errorf("got %d points, want 5 without the NaN", n)
+	}
+}
+
+func TestHTTPPartialFailure(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		rw.WriteHeader(http.StatusBadRequest)
+		rw.Write([]byte(`{"success":1,"failed":1,"errors":[{"error":"Unable to parse value"}]}`))
+	}))
+	defer srv.Close()
+
+	db := NewOpenTSDB(testConfig(ProtocolHTTP, srv.URL))
+	err := db.Flush([]point.Point{
+		point.New("a", "value", nil, 1, 10, point.Gauge),
+		point.New("b", "value", nil, 2, 10, point.Gauge),
+	})
+	if err == nil || !strings.Contains(err.Error(), "dropped 1 of 2 points") ||
+		!strings.Contains(err.Error(), "Unable to parse value") {
+		t.Fatalf("got %v", err)
+	}
+}
+
+func TestHTTPError(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		http.Error(rw, "overloaded", http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+
+	db := NewOpenTSDB(testConfig(ProtocolHTTP, srv.URL))
+	err := db.Flush([]point.Point{point.New("a", "value", nil, 1, 10, point.Gauge)})
+	if err == nil || !strings.Contains(err.Error(), "responded 503: overloaded") {
+		t.Fatalf("got %v", err)
+	}
+}
+
+func TestCheckAddr(t *testing.T) {
+	for _, c := range []struct {
+		protocol, addr string
+		ok             bool
+	}{
+		{ProtocolTelnet, "127.0.0.1:4242", true},
+		{ProtocolTelnet, "tsdb", false},
+		{ProtocolTelnet, "http://tsdb:4242", false},
+		{ProtocolHTTP, "http://tsdb:4242", true},
+		{ProtocolHTTP, "https://tsdb/prefix", true},
+		{ProtocolHTTP, "tsdb:4242", false},
+		{ProtocolHTTP, "ftp://tsdb", false},
+		{ProtocolHTTP, "http://", false},
+	} {
+		panicked := func() (p bool) {
+			defer func() { p = recover() != nil }()
+			testConfig(c.protocol, c.addr)
+			return
+		}()
+		if panicked == c.ok {
+			t.Errorf("%s %q: panicked %v", c.protocol, c.addr, panicked)
+		}
+	}
+}
@@ -0,0 +1,152 @@
+package opentsdb
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/coder-van/v-stats/point"
+	"github.com/coder-van/v-util/log"
+)
+
+/*
+ telnet 协议写入成功时没有回复, 只有出错时 OpenTSDB 才会回一行错误信息,
+ 所以单独起一个 goroutine 读取并记录这些错误, 否则连接的接收缓冲区会被写满
+ 长连接可能已经被对端关闭, 这时立即重新连接并再发送一次,
+ 连接失败或者新的连接写入失败后按 backoff 等待, 等待期间的数据直接丢弃
+*/
+
+func newTelnetWriter(conf *Config) *telnetWriter {
+	return &telnetWriter{
+		config: conf,
+		logger: log.GetLogger("statsd.OpenTSDBBackend", log.RotateModeMonth),
+	}
+}
+
+type telnetWriter struct {
+	config *Config
+	logger *log.Vlogger
+
+	mu      sync.Mutex
+	c       net.Conn
+	backoff time.Duration
+	retryAt time.Time
+}
+
+// write sends points over the persistent connection, when writing to an
+// established connection fails it is dialed again and the batch is sent
+// once more.
+func (w *telnetWriter) write(points []point.Point) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	buf, skipped := w.encode(points)
+	reused := w.c != nil
+	err := w.send(buf)
+	if err != nil && reused {
+		err = w.send(buf)
+	}
+	if err != nil {
+		return fmt.Errorf("opentsdb %s: dropped %d points, %s", w.config.Addr, len(points), err)
+	}
+	if skipped > 0 {
+		return fmt.Errorf("opentsdb %s: skipped %d lines longer than %d bytes", w.config.Addr, skipped, maxLineBytes)
+	}
+	return nil
+}
+
+func (w *telnetWriter) encode(points []point.Point) ([]byte, int) {
+	var buf, line bytes.Buffer
+	skipped := 0
+	for _, p := range points {
+		if !finite(p) {
+			continue
+		}
+		line.Reset()
+		line.WriteString("put ")
+		line.WriteString(metricName(p))
+		line.WriteByte(' ')
+		line.WriteString(strconv.FormatInt(p.Timestamp, 10))
+		line.WriteByte(' ')
+		line.WriteString(point.FormatValue(p.Value))
+		for _, tag := range tags(p, w.config.DefaultHost) {
+			line.WriteByte(' ')
+			line.WriteString(tag[0])
+			line.WriteByte('=')
+			line.WriteString(tag[1])
+		}
+		line.WriteByte('\n')
+		if line.Len() > maxLineBytes {
+			skipped++
+			continue
+		}
+		buf.Write(line.Bytes())
+	}
+	return buf.Bytes(), skipped
+}
+
+func (w *telnetWriter) send(b []byte) error {
+	fresh := w.c == nil
+	if fresh {
+		if wait := time.Until(w.retryAt); wait > 0 {
+			return fmt.Errorf("next reconnect in %s", wait.Truncate(time.Millisecond))
+		}
+		c, err := net.DialTimeout("tcp", w.config.Addr, w.config.Timeout())
+		if err != nil {
+			w.fail()
+			return err
+		}
+		w.c = c
+		go w.drain(c)
+	}
+	err := w.c.SetWriteDeadline(time.Now().Add(w.config.Timeout()))
+	if err == nil {
+		_, err = w.c.Write(b)
+	}
+	if err != nil {
+		if fresh {
+			w.fail()
+		} else {
+			w.reset()
+		}
+		return err
+	}
+	w.backoff = 0
+	return nil
+}
+
+// fail closes the connection and delays the next dial.
+func (w *telnetWriter) fail() {
+	w.reset()
+	if w.backoff == 0 {
+		w.backoff = minBackoff
+	} else if w.backoff *= 2; w.backoff > maxBackoff {
+		w.backoff = maxBackoff
+	}
+	w.retryAt = time.Now().Add(w.backoff)
+}
+
+// drain logs the error lines OpenTSDB sends back until c is closed.
+func (w *telnetWriter) drain(c net.Conn) {
+	s := bufio.NewScanner(c)
+	for s.Scan() {
+		w.logger.Printf("opentsdb %s: %s", w.config.Addr, s.Text())
+	}
+}
+
+func (w *telnetWriter) close() {
+	w.mu.Lock()
+	w.reset()
+	w.mu.Unlock()
+}
+
+func (w *telnetWriter) reset() {
+	if w.c != nil {
+		w.c.Close()
+		w.c = nil
+	}
+}
@@ -0,0 +1,374 @@
+package otlp
+
+import (
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/coder-van/v-stats/point"
+	"github.com/coder-van/v-stats/protobuf"
+)
+
+/*
+ opentelemetry/proto/metrics/v1 中用到的字段:
+ ExportMetricsServiceRequest { ResourceMetrics resource_metrics = 1 }
+ ResourceMetrics    { Resource resource = 1; ScopeMetrics scope_metrics = 2 }
+ Resource           { KeyValue attributes = 1 }
+ ScopeMetrics       { InstrumentationScope scope = 1; Metric metrics = 2 }
+ Metric             { name = 1; unit = 3; Gauge gauge = 5; Sum sum = 7; Histogram histogram = 9 }
+ Gauge              { NumberDataPoint data_points = 1 }
+ Sum                { NumberDataPoint data_points = 1; aggregation_temporality = 2; is_monotonic = 3 }
+ Histogram          { HistogramDataPoint data_points = 1; aggregation_temporality = 2 }
+ NumberDataPoint    { start_time_unix_nano = 2; time_unix_nano = 3; as_double = 4; attributes = 7 }
+ HistogramDataPoint { start_time_unix_nano = 2; time_unix_nano = 3; count = 4; sum = 5;
+ bucket_counts = 6; explicit_bounds = 7; attributes = 9; min = 11; max = 12 }
+
+ aggregator 只输出 timer 的百分位, 没有原始的桶, 这里用百分位作为桶的边界还原一个近似的分布:
+ p50 = 12, p99 = 30, count = 100 -> explicit_bounds [12, 30], bucket_counts [50, 49, 1]
+ 这样 collector 端按桶计算的百分位和 aggregator 的结果一致
+*/
+const (
+	temporalityDelta      = 1
+	temporalityCumulative = 2
+)
+
+type numberPoint struct {
+	tags        []string
+	start, time uint64
+	value       float64
+}
+
+type histogramPoint struct {
+	tags        []string
+	start, time uint64
+	count       uint64
+	sum         float64
+	// min 和 max 是 timer 从启动开始的值, 只在 cumulative 模式下输出
+	minMax   bool
+	min, max float64
+	bounds   []float64
+	counts   []uint64
+}
+
+type metric struct {
+	name string
+	kind point.Kind
+	// temporality of Sum and Histogram, 1 delta, 2 cumulative
+	temporality uint64
+	numbers     []numberPoint
+	histograms  []histogramPoint
+}
+
+// seriesState is what has to be remembered between flushes to compute
+// delta or cumulative values.
+type seriesState struct {
+	first   uint64
+	last    uint64
+	total   float64
+	count   float64
+	sum     float64
+	updated time.Time
+}
+
+// timerFields collects the points of one timer series at one timestamp.
+type timerFields struct {
+	key    string
+	name   string
+	kind   point.Kind
+	tags   []string
+	ts     int64
+	fields map[string]float64
+}
+
+func (o *OTLP) convert(points []point.Point, now time.Time) []*metric {
+	var order []*metric
+	byName := make(map[string]*metric)
+	temporality := uint64(temporalityDelta)
+	if o.config.Temporality == TemporalityCumulative {
+		temporality = temporalityCumulative
+	}
+	get := func(name string, kind point.Kind) *metric {
+		k := name + "\x00" + kind.String()
+		m, ok := byName[k]
+		if !ok {
+			m = &metric{name: name, kind: kind, temporality: temporality}
+			byName[k] = m
+			order = append(order, m)
+		}
+		return m
+	}
+
+	var timerOrder []*timerFields
+	timers := make(map[string]*timerFields)
+	if tf := o.partial; tf != nil {
+		// 上一批最后一个 timer 的字段可能在这一批继续
+		o.partial = nil
+		timers[tf.key] = tf
+		timerOrder = append(timerOrder, tf)
+	}
+	var last *timerFields
+	var latest uint64
+	for _, pt := range points {
+		last = nil
+		ts := uint64(pt.Timestamp) * uint64(time.Second)
+		if ts > latest {
+			latest = ts
+		}
+		switch pt.Kind {
+		case point.Counter:
+			if pt.Field != "count" {
+				continue
+			}
+			st := o.stateOf(pt.Kind, pt.Name, pt.Tags, ts, now)
+			np := numberPoint{tags: pt.Tags, time: ts, value: pt.Value}
+			if o.config.Temporality == TemporalityCumulative {
+				st.total += pt.Value
+				np.start, np.value = st.first, st.total
+			} else {
+				np.start = st.last
+			}
+			st.last = ts
+			m := get(pt.Name, pt.Kind)
+			m.numbers = append(m.numbers, np)
+		case point.Timer, point.Histogram:
+			k := pt.Name + "\x00" + strings.Join(pt.Tags, ",") + "\x00" + strconv.FormatInt(pt.Timestamp, 10)
+			tf, ok := timers[k]
+			if !ok {
+				tf = &timerFields{key: k, name: pt.Name, kind: pt.Kind, tags: pt.Tags, ts: pt.Timestamp, fields: make(map[string]float64)}
+				timers[k] = tf
+				timerOrder = append(timerOrder, tf)
+			}
+			tf.fields[pt.Field] = pt.Value
+			last = tf
+		default:
+			m := get(pt.Name, point.Gauge)
+			m.numbers = append(m.numbers, numberPoint{tags: pt.Tags, time: ts, value: pt.Value})
+		}
+	}
+
+	if last != nil {
+		/*
+		 BackendManger 按数量分批, 一个 timer 的字段可能被分到两次 Flush 中,
+		 aggregator 连续输出一个 series 的所有字段, 只有一批中最后一个 timer 可能不完整,
+		 留到下一批和剩下的字段合并, 下一批没有它的字段时再输出
+		*/
+		o.partial = last
+		for i, tf := range timerOrder {
+			if tf == last {
+				timerOrder = append(timerOrder[:i], timerOrder[i+1:]...)
+				break
+			}
+		}
+	}
+
+	for _, tf := range timerOrder {
+		count, ok := tf.fields["count"]
+		if !ok {
+			// 缺少 count 时无法计算分布, 也不能当作 count 为 0 重置累计值
+			continue
+		}
+		ts := uint64(tf.ts) * uint64(time.Second)
+		st := o.stateOf(tf.kind, tf.name, tf.tags, ts, now)
+		sum := tf.fields["mean"] * count
+		hp := histogramPoint{tags: tf.tags, time: ts}
+		if o.config.Temporality == TemporalityCumulative {
+			lo, hasMin := tf.fields["min"]
+			hi, hasMax := tf.fields["max"]
+			if hasMin && hasMax {
+				hp.min, hp.max, hp.minMax = lo, hi, true
+			}
+			hp.start = st.first
+			hp.sum = sum
+			hp.count = uint64(math.Round(count))
+		} else {
+			hp.start = st.last
+			dc, ds := count-st.count, sum-st.sum
+			if dc < 0 {
+				// count 变小说明 timer 被重建了
+				dc, ds = count, sum
+			}
+			hp.sum = ds
+			hp.count = uint64(math.Round(dc))
+		}
+		st.count, st.sum, st.last = count, sum, ts
+		hp.bounds, hp.counts = buckets(tf.fields, hp.count)
+		m := get(tf.name, tf.kind)
+		m.histograms = append(m.histograms, hp)
+	}
+
+	if latest > o.prev {
+		o.prev = latest
+	}
+	o.expire(now)
+	return order
+}
+
+// stateOf returns the state of a series, a new series starts at the time of
+// the previous flush, its first value was aggregated since then.
+func (o *OTLP) stateOf(kind point.Kind, name string, tags []string, ts uint64, now time.Time) *seriesState {
+	k := kind.String() + "\x00" + name + "\x00" + strings.Join(tags, ",")
+	st, ok := o.state[k]
+	if !ok {
+		start := o.prev
+		if start > ts {
+			start = ts
+		}
+		st = &seriesState{first: start, last: start}
+		o.state[k] = st
+	}
+	st.updated = now
+	return st
+}
+
+func (o *OTLP) expire(now time.Time) {
+	ttl := time.Duration(o.config.ExpireSeconds) * time.Second
+	for k, st := range o.state {
+		if now.Sub(st.updated) > ttl {
+			delete(o.state, k)
+		}
+	}
+}
+
+// buckets turns the percentile fields of a timer into explicit bounds and
+// bucket counts, see the comment at the top of this file.
+func buckets(fields map[string]float64, count uint64) ([]float64, []uint64) {
+	type quantile struct{ q, v float64 }
+	var qs []quantile
+	for f, v := range fields {
+		if q, ok := point.Quantile(f); ok {
+			qs = append(qs, quantile{q, v})
+		}
+	}
+	if len(qs) == 0 {
+		return nil, nil
+	}
+	sort.Slice(qs, func(i, j int) bool { return qs[i].q < qs[j].q })
+
+	var bounds []float64
+	var cum []uint64
+	for _, q := range qs {
+		c := uint64(math.Round(float64(count) * q.q))
+		if n := len(bounds); n > 0 && q.v <= bounds[n-1] {
+			// 边界必须递增, 相同的边界合并到一个桶
+			cum[n-1] = c
+			continue
+		}
+		bounds = append(bounds, q.v)
+		cum = append(cum, c)
+	}
+	counts := make([]uint64, len(bounds)+1)
+	var prev uint64
+	for i, c := range cum {
+		counts[i] = c - prev
+		prev = c
+	}
+	counts[len(bounds)] = count - prev
+	return bounds, counts
+}
+
+func encodeRequest(resource map[string]string, metrics []*metric) []byte {
+	res := protobuf.NewBuffer()
+	keys := make([]string, 0, len(resource))
+	for k := range resource {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		res.Message(1, keyValue(k, resource[k]))
+	}
+
+	scope := protobuf.NewBuffer()
+	scope.String(1, "v-stats")
+
+	sm := protobuf.NewBuffer()
+	sm.Message(1, scope)
+	for _, m := range metrics {
+		sm.Message(2, encodeMetric(m))
+	}
+
+	rm := protobuf.NewBuffer()
+	rm.Message(1, res)
+	rm.Message(2, sm)
+
+	req := protobuf.NewBuffer()
+	req.Message(1, rm)
+	return req.Bytes()
+}
+
+func encodeMetric(m *metric) *protobuf.Buffer {
+	b := protobuf.NewBuffer()
+	b.String(1, m.name)
+	data := protobuf.NewBuffer()
+	switch m.kind {
+	case point.Counter:
+		for _, np := range m.numbers {
+			data.Message(1, encodeNumber(np))
+		}
+		data.Uint64(2, m.temporality)
+		data.Bool(3, true)
+		b.Message(7, data)
+	case point.Timer, point.Histogram:
+		if m.kind == point.Timer {
+			b.String(3, "ns")
+		}
+		for _, hp := range m.histograms {
+			data.Message(1, encodeHistogram(hp))
+		}
+		data.Uint64(2, m.temporality)
+		b.Message(9, data)
+	default:
+		for _, np := range m.numbers {
+			data.Message(1, encodeNumber(np))
+		}
+		b.Message(5, data)
+	}
+	return b
+}
+
+func encodeNumber(np numberPoint) *protobuf.Buffer {
+	b := protobuf.NewBuffer()
+	if np.start > 0 {
+		b.Fixed64(2, np.start)
+	}
+	b.Fixed64(3, np.time)
+	b.Double(4, np.value)
+	for _, tag := range np.tags {
+		k, v := point.SplitTag(tag)
+		b.Message(7, keyValue(k, v))
+	}
+	return b
+}
+
+func encodeHistogram(hp histogramPoint) *protobuf.Buffer {
+	b := protobuf.NewBuffer()
+	b.Fixed64(2, hp.start)
+	b.Fixed64(3, hp.time)
+	b.Fixed64(4, hp.count)
+	b.Double(5, hp.sum)
+	b.PackedFixed64s(6, hp.counts)
+	b.PackedDoubles(7, hp.bounds)
+	for _, tag := range hp.tags {
+		k, v := point.SplitTag(tag)
+		b.Message(9, keyValue(k, v))
+	}
+	if hp.minMax {
+		b.Double(11, hp.min)
+		b.Double(12, hp.max)
+	}
+	return b
+}
+
+// keyValue encodes a KeyValue with a string AnyValue, bare tags get "true".
+func keyValue(k, v string) *protobuf.Buffer {
+	if v == "" {
+		v = "true"
+	}
+	any := protobuf.NewBuffer()
+	any.String(1, v)
+	kv := protobuf.NewBuffer()
+	kv.String(1, k)
+	kv.Message(2, any)
+	return kv
+}
@@ -0,0 +1,237 @@
+package otlp
+
+import (
+	"encoding/binary"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/coder-van/v-stats/point"
+)
+
+// message is a decoded protobuf message, field number to values. Varint and
+// fixed64 values are kept in ints, length delimited values in bytes.
+type message struct {
+	ints  map[int][]uint64
+	bytes map[int][][]byte
+}
+
+func decode(t *testing.T, b []byte) message {
+	m := message{ints: make(map[int][]uint64), bytes: make(map[int][][]byte)}
+	for len(b) > 0 {
+		key, n := binary.Uvarint(b)
+		if n <= 0 {
+			t.Fatalf("bad field key")
+		}
+		b = b[n:]
+		num := int(key >> 3)
+		switch key & 7 {
+		case 0:
+			v, n := binary.Uvarint(b)
+			if n <= 0 {
+				t.Fatalf("bad varint")
+			}
+			m.ints[num] = append(m.ints[num], v)
+			b = b[n:]
+		case 1:
+			m.ints[num] = append(m.ints[num], binary.LittleEndian.Uint64(b))
+			b = b[8:]
+		case 2:
+			l, n := binary.Uvarint(b)
+			if n <= 0 || uint64(len(b)-n) < l {
+				t.Fatalf("bad length")
+			}
+			m.bytes[num] = append(m.bytes[num], b[n:n+int(l)])
+			b = b[n+int(l):]
+		default:
+			t.Fatalf("unexpected wire type %d", key&7)
+		}
+	}
+	return m
+}
+
+func (m message) int(num int) uint64 {
+	if len(m.ints[num]) == 0 {
+		return 0
+	}
+	return m.ints[num][0]
+}
+
+func (m message) double(num int) float64 {
+	return math.Float64frombits(m.int(num))
+}
+
+func (m message) string(num int) string {
+	if len(m.bytes[num]) == 0 {
+		return ""
+	}
+	return string(m.bytes[num][0])
+}
+
+func newTestOTLP(temporality string) *OTLP {
+	conf := &Config{Temporality: temporality}
+	conf.Check()
+	o := NewOTLP(conf)
+	o.prev = uint64(100 * time.Second)
+	return o
+}
+
+// exportedMetrics decodes a request into its metrics by name.
+func exportedMetrics(t *testing.T, req []byte) map[string]message {
+	out := make(map[string]message)
+	rm := decode(t, decode(t, req).bytes[1][0])
+	for _, sm := range rm.bytes[2] {
+		for _, b := range decode(t, sm).bytes[2] {
+			m := decode(t, b)
+			out[m.string(1)] = m
+		}
+	}
+	return out
+}
+
+func TestEncodeRequest(t *testing.T) {
+	o := newTestOTLP(TemporalityCumulative)
+	now := time.Now()
+	points := []point.Point{
+		point.New("hits", "count", []string{"host=a"}, 3, 110, point.Counter),
+		point.New("hits", "rate", []string{"host=a"}, 0.3, 110, point.Counter),
+		point.New("lat", "count", nil, 100, 110, point.Timer),
+		point.New("lat", "mean", nil, 15, 110, point.Timer),
+		point.New("lat", "min", nil, 1, 110, point.Timer),
+		point.New("lat", "max", nil, 40, 110, point.Timer),
+		point.New("lat", "p50", nil, 12, 110, point.Timer),
+		point.New("lat", "p99", nil, 30, 110, point.Timer),
+		point.New("temp", "value", nil, 21.5, 110, point.Gauge),
+	}
+	ms := exportedMetrics(t, encodeRequest(o.config.ResourceAttributes, o.convert(points, now)))
+	if len(ms) != 3 {
+		t.Fatalf("got %d metrics, want 3", len(ms))
+	}
+
+	sum := decode(t, ms["hits"].bytes[7][0])
+	if sum.int(2) != temporalityCumulative || sum.int(3) != 1 {
+		t.Errorf("hits: temporality %d, monotonic %d", sum.int(2), sum.int(3))
+	}
+	np := decode(t, sum.bytes[1][0])
+	if np.int(2) != uint64(100*time.Second) || np.int(3) != uint64(110*time.Second) || np.double(4) != 3 {
+		t.Errorf("hits: got start %d, time %d, value %v", np.int(2), np.int(3), np.double(4))
+	}
+	attr := decode(t, np.bytes[7][0])
+	if attr.string(1) != "host" || decode(t, attr.bytes[2][0]).string(1) != "a" {
+		t.Errorf("hits: bad attribute")
+	}
+
+	gauge := decode(t, decode(t, ms["temp"].bytes[5][0]).bytes[1][0])
+	if gauge.double(4) != 21.5 {
+		t.Errorf("temp: got %v", gauge.double(4))
+	}
+
+	if ms["lat"].string(3) != "ns" {
+		t.Errorf("lat: unit %q", ms["lat"].string(3))
+	}
+	hp := decode(t, decode(t, ms["lat"].bytes[9][0]).bytes[1][0])
+	if hp.int(4) != 100 || hp.double(5) != 1500 || hp.double(11) != 1 || hp.double(12) != 40 {
+		t.Errorf("lat: got count %d, sum %v, min %v, max %v", hp.int(4), hp.double(5), hp.double(11), hp.double(12))
+	}
+	counts := hp.bytes[6][0]
+	bounds := hp.bytes[7][0]
+	if len(counts) != 24 || len(bounds) != 16 {
+		t.Fatalf("lat: got %d counts, %d bounds", len(counts)/8, len(bounds)/8)
+	}
+	for i, want := range []uint64{50, 49, 1} {
+		if c := binary.LittleEndian.Uint64(counts[8*i:]); c != want {
+			t.Errorf("lat: bucket %d is %d, want %d", i, c, want)
+		}
+	}
+	for i, want := range []float64{12, 30} {
+		if b := math.Float64frombits(binary.LittleEndian.Uint64(bounds[8*i:])); b != want {
+			t.Errorf("lat: bound %d is %v, want %v", i, b, want)
+		}
+	}
+}
+
+func TestStartTime(t *testing.T) {
+	o := newTestOTLP(TemporalityDelta)
+	now := time.Now()
+	o.convert([]point.Point{point.New("a", "count", nil, 1, 110, point.Counter)}, now)
+	ms := o.convert([]point.Point{
+		point.New("a", "count", nil, 2, 120, point.Counter),
+		point.New("b", "count", nil, 5, 120, point.Counter),
+	}, now)
+
+	starts := make(map[string]uint64)
+	for _, m := range ms {
+		for _, np := range m.numbers {
+			starts[m.name] = np.start
+		}
+	}
+	// a 的起始时间是它上一个数据点的时间, 新出现的 b 从上一次刷新开始, 而不是从进程启动开始
+	if starts["a"] != uint64(110*time.Second) || starts["b"] != uint64(110*time.Second) {
+		t.Errorf("got start times %v", starts)
+	}
+}
+
+func TestMinMaxOnlyWhenPresent(t *testing.T) {
+	o := newTestOTLP(TemporalityCumulative)
+	ms := o.convert([]point.Point{
+		point.New("lat", "count", nil, 10, 110, point.Timer),
+		point.New("lat", "min", nil, 1, 110, point.Timer),
+		point.New("temp", "value", nil, 1, 110, point.Gauge),
+	}, time.Now())
+	if hp := ms[len(ms)-1].histograms[0]; hp.minMax {
+		t.Errorf("min and max are set without a max field")
+	}
+}
+
+func timerPoints(count, mean float64, ts int64) []point.Point {
+	return []point.Point{
+		point.New("lat", "count", nil, count, ts, point.Timer),
+		point.New("lat", "min", nil, 1, ts, point.Timer),
+		point.New("lat", "max", nil, 40, ts, point.Timer),
+		point.New("lat", "mean", nil, mean, ts, point.Timer),
+		point.New("lat", "p50", nil, 12, ts, point.Timer),
+		point.New("lat", "p99", nil, 30, ts, point.Timer),
+	}
+}
+
+func TestTimerSplitAcrossBatches(t *testing.T) {
+	o := newTestOTLP(TemporalityDelta)
+	now := time.Now()
+	var got []histogramPoint
+	convert := func(points []point.Point) {
+		for _, m := range o.convert(points, now) {
+			got = append(got, m.histograms...)
+		}
+	}
+
+	first := timerPoints(100, 10, 110)
+	second := timerPoints(150, 10, 120)
+	gauge := point.New("temp", "value", nil, 1, 120, point.Gauge)
+	// BackendManger 按数量分批, 每个 timer 都被分在两批中
+	convert(first[:4])
+	convert(append(first[4:], second[:1]...))
+	convert(append(second[1:], gauge))
+
+	if len(got) != 2 {
+		t.Fatalf("got %d histogram points, want 2: %+v", len(got), got)
+	}
+	for i, want := range []struct {
+		count uint64
+		sum   float64
+	}{{100, 1000}, {50, 500}} {
+		if hp := got[i]; hp.count != want.count || hp.sum != want.sum || len(hp.bounds) != 2 {
+			t.Errorf("point %d: got count %d, sum %v, bounds %v, want %d, %v", i, hp.count, hp.sum, hp.bounds, want.count, want.sum)
+		}
+	}
+}
+
+func TestTimerWithoutCount(t *testing.T) {
+	o := newTestOTLP(TemporalityCumulative)
+	points := timerPoints(100, 10, 110)[1:]
+	ms := o.convert(append(points, point.New("temp", "value", nil, 1, 110, point.Gauge)), time.Now())
+	for _, m := range ms {
+		if len(m.histograms) > 0 {
+			t.Errorf("converted a timer without count: %+v", m.histograms)
+		}
+	}
+}
@@ -0,0 +1,152 @@
+package otlp
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/coder-van/v-stats/backends/push"
+	"github.com/coder-van/v-stats/point"
+)
+
+/*
+ 以 OTLP/HTTP protobuf 格式推送到 OpenTelemetry collector
+ counter -> Sum(monotonic), gauge 和 set -> Gauge, timer 和 histogram -> Histogram
+ aggregator 每个周期清空 counter, delta 模式直接使用每个周期的值,
+ cumulative 模式由这里累加, 起始时间是 series 第一次出现的时间
+ timer 的 count 从进程启动开始累计, delta 模式下输出和上一次的差值
+ 失败的请求按 backends/push 的规则重试, 按 OTLP 规范只有 429, 502, 503, 504 可以重试, 其他错误直接丢弃
+*/
+const (
+	TemporalityDelta      = "delta"
+	TemporalityCumulative = "cumulative"
+
+	CompressionGzip = "gzip"
+	CompressionNone = "none"
+
+	DefaultURL = "http://localhost:4318/v1/metrics"
+)
+
+// Config is the [backends.otlp] section of the config file.
+type Config struct {
+	// URL is the full metrics endpoint, e.g. http://collector:4318/v1/metrics
+	URL         string            `toml:"url"`
+	Headers     map[string]string `toml:"headers"`
+	Temporality string            `toml:"temporality"`
+	Compression string            `toml:"compression"`
+	// ResourceAttributes describe this process, service.name defaults to v-stats
+	ResourceAttributes map[string]string `toml:"resource_attributes"`
+
+	TimeoutSeconds int `toml:"timeout_seconds"`
+	MaxRetries     int `toml:"max_retries"`
+	// ExpireSeconds drops the state kept for series that were not flushed
+	// for that long
+	ExpireSeconds int `toml:"expire_seconds"`
+}
+
+func (c *Config) Check() {
+	if c.URL == "" {
+		fmt.Println("warn config backends.otlp url is empty, set to " + DefaultURL)
+		c.URL = DefaultURL
+	}
+	switch c.Temporality {
+	case TemporalityDelta, TemporalityCumulative:
+	case "":
+		c.Temporality = TemporalityDelta
+	default:
+		panic("config backends.otlp temporality must be delta or cumulative")
+	}
+	switch c.Compression {
+	case CompressionGzip, CompressionNone:
+	case "":
+		c.Compression = CompressionGzip
+	default:
+		panic("config backends.otlp compression must be gzip or none")
+	}
+	if c.ResourceAttributes == nil {
+		c.ResourceAttributes = make(map[string]string)
+	}
+	if c.ResourceAttributes["service.name"] == "" {
+		c.ResourceAttributes["service.name"] = "v-stats"
+	}
+	if c.TimeoutSeconds < 1 {
+		fmt.Println("warn config backends.otlp timeout_seconds can't smaller than 1, set to 10")
+		c.TimeoutSeconds = 10
+	}
+	if c.MaxRetries < 1 {
+		fmt.Println("warn config backends.otlp max_retries can't smaller than 1, set to 3")
+		c.MaxRetries = 3
+	}
+	if c.ExpireSeconds < 1 {
+		fmt.Println("warn config backends.otlp expire_seconds can't smaller than 1, set to 300")
+		c.ExpireSeconds = 300
+	}
+}
+
+func NewOTLP(conf *Config) *OTLP {
+	return &OTLP{
+		config: conf,
+		client: &http.Client{Timeout: time.Duration(conf.TimeoutSeconds) * time.Second},
+		prev:   uint64(time.Now().UnixNano()),
+		state:  make(map[string]*seriesState),
+		queue:  push.Queue{MaxRetries: conf.MaxRetries, Retryable: retryable, Unit: "metrics"},
+	}
+}
+
+type OTLP struct {
+	config *Config
+	client *http.Client
+
+	mu sync.Mutex
+	// prev 是上一次刷新的数据点时间, 单位纳秒, 作为新 series 的起始时间
+	prev  uint64
+	state map[string]*seriesState
+	// partial 是上一批最后一个 timer, 它的字段可能还没有全部收到, 见 convert
+	partial *timerFields
+	queue   push.Queue
+}
+
+// retryable tells whether a request answered with code may succeed when it
+// is sent again.
+func retryable(code int) bool {
+	switch code {
+	case http.StatusTooManyRequests, http.StatusBadGateway,
+		http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+func (o *OTLP) Flush(points []point.Point) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if metrics := o.convert(points, time.Now()); len(metrics) > 0 {
+		body := encodeRequest(o.config.ResourceAttributes, metrics)
+		if o.config.Compression == CompressionGzip {
+			var err error
+			if body, err = push.Gzip(body); err != nil {
+				return fmt.Errorf("unable to compress batch, %s", err.Error())
+			}
+		}
+		o.queue.Add(body, len(metrics))
+	}
+	return o.queue.Send(o.post)
+}
+
+func (o *OTLP) post(body []byte) error {
+	req, err := http.NewRequest("POST", o.config.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	if o.config.Compression == CompressionGzip {
+		req.Header.Set("Content-Encoding", "gzip")
+	}
+	for k, v := range o.config.Headers {
+		req.Header.Set(k, v)
+	}
+	return push.Do(o.client, req, "otlp collector")
+}
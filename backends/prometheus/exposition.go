@@ -0,0 +1,156 @@
+package prometheus
+
+import (
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+/*
+ 两种输出格式的区别:
+ text 0.0.4: counter 的 HELP 和 TYPE 行写完整的名字 foo_total
+ OpenMetrics: counter 的 HELP 和 TYPE 行写去掉 _total 的名字 foo, 最后以 # EOF 结尾
+ HELP 的内容是原来的 statsd 名字, 清理名字之后仍然可以找到数据的来源
+*/
+const (
+	ContentTypeText        = "text/plain; version=0.0.4; charset=utf-8"
+	ContentTypeOpenMetrics = "application/openmetrics-text; version=1.0.0; charset=utf-8"
+)
+
+var (
+	labelValueEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+	helpEscaper       = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+)
+
+func writeFamily(buf *strings.Builder, f *family, openMetrics bool) {
+	keys := make([]string, 0, len(f.series))
+	for k := range f.series {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	name := f.name
+	if f.typ == typeCounter && !openMetrics {
+		name += "_total"
+	}
+	if f.help != "" {
+		buf.WriteString("# HELP ")
+		buf.WriteString(name)
+		buf.WriteByte(' ')
+		if openMetrics {
+			// OpenMetrics 的 HELP 和 label 值一样转义双引号
+			buf.WriteString(labelValueEscaper.Replace(f.help))
+		} else {
+			buf.WriteString(helpEscaper.Replace(f.help))
+		}
+		buf.WriteByte('\n')
+	}
+	buf.WriteString("# TYPE ")
+	buf.WriteString(name)
+	buf.WriteByte(' ')
+	buf.WriteString(string(f.typ))
+	buf.WriteByte('\n')
+
+	for _, k := range keys {
+		s := f.series[k]
+		switch f.typ {
+		case typeCounter:
+			writeSample(buf, f.name+"_total", s.labels, "", "", s.value)
+		case typeSummary:
+			qs := make([]float64, 0, len(s.quantiles))
+			for q := range s.quantiles {
+				qs = append(qs, q)
+			}
+			sort.Float64s(qs)
+			for _, q := range qs {
+				writeSample(buf, f.name, s.labels, "quantile", formatFloat(q), s.quantiles[q])
+			}
+			writeSample(buf, f.name+"_sum", s.labels, "", "", s.sum)
+			writeSample(buf, f.name+"_count", s.labels, "", "", s.count)
+		default:
+			writeSample(buf, f.name, s.labels, "", "", s.value)
+		}
+	}
+}
+
+// writeSample writes one sample line, extraName is an additional label such
+// as "quantile" placed after the series labels.
+func writeSample(buf *strings.Builder, name string, labels []label, extraName, extraValue string, v float64) {
+	buf.WriteString(name)
+	if len(labels) > 0 || extraName != "" {
+		buf.WriteByte('{')
+		for i, l := range labels {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			writeLabel(buf, l.name, l.value)
+		}
+		if extraName != "" {
+			if len(labels) > 0 {
+				buf.WriteByte(',')
+			}
+			writeLabel(buf, extraName, extraValue)
+		}
+		buf.WriteByte('}')
+	}
+	buf.WriteByte(' ')
+	buf.WriteString(formatFloat(v))
+	buf.WriteByte('\n')
+}
+
+func writeLabel(buf *strings.Builder, name, value string) {
+	buf.WriteString(name)
+	buf.WriteString(`="`)
+	buf.WriteString(labelValueEscaper.Replace(value))
+	buf.WriteByte('"')
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsNaN(v):
+		return "NaN"
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// sanitizeName maps a metric name onto [a-zA-Z_:][a-zA-Z0-9_:]*, every
+// other character, including '.', becomes '_'.
+func sanitizeName(s string) string {
+	return sanitize(s, true)
+}
+
+// sanitizeLabel maps a label name onto [a-zA-Z_][a-zA-Z0-9_]*, names starting
+// with "__" are reserved by Prometheus and get an extra prefix.
+func sanitizeLabel(s string) string {
+	s = sanitize(s, false)
+	if strings.HasPrefix(s, "__") {
+		s = "tag" + s
+	}
+	return s
+}
+
+func sanitize(s string, colon bool) string {
+	if s == "" {
+		return s
+	}
+	b := []byte(s)
+	for i, c := range b {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c == '_':
+		case c == ':' && colon:
+		case c >= '0' && c <= '9' && i > 0:
+		default:
+			b[i] = '_'
+		}
+	}
+	if s[0] >= '0' && s[0] <= '9' {
+		// 不能以数字开头, 加前缀保留原来的数字
+		return "_" + s[:1] + string(b[1:])
+	}
+	return string(b)
+}
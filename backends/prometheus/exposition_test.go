@@ -0,0 +1,172 @@
+package prometheus
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coder-van/v-stats/point"
+)
+
+func newTestPrometheus() *Prometheus {
+	return NewPrometheus(&Config{ListenAddr: "127.0.0.1:0", Path: "/metrics", ExpireSeconds: 300})
+}
+
+// scrape returns the content type and body served for the Accept header.
+func scrape(p *Prometheus, accept string) (string, string) {
+	r := httptest.NewRequest("GET", "/metrics", nil)
+	if accept != "" {
+		r.Header.Set("Accept", accept)
+	}
+	w := httptest.NewRecorder()
+	p.handle(w, r)
+	return w.Header().Get("Content-Type"), w.Body.String()
+}
+
+func testPoints() []point.Point {
+	tags := []string{"dc=eu"}
+	return []point.Point{
+		point.New("hits", "count", []string{"host=a"}, 3, 10, point.Counter),
+		point.New("hits", "rate", []string{"host=a"}, 0.3, 10, point.Counter),
+		point.New("cpu.load", "value", []string{`path=C:\tmp "x"`}, 0.5, 10, point.Gauge),
+		point.New("api.lat", "count", tags, 4, 10, point.Timer),
+		point.New("api.lat", "min", tags, 1, 10, point.Timer),
+		point.New("api.lat", "mean", tags, 2.5, 10, point.Timer),
+		point.New("api.lat", "p50", tags, 2, 10, point.Timer),
+		point.New("api.lat", "p99", tags, 4, 10, point.Timer),
+	}
+}
+
+func TestExpositionText(t *testing.T) {
+	p := newTestPrometheus()
+	p.Flush(testPoints())
+
+	ct, body := scrape(p, "")
+	if ct != ContentTypeText {
+		t.Errorf("content type %q", ct)
+	}
+	want := `# HELP api_lat api.lat
+# TYPE api_lat summary
+api_lat{dc="eu",quantile="0.5"} 2
+api_lat{dc="eu",quantile="0.99"} 4
+api_lat_sum{dc="eu"} 10
+api_lat_count{dc="eu"} 4
+# HELP api_lat_min api.lat.min
+# TYPE api_lat_min gauge
+api_lat_min{dc="eu"} 1
+# HELP cpu_load cpu.load
+# TYPE cpu_load gauge
+cpu_load{path="C:\\tmp \"x\""} 0.5
+# HELP hits_total hits
+# TYPE hits_total counter
+hits_total{host="a"} 3
+`
+	if body != want {
+		t.Errorf("got\n%s\nwant\n%s", body, want)
+	}
+}
+
+func TestExpositionOpenMetrics(t *testing.T) {
+	p := newTestPrometheus()
+	p.Flush(testPoints())
+
+	ct, body := scrape(p, "application/openmetrics-text; version=1.0.0,text/plain;version=0.0.4;q=0.5")
+	if ct != ContentTypeOpenMetrics {
+		t.Errorf("content type %q", ct)
+	}
+	// counter 的 HELP 和 TYPE 行不带 _total, sample 带
+	if !strings.Contains(body, "# HELP hits hits\n# TYPE hits counter\nhits_total{host=\"a\"} 3\n") {
+		t.Errorf("counter family in\n%s", body)
+	}
+	if !strings.HasSuffix(body, "\n# EOF\n") {
+		t.Errorf("missing # EOF in\n%s", body)
+	}
+
+	ct, body = scrape(p, "text/plain")
+	if ct != ContentTypeText || strings.Contains(body, "# EOF") {
+		t.Errorf("text/plain got %q\n%s", ct, body)
+	}
+}
+
+func TestHelpEscape(t *testing.T) {
+	p := newTestPrometheus()
+	p.Flush([]point.Point{point.New("a\\b\nc\"d", "value", nil, 1, 10, point.Gauge)})
+
+	_, body := scrape(p, "")
+	if !strings.HasPrefix(body, "# HELP a_b_c_d a\\\\b\\nc\"d\n") {
+		t.Errorf("text got\n%s", body)
+	}
+	_, body = scrape(p, "application/openmetrics-text")
+	if !strings.HasPrefix(body, "# HELP a_b_c_d a\\\\b\\nc\\\"d\n") {
+		t.Errorf("openmetrics got\n%s", body)
+	}
+}
+
+func TestCounterTotal(t *testing.T) {
+	p := newTestPrometheus()
+	// aggregator 每个周期清空 counter, 输出的 _total 是各次增量之和
+	for _, v := range []float64{3, 0, 2} {
+		p.Flush([]point.Point{point.New("hits", "count", nil, v, 10, point.Counter)})
+	}
+	if _, body := scrape(p, ""); !strings.Contains(body, "\nhits_total 5\n") {
+		t.Errorf("got\n%s", body)
+	}
+
+	// 名字本身以 _total 结尾时不重复
+	p.Flush([]point.Point{point.New("bytes_total", "count", nil, 7, 10, point.Counter)})
+	if _, body := scrape(p, ""); !strings.Contains(body, "\nbytes_total 7\n") {
+		t.Errorf("got\n%s", body)
+	}
+}
+
+func TestExpire(t *testing.T) {
+	st := newStore(300)
+	now := time.Unix(1000, 0)
+	st.update([]point.Point{point.New("old", "value", nil, 1, 0, point.Gauge)}, now)
+	st.update([]point.Point{point.New("new", "value", nil, 1, 0, point.Gauge)}, now.Add(200*time.Second))
+
+	st.update(nil, now.Add(300*time.Second))
+	if len(st.families) != 2 {
+		t.Fatalf("got %d families at the ttl, want 2", len(st.families))
+	}
+	st.update(nil, now.Add(301*time.Second))
+	if _, ok := st.families["old"]; ok {
+		t.Error("old is kept after the ttl")
+	}
+	if _, ok := st.families["new"]; !ok {
+		t.Error("new is dropped before the ttl")
+	}
+}
+
+func TestSanitize(t *testing.T) {
+	for _, c := range []struct{ in, name, label string }{
+		{"api.lat-ms", "api_lat_ms", "api_lat_ms"},
+		{"ns:metric", "ns:metric", "ns_metric"},
+		{"9lives", "_9lives", "_9lives"},
+		{"__name__", "__name__", "tag__name__"},
+		{"häh", "h__h", "h__h"},
+		{"", "", ""},
+	} {
+		if got := sanitizeName(c.in); got != c.name {
+			t.Errorf("sanitizeName(%q) = %q, want %q", c.in, got, c.name)
+		}
+		if got := sanitizeLabel(c.in); got != c.label {
+			t.Errorf("sanitizeLabel(%q) = %q, want %q", c.in, got, c.label)
+		}
+	}
+}
+
+func TestLabels(t *testing.T) {
+	// 清理后重名的 label 只保留最后一个, summary 中的 quantile 改名
+	ls := labels([]string{"a.b=1", "a_b=2", "quantile=x", "=y", "bare"}, typeSummary)
+	want := []label{{"a_b", "2"}, {"bare", ""}, {"tag_quantile", "x"}}
+	if len(ls) != len(want) {
+		t.Fatalf("got %v, want %v", ls, want)
+	}
+	for i := range want {
+		if ls[i] != want[i] {
+			t.Errorf("got %v, want %v", ls, want)
+		}
+	}
+}
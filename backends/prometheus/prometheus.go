@@ -0,0 +1,107 @@
+package prometheus
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/coder-van/v-stats/point"
+	"github.com/coder-van/v-util/log"
+)
+
+/*
+ pull 模式的 backend, 保存最近一次刷新的数据, 由 Prometheus 抓取 /metrics
+ 数据的转换见 store.go, tags 作为 label 输出, 名字按 Prometheus 的规则替换非法字符
+*/
+
+// Config is the [backends.prometheus] section of the config file.
+type Config struct {
+	ListenAddr string `toml:"listen_addr"`
+	Path       string `toml:"path"`
+	// ExpireSeconds drops series that were not flushed for that long
+	ExpireSeconds int `toml:"expire_seconds"`
+}
+
+func (c *Config) Check() {
+	if c.ListenAddr == "" || strings.Index(c.ListenAddr, ":") < 0 {
+		panic("config backends.prometheus listen_addr is invail")
+	}
+	if c.Path == "" {
+		c.Path = "/metrics"
+	}
+	if c.ExpireSeconds < 1 {
+		fmt.Println("warn config backends.prometheus expire_seconds can't smaller than 1, set to 300")
+		c.ExpireSeconds = 300
+	}
+}
+
+func NewPrometheus(conf *Config) *Prometheus {
+	p := &Prometheus{
+		config: conf,
+		store:  newStore(conf.ExpireSeconds),
+		logger: log.GetLogger("statsd.PrometheusBackend", log.RotateModeMonth),
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc(conf.Path, p.handle)
+	p.server = &http.Server{
+		Addr:         conf.ListenAddr,
+		Handler:      mux,
+		ReadTimeout:  10 * time.Second,
+		WriteTimeout: 10 * time.Second,
+	}
+	return p
+}
+
+type Prometheus struct {
+	config *Config
+	server *http.Server
+	logger *log.Vlogger
+	store  *store
+}
+
+// Start listens on ListenAddr and serves scrapes in the background.
+func (p *Prometheus) Start() error {
+	l, err := net.Listen("tcp", p.config.ListenAddr)
+	if err != nil {
+		return err
+	}
+	p.logger.Println("Statsd prometheus backend listening on:", l.Addr())
+	go func() {
+		if err := p.server.Serve(l); err != nil && err != http.ErrServerClosed {
+			p.logger.Printf("Error serving prometheus scrapes: %s", err)
+		}
+	}()
+	return nil
+}
+
+func (p *Prometheus) Close() error {
+	return p.server.Close()
+}
+
+func (p *Prometheus) Flush(points []point.Point) error {
+	p.store.mu.Lock()
+	p.store.update(points, time.Now())
+	p.store.mu.Unlock()
+	return nil
+}
+
+func (p *Prometheus) handle(w http.ResponseWriter, r *http.Request) {
+	openMetrics := strings.Contains(r.Header.Get("Accept"), "application/openmetrics-text")
+
+	var buf strings.Builder
+	p.store.mu.Lock()
+	for _, f := range p.store.sortedFamilies() {
+		writeFamily(&buf, f, openMetrics)
+	}
+	p.store.mu.Unlock()
+
+	if openMetrics {
+		buf.WriteString("# EOF\n")
+		w.Header().Set("Content-Type", ContentTypeOpenMetrics)
+	} else {
+		w.Header().Set("Content-Type", ContentTypeText)
+	}
+	w.Write([]byte(buf.String()))
+}
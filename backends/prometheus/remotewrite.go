@@ -0,0 +1,185 @@
+package prometheus
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/coder-van/v-stats/backends/push"
+	"github.com/coder-van/v-stats/point"
+	"github.com/coder-van/v-stats/protobuf"
+	"github.com/golang/snappy"
+)
+
+/*
+ 通过 remote_write 协议推送到 Cortex, Mimir, Thanos Receive, VictoriaMetrics 等
+ body 是 snappy 压缩的 protobuf WriteRequest:
+ message WriteRequest { repeated TimeSeries timeseries = 1; }
+ message TimeSeries   { repeated Label labels = 1; repeated Sample samples = 2; }
+ message Label        { string name = 1; string value = 2; }
+ message Sample       { double value = 1; int64 timestamp = 2; }  // timestamp 单位毫秒
+ 数据的转换和 scrape 相同(见 store.go), 每次只推送本次刷新改变过的 sample
+ 失败的请求按 backends/push 的规则重试, 5xx 和 429 重试, 其他错误直接丢弃
+*/
+
+// RemoteWriteConfig is the [backends.prometheus_remote_write] section of the
+// config file.
+type RemoteWriteConfig struct {
+	URL         string `toml:"url"`
+	Username    string `toml:"username"`
+	Password    string `toml:"password"`
+	BearerToken string `toml:"bearer_token"`
+	// Headers are added to every request, e.g. X-Scope-OrgID for Cortex and Mimir
+	Headers map[string]string `toml:"headers"`
+
+	TimeoutSeconds int `toml:"timeout_seconds"`
+	MaxRetries     int `toml:"max_retries"`
+	// ExpireSeconds drops the counter totals of series that were not flushed
+	// for that long
+	ExpireSeconds int `toml:"expire_seconds"`
+}
+
+func (c *RemoteWriteConfig) Check() {
+	if c.URL == "" {
+		panic("config backends.prometheus_remote_write url is required")
+	}
+	if c.TimeoutSeconds < 1 {
+		fmt.Println("warn config backends.prometheus_remote_write timeout_seconds can't smaller than 1, set to 10")
+		c.TimeoutSeconds = 10
+	}
+	if c.MaxRetries < 1 {
+		fmt.Println("warn config backends.prometheus_remote_write max_retries can't smaller than 1, set to 3")
+		c.MaxRetries = 3
+	}
+	if c.ExpireSeconds < 1 {
+		fmt.Println("warn config backends.prometheus_remote_write expire_seconds can't smaller than 1, set to 300")
+		c.ExpireSeconds = 300
+	}
+}
+
+func NewRemoteWrite(conf *RemoteWriteConfig) *RemoteWrite {
+	return &RemoteWrite{
+		config: conf,
+		store:  newStore(conf.ExpireSeconds),
+		client: &http.Client{Timeout: time.Duration(conf.TimeoutSeconds) * time.Second},
+		queue:  push.Queue{MaxRetries: conf.MaxRetries, Unit: "series"},
+	}
+}
+
+type RemoteWrite struct {
+	config *RemoteWriteConfig
+	store  *store
+	client *http.Client
+
+	mu    sync.Mutex
+	queue push.Queue
+}
+
+func (rw *RemoteWrite) Flush(points []point.Point) error {
+	rw.mu.Lock()
+	defer rw.mu.Unlock()
+
+	if len(points) > 0 {
+		now := time.Now()
+		rw.store.mu.Lock()
+		rw.store.update(points, now)
+		req, n := encodeWriteRequest(rw.store.sortedFamilies(), now)
+		rw.store.mu.Unlock()
+		if n > 0 {
+			rw.queue.Add(snappy.Encode(nil, req), n)
+		}
+	}
+	return rw.queue.Send(rw.post)
+}
+
+func (rw *RemoteWrite) post(body []byte) error {
+	req, err := http.NewRequest("POST", rw.config.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("Content-Encoding", "snappy")
+	req.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+	req.Header.Set("User-Agent", "v-stats")
+	for k, v := range rw.config.Headers {
+		req.Header.Set(k, v)
+	}
+	if rw.config.BearerToken != "" {
+		req.Header.Set("Authorization", "Bearer "+rw.config.BearerToken)
+	} else if rw.config.Username != "" {
+		req.SetBasicAuth(rw.config.Username, rw.config.Password)
+	}
+	return push.Do(rw.client, req, "remote write")
+}
+
+// encodeWriteRequest encodes the samples changed by the update at now, it
+// returns the message and the number of time series in it.
+func encodeWriteRequest(families []*family, now time.Time) ([]byte, int) {
+	wr := protobuf.NewBuffer()
+	ts := protobuf.NewBuffer()
+	n := 0
+	write := func(name string, ls []label, v float64, ms int64) {
+		ts.Reset()
+		encodeLabels(ts, name, ls)
+		sample := protobuf.NewBuffer()
+		sample.Double(1, v)
+		sample.Int64(2, ms)
+		ts.Message(2, sample)
+		wr.Message(1, ts)
+		n++
+	}
+
+	for _, f := range families {
+		for _, s := range f.series {
+			if !s.updated.Equal(now) {
+				continue
+			}
+			ms := s.timestamp * 1000
+			if ms == 0 {
+				ms = now.UnixNano() / int64(time.Millisecond)
+			}
+			switch f.typ {
+			case typeCounter:
+				if s.valueChanged {
+					write(f.name+"_total", s.labels, s.value, ms)
+				}
+			case typeSummary:
+				for _, q := range s.changed {
+					ls := append(s.labels[:len(s.labels):len(s.labels)], label{"quantile", formatFloat(q)})
+					write(f.name, ls, s.quantiles[q], ms)
+				}
+				if s.sumChanged {
+					write(f.name+"_sum", s.labels, s.sum, ms)
+				}
+				if s.countChanged {
+					write(f.name+"_count", s.labels, s.count, ms)
+				}
+			default:
+				if s.valueChanged {
+					write(f.name, s.labels, s.value, ms)
+				}
+			}
+		}
+	}
+	return wr.Bytes(), n
+}
+
+// encodeLabels writes __name__ and ls sorted by label name, as required by
+// the remote write spec.
+func encodeLabels(ts *protobuf.Buffer, name string, ls []label) {
+	all := make([]label, 0, len(ls)+1)
+	all = append(all, label{"__name__", name})
+	all = append(all, ls...)
+	sort.Slice(all, func(i, j int) bool { return all[i].name < all[j].name })
+
+	l := protobuf.NewBuffer()
+	for _, lb := range all {
+		l.Reset()
+		l.String(1, lb.name)
+		l.String(2, lb.value)
+		ts.Message(1, l)
+	}
+}
@@ -0,0 +1,227 @@
+package prometheus
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/coder-van/v-stats/point"
+	"github.com/golang/snappy"
+)
+
+type pbField struct {
+	num   int
+	value uint64
+	bytes []byte
+}
+
+// decodeFields splits a protobuf message into its fields, only the wire
+// types used by remote write are handled.
+func decodeFields(t *testing.T, b []byte) []pbField {
+	var fs []pbField
+	for len(b) > 0 {
+		key, n := binary.Uvarint(b)
+		if n <= 0 {
+			t.Fatalf("bad field key")
+		}
+		b = b[n:]
+		f := pbField{num: int(key >> 3)}
+		switch key & 7 {
+		case 0:
+			f.value, n = binary.Uvarint(b)
+			if n <= 0 {
+				t.Fatalf("bad varint")
+			}
+			b = b[n:]
+		case 1:
+			f.value = binary.LittleEndian.Uint64(b)
+			b = b[8:]
+		case 2:
+			l, n := binary.Uvarint(b)
+			if n <= 0 || uint64(len(b)-n) < l {
+				t.Fatalf("bad length")
+			}
+			f.bytes = b[n : n+int(l)]
+			b = b[n+int(l):]
+		default:
+			t.Fatalf("unexpected wire type %d", key&7)
+		}
+		fs = append(fs, f)
+	}
+	return fs
+}
+
+type sample struct {
+	labels []label
+	value  float64
+	ms     int64
+}
+
+func decodeWriteRequest(t *testing.T, body []byte) map[string]sample {
+	raw, err := snappy.Decode(nil, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := make(map[string]sample)
+	for _, ts := range decodeFields(t, raw) {
+		var s sample
+		for _, f := range decodeFields(t, ts.bytes) {
+			switch f.num {
+			case 1:
+				var l label
+				for _, lf := range decodeFields(t, f.bytes) {
+					if lf.num == 1 {
+						l.name = string(lf.bytes)
+					} else {
+						l.value = string(lf.bytes)
+					}
+				}
+				s.labels = append(s.labels, l)
+			case 2:
+				for _, sf := range decodeFields(t, f.bytes) {
+					if sf.num == 1 {
+						s.value = math.Float64frombits(sf.value)
+					} else {
+						s.ms = int64(sf.value)
+					}
+				}
+			}
+		}
+		parts := make([]string, len(s.labels))
+		for i, l := range s.labels {
+			parts[i] = l.name + "=" + l.value
+		}
+		out[strings.Join(parts, ",")] = s
+	}
+	return out
+}
+
+// remoteWriteServer records the bodies it receives.
+type remoteWriteServer struct {
+	*httptest.Server
+	mu     sync.Mutex
+	bodies [][]byte
+}
+
+func newRemoteWriteServer() *remoteWriteServer {
+	s := &remoteWriteServer{}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.bodies = append(s.bodies, body)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	return s
+}
+
+func (s *remoteWriteServer) requests() [][]byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.bodies
+}
+
+func newTestRemoteWrite(url string) *RemoteWrite {
+	conf := &RemoteWriteConfig{URL: url}
+	conf.Check()
+	return NewRemoteWrite(conf)
+}
+
+func TestRemoteWriteLabels(t *testing.T) {
+	srv := newRemoteWriteServer()
+	defer srv.Close()
+	rw := newTestRemoteWrite(srv.URL)
+
+	tags := []string{"a.b=1", "a_b=2", "quantile=x"}
+	err := rw.Flush([]point.Point{
+		point.New("hits", "count", []string{"host=a"}, 3, 100, point.Counter),
+		point.New("hits", "rate", []string{"host=a"}, 0.6, 100, point.Counter),
+		point.New("api.lat", "count", tags, 4, 100, point.Timer),
+		point.New("api.lat", "mean", tags, 2.5, 100, point.Timer),
+		point.New("api.lat", "p99_9", tags, 9, 100, point.Timer),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	reqs := srv.requests()
+	if len(reqs) != 1 {
+		t.Fatalf("got %d requests, want 1", len(reqs))
+	}
+	got := decodeWriteRequest(t, reqs[0])
+	want := map[string]float64{
+		"__name__=hits_total,host=a":                           3,
+		"__name__=api_lat,a_b=2,quantile=0.999,tag_quantile=x": 9,
+		"__name__=api_lat_count,a_b=2,tag_quantile=x":          4,
+		"__name__=api_lat_sum,a_b=2,tag_quantile=x":            10,
+	}
+	if len(got) != len(want) {
+		t.Errorf("got series %v", got)
+	}
+	for key, v := range want {
+		s, ok := got[key]
+		if !ok {
+			t.Errorf("missing series %s", key)
+			continue
+		}
+		if s.value != v || s.ms != 100000 {
+			t.Errorf("%s: got %v at %d, want %v at 100000", key, s.value, s.ms, v)
+		}
+		if !sort.SliceIsSorted(s.labels, func(i, j int) bool { return s.labels[i].name < s.labels[j].name }) {
+			t.Errorf("%s: labels are not sorted", key)
+		}
+	}
+}
+
+func TestRemoteWriteSplitTimer(t *testing.T) {
+	srv := newRemoteWriteServer()
+	defer srv.Close()
+	rw := newTestRemoteWrite(srv.URL)
+
+	points := []point.Point{
+		point.New("lat", "count", nil, 4, 20, point.Timer),
+		point.New("lat", "min", nil, 1, 20, point.Timer),
+		point.New("lat", "mean", nil, 2.5, 20, point.Timer),
+		point.New("lat", "p50", nil, 5, 20, point.Timer),
+		point.New("lat", "p99", nil, 7, 20, point.Timer),
+	}
+	// 同一个 timer 的字段被 BackendManger 分到两次 Flush 中
+	for _, chunk := range [][]point.Point{points[:4], points[4:]} {
+		if err := rw.Flush(chunk); err != nil {
+			t.Fatal(err)
+		}
+	}
+	reqs := srv.requests()
+	if len(reqs) != 2 {
+		t.Fatalf("got %d requests, want 2", len(reqs))
+	}
+	seen := make(map[string]float64)
+	for i, req := range reqs {
+		for key, s := range decodeWriteRequest(t, req) {
+			if v, ok := seen[key]; ok {
+				t.Errorf("request %d: %s sent again, %v then %v", i, key, v, s.value)
+			}
+			seen[key] = s.value
+		}
+	}
+	want := map[string]float64{
+		"__name__=lat_count":         4,
+		"__name__=lat_sum":           10,
+		"__name__=lat_min":           1,
+		"__name__=lat,quantile=0.5":  5,
+		"__name__=lat,quantile=0.99": 7,
+	}
+	if len(seen) != len(want) {
+		t.Errorf("got series %v", seen)
+	}
+	for key, v := range want {
+		if seen[key] != v {
+			t.Errorf("%s: got %v, want %v", key, seen[key], v)
+		}
+	}
+}
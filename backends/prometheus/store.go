@@ -0,0 +1,228 @@
+package prometheus
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coder-van/v-stats/point"
+)
+
+/*
+ store 把数据点转换成 Prometheus 的数据模型, scrape 和 remote_write 共用
+ counter: aggregator 每个周期会清空 counter, 这里把每次的增量累加, 输出单调递增的 <name>_total
+ timer, histogram: 输出 summary, 百分位作为 quantile, 另外输出 min, max 等 gauge
+ gauge, set: 输出 gauge
+*/
+
+type metricType string
+
+const (
+	typeCounter metricType = "counter"
+	typeGauge   metricType = "gauge"
+	typeSummary metricType = "summary"
+)
+
+// family is all series of one metric name.
+type family struct {
+	name string
+	typ  metricType
+	// help 是清理之前的 statsd 名字, 输出在 HELP 行
+	help   string
+	series map[string]*series
+}
+
+type series struct {
+	labels    []label
+	value     float64
+	count     float64
+	sum       float64
+	quantiles map[float64]float64
+	// timestamp 是最近一次数据点的时间, 单位秒
+	timestamp int64
+	updated   time.Time
+	// 以下记录 updated 那一次 update 中改变的值, remote write 只推送这些,
+	// 一个 timer 的字段可能被分到两次 Flush 中, 同一个时间戳的 sample 推送两次会被拒绝
+	valueChanged bool
+	countChanged bool
+	sumChanged   bool
+	changed      []float64
+}
+
+// touch marks s as updated at now, forgetting the changes of an earlier update.
+func (s *series) touch(now time.Time) {
+	if !s.updated.Equal(now) {
+		s.updated = now
+		s.valueChanged, s.countChanged, s.sumChanged = false, false, false
+		s.changed = s.changed[:0]
+	}
+}
+
+type label struct {
+	name, value string
+}
+
+type store struct {
+	mu       sync.Mutex
+	families map[string]*family
+	ttl      time.Duration
+}
+
+func newStore(expireSeconds int) *store {
+	return &store{
+		families: make(map[string]*family),
+		ttl:      time.Duration(expireSeconds) * time.Second,
+	}
+}
+
+// update applies a batch and drops expired series, the caller holds mu.
+func (st *store) update(points []point.Point, now time.Time) {
+	for _, pt := range points {
+		st.add(pt, now)
+	}
+	st.expire(now)
+}
+
+func (st *store) add(pt point.Point, now time.Time) {
+	name := sanitizeName(pt.Name)
+	var s *series
+	switch pt.Kind {
+	case point.Counter:
+		// rate 可以由 Prometheus 自己计算
+		if pt.Field != "count" {
+			return
+		}
+		s = st.series(strings.TrimSuffix(name, "_total"), typeCounter, pt.Name, pt.Tags, now)
+		s.value += pt.Value
+		s.valueChanged = true
+	case point.Timer, point.Histogram:
+		if q, ok := point.Quantile(pt.Field); ok {
+			s = st.series(name, typeSummary, pt.Name, pt.Tags, now)
+			if !containsFloat(s.changed, q) {
+				s.changed = append(s.changed, q)
+			}
+			s.quantiles[q] = pt.Value
+			break
+		}
+		switch pt.Field {
+		case "count":
+			s = st.series(name, typeSummary, pt.Name, pt.Tags, now)
+			s.count = pt.Value
+			s.countChanged = true
+		case "mean":
+			// sum 由 mean * count 得到, count 总是先于 mean 输出
+			s = st.series(name, typeSummary, pt.Name, pt.Tags, now)
+			s.sum = pt.Value * s.count
+			s.sumChanged = true
+		default:
+			s = st.series(name+"_"+sanitizeName(pt.Field), typeGauge, pt.Path(), pt.Tags, now)
+			s.value = pt.Value
+			s.valueChanged = true
+		}
+	default:
+		s = st.series(name, typeGauge, pt.Name, pt.Tags, now)
+		s.value = pt.Value
+		s.valueChanged = true
+	}
+	s.timestamp = pt.Timestamp
+}
+
+func containsFloat(fs []float64, f float64) bool {
+	for _, v := range fs {
+		if v == f {
+			return true
+		}
+	}
+	return false
+}
+
+// series returns the series of a family, creating both when needed, and
+// marks it updated at now.
+func (st *store) series(name string, typ metricType, help string, tags []string, now time.Time) *series {
+	f, ok := st.families[name]
+	if !ok || f.typ != typ {
+		// 同名但类型不同时以最新的为准
+		f = &family{name: name, typ: typ, help: help, series: make(map[string]*series)}
+		st.families[name] = f
+	}
+	// 不同的 tags 清理之后可能得到相同的 labels, 按 labels 区分 series
+	ls := labels(tags, typ)
+	key := labelsKey(ls)
+	s, ok := f.series[key]
+	if !ok {
+		s = &series{labels: ls}
+		if typ == typeSummary {
+			s.quantiles = make(map[float64]float64)
+		}
+		f.series[key] = s
+	}
+	s.touch(now)
+	return s
+}
+
+func (st *store) expire(now time.Time) {
+	for name, f := range st.families {
+		for key, s := range f.series {
+			if now.Sub(s.updated) > st.ttl {
+				delete(f.series, key)
+			}
+		}
+		if len(f.series) == 0 {
+			delete(st.families, name)
+		}
+	}
+}
+
+// sortedFamilies returns the families ordered by name, the caller holds mu.
+func (st *store) sortedFamilies() []*family {
+	fs := make([]*family, 0, len(st.families))
+	for _, f := range st.families {
+		fs = append(fs, f)
+	}
+	sort.Slice(fs, func(i, j int) bool { return fs[i].name < fs[j].name })
+	return fs
+}
+
+// labels turns tags into sorted label pairs. Label names are unique after
+// sanitizing, the last tag wins, and "quantile" is reserved in summaries.
+func labels(tags []string, typ metricType) []label {
+	ls := make([]label, 0, len(tags))
+	for _, tag := range tags {
+		k, v := point.SplitTag(tag)
+		k = sanitizeLabel(k)
+		if k == "" {
+			continue
+		}
+		if k == "quantile" && typ == typeSummary {
+			k = "tag_quantile"
+		}
+		ls = append(ls, label{name: k, value: v})
+	}
+	sort.SliceStable(ls, func(i, j int) bool { return ls[i].name < ls[j].name })
+	// 例如 a.b 和 a_b 清理后都是 a_b, 重复的 label 会让整个请求被拒绝
+	out := ls[:0]
+	for _, l := range ls {
+		if n := len(out); n > 0 && out[n-1].name == l.name {
+			out[n-1] = l
+			continue
+		}
+		out = append(out, l)
+	}
+	return out
+}
+
+// labelsKey identifies a label set, values may contain any byte so they are
+// length prefixed.
+func labelsKey(ls []label) string {
+	var b strings.Builder
+	for _, l := range ls {
+		b.WriteString(l.name)
+		b.WriteByte('=')
+		b.WriteString(strconv.Itoa(len(l.value)))
+		b.WriteByte(':')
+		b.WriteString(l.value)
+	}
+	return b.String()
+}
@@ -0,0 +1,147 @@
+package push
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+/*
+ 通过 http 推送的 backend(influxdb, prometheus remote write, otlp)共用的发送逻辑
+ 每次 Flush 编码出的请求 body 作为一个 batch 放入 Queue, 然后按顺序发送
+ 不可重试的错误(一般是 4xx, 数据或者配置有问题, 重试也不会成功)直接丢弃这个 batch;
+ 可重试的 batch 保留下来, 在之后的 Flush 中先于新的 batch 按顺序重发, 最多重试 MaxRetries 次
+ Flush 中不能 sleep 等待重试, BackendManger 要等所有 backend 的 Flush 返回, 会拖慢其他 backend
+ 一次 Send 遇到可重试的错误就停止, 最多只会等待一次请求超时
+*/
+const (
+	// 最多保留的待发送 batch 数量, 超过时丢弃最旧的
+	MaxPendingBatches = 16
+)
+
+// StatusError is returned by Do for non 2xx responses.
+type StatusError struct {
+	// Service names the remote end in the message, e.g. influxdb
+	Service    string
+	StatusCode int
+	Body       string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("%s responded %d: %s", e.Service, e.StatusCode, e.Body)
+}
+
+// RetryableStatus tells whether a request answered with code may succeed
+// when it is sent again, that is 5xx and 429.
+func RetryableStatus(code int) bool {
+	return code >= 500 || code == http.StatusTooManyRequests
+}
+
+// Do sends req and returns a *StatusError for non 2xx responses.
+func Do(client *http.Client, req *http.Request, service string) error {
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+	if resp.StatusCode/100 != 2 {
+		return &StatusError{Service: service, StatusCode: resp.StatusCode, Body: strings.TrimSpace(string(msg))}
+	}
+	return nil
+}
+
+// Gzip compresses a request body.
+func Gzip(b []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write(b); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Queue holds the batches waiting to be sent, it is not safe for concurrent
+// use.
+type Queue struct {
+	// MaxRetries is how many times a batch is sent again before it is dropped
+	MaxRetries int
+	// Retryable tells which status codes are retried, RetryableStatus when nil
+	Retryable func(code int) bool
+	// Unit names what the size of a batch counts in errors, e.g. points
+	Unit string
+
+	pending []*batch
+}
+
+type batch struct {
+	body     []byte
+	size     int
+	attempts int
+}
+
+// Add queues a request body holding size units.
+func (q *Queue) Add(body []byte, size int) {
+	q.pending = append(q.pending, &batch{body: body, size: size})
+}
+
+// Len returns the number of batches waiting to be sent.
+func (q *Queue) Len() int {
+	return len(q.pending)
+}
+
+// Send posts the pending batches in order and stops at the first failure
+// that may succeed later.
+func (q *Queue) Send(post func(body []byte) error) error {
+	var errs []string
+	for len(q.pending) > 0 {
+		b := q.pending[0]
+		b.attempts++
+		err := post(b.body)
+		if err == nil {
+			q.pending = q.pending[1:]
+			continue
+		}
+		if !q.retryable(err) {
+			q.pending = q.pending[1:]
+			errs = append(errs, fmt.Sprintf("dropped batch of %d %s, %s", b.size, q.Unit, err))
+			continue
+		}
+		if b.attempts > q.MaxRetries {
+			q.pending = q.pending[1:]
+			errs = append(errs, fmt.Sprintf("dropped batch of %d %s after %d attempts, %s", b.size, q.Unit, b.attempts, err))
+		} else {
+			errs = append(errs, fmt.Sprintf("%d batches queued for retry, %s", len(q.pending), err))
+		}
+		break
+	}
+	for len(q.pending) > MaxPendingBatches {
+		errs = append(errs, fmt.Sprintf("dropped batch of %d %s, too many batches pending", q.pending[0].size, q.Unit))
+		q.pending = q.pending[1:]
+	}
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// retryable tells whether sending the same batch again may succeed, errors
+// other than *StatusError are network errors and are retried.
+func (q *Queue) retryable(err error) bool {
+	se, ok := err.(*StatusError)
+	if !ok {
+		return true
+	}
+	if q.Retryable != nil {
+		return q.Retryable(se.StatusCode)
+	}
+	return RetryableStatus(se.StatusCode)
+}
@@ -0,0 +1,155 @@
+package push
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// server answers with the given status codes in turn and records the
+// bodies, the last code is repeated.
+type server struct {
+	codes  []int
+	bodies []string
+}
+
+func (s *server) post(body []byte) error {
+	s.bodies = append(s.bodies, string(body))
+	code := s.codes[0]
+	if len(s.codes) > 1 {
+		s.codes = s.codes[1:]
+	}
+	if code/100 != 2 {
+		return &StatusError{Service: "test", StatusCode: code}
+	}
+	return nil
+}
+
+func TestRetry(t *testing.T) {
+	s := &server{codes: []int{http.StatusServiceUnavailable, http.StatusNoContent}}
+	q := &Queue{MaxRetries: 2, Unit: "points"}
+
+	q.Add([]byte("1"), 1)
+	if err := q.Send(s.post); err == nil {
+		t.Fatal("expected an error on 503")
+	}
+	q.Add([]byte("2"), 1)
+	if err := q.Send(s.post); err != nil {
+		t.Fatal(err)
+	}
+	// 失败的 batch 先于新的 batch 重发
+	if got := strings.Join(s.bodies, ","); got != "1,1,2" {
+		t.Errorf("sent %s, want 1,1,2", got)
+	}
+	if q.Len() != 0 {
+		t.Errorf("%d batches still pending", q.Len())
+	}
+}
+
+func TestNoRetryOn4xx(t *testing.T) {
+	s := &server{codes: []int{http.StatusBadRequest, http.StatusNoContent}}
+	q := &Queue{MaxRetries: 2, Unit: "points"}
+
+	q.Add([]byte("1"), 1)
+	q.Add([]byte("2"), 1)
+	err := q.Send(s.post)
+	if err == nil || !strings.Contains(err.Error(), "dropped batch of 1 points") {
+		t.Fatalf("got error %v", err)
+	}
+	// 被丢弃的 batch 不会挡住后面的 batch
+	if got := strings.Join(s.bodies, ","); got != "1,2" {
+		t.Errorf("sent %s, want 1,2", got)
+	}
+	if q.Len() != 0 {
+		t.Errorf("%d batches still pending", q.Len())
+	}
+}
+
+func TestRetryableCodes(t *testing.T) {
+	s := &server{codes: []int{http.StatusInternalServerError}}
+	q := &Queue{MaxRetries: 2, Retryable: func(code int) bool { return code == http.StatusServiceUnavailable }}
+	q.Add([]byte("1"), 1)
+	q.Send(s.post)
+	if q.Len() != 0 {
+		t.Error("500 was retried")
+	}
+
+	// 网络错误总是重试
+	q.Add([]byte("1"), 1)
+	q.Send(func(body []byte) error { return errors.New("connection refused") })
+	if q.Len() != 1 {
+		t.Error("a network error was not retried")
+	}
+}
+
+func TestGivesUp(t *testing.T) {
+	s := &server{codes: []int{http.StatusInternalServerError}}
+	q := &Queue{MaxRetries: 2}
+	for i := 0; i < 3; i++ {
+		q.Add([]byte{byte('0' + i)}, 1)
+		q.Send(s.post)
+	}
+	// 第一个 batch 在 1 + MaxRetries 次之后被丢弃, 每次 Send 遇到错误就停止
+	if got := strings.Join(s.bodies, ","); got != "0,0,0" {
+		t.Errorf("sent %s, want 0,0,0", got)
+	}
+	if q.Len() != 2 || q.pending[0].attempts != 0 {
+		t.Errorf("got %d pending batches", q.Len())
+	}
+}
+
+func TestMaxPendingBatches(t *testing.T) {
+	s := &server{codes: []int{http.StatusServiceUnavailable}}
+	q := &Queue{MaxRetries: 100}
+	for i := 0; i < MaxPendingBatches+5; i++ {
+		q.Add([]byte("x"), 1)
+		q.Send(s.post)
+	}
+	if q.Len() != MaxPendingBatches {
+		t.Errorf("got %d pending batches, want %d", q.Len(), MaxPendingBatches)
+	}
+}
+
+func TestDo(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/ok" {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		http.Error(w, "bad series", http.StatusBadRequest)
+	}))
+	defer srv.Close()
+
+	req, _ := http.NewRequest("POST", srv.URL+"/ok", nil)
+	if err := Do(srv.Client(), req, "test"); err != nil {
+		t.Fatal(err)
+	}
+	req, _ = http.NewRequest("POST", srv.URL+"/bad", nil)
+	err := Do(srv.Client(), req, "test")
+	se, ok := err.(*StatusError)
+	if !ok || se.StatusCode != http.StatusBadRequest || se.Body != "bad series" {
+		t.Fatalf("got %#v", err)
+	}
+	if se.Error() != "test responded 400: bad series" {
+		t.Errorf("got %q", se.Error())
+	}
+}
+
+func TestGzip(t *testing.T) {
+	b, err := Gzip([]byte("a value=1 1\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := ioutil.ReadAll(zr); string(got) != "a value=1 1\n" {
+		t.Errorf("got %q", got)
+	}
+}
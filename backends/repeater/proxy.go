@@ -0,0 +1,266 @@
+package repeater
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/coder-van/v-stats/parser"
+	"github.com/coder-van/v-util/log"
+)
+
+/*
+ proxy 模式下 StatsD 不做聚合, receiver 收到的数据包由 Proxy 逐行转发,
+ 按 metric 名(不含 tags)在一致性哈希环上选择下游节点, 同一个 metric 总是落在同一个节点上,
+ 这样各节点算出的百分位和 set 才是正确的
+ 健康检查:
+ tcp: 连接节点的地址, 下游用 tcp 接收时使用
+ admin: 连接节点的 admin 端口发送 health, 回复 "health: up" 为健康(Etsy statsd 的 admin 接口)
+ none: 不检查, 只有发送失败的节点在重连等待期间被跳过
+ 节点不健康时它的 metric 转发给环上的下一个健康节点, 恢复后迁回
+ 没有健康节点, 以及节点连接失败或等待重连时丢弃的行计入 proxy.dropped_lines
+*/
+const (
+	HealthCheckTCP   = "tcp"
+	HealthCheckAdmin = "admin"
+	HealthCheckNone  = "none"
+)
+
+// ProxyConfig is the [proxy] section of the config file.
+type ProxyConfig struct {
+	Nodes              []string `toml:"nodes"`
+	Protocol           string   `toml:"protocol"`
+	MTU                int      `toml:"mtu"`
+	HealthCheck        string   `toml:"health_check"`
+	HealthCheckSeconds int      `toml:"health_check_seconds"`
+	AdminPort          int      `toml:"admin_port"`
+}
+
+func (c *ProxyConfig) Check() {
+	if len(c.Nodes) == 0 {
+		panic("config proxy nodes is empty")
+	}
+	for _, n := range c.Nodes {
+		if strings.Index(n, ":") < 0 {
+			panic("config proxy node " + n + " is invail")
+		}
+	}
+	switch c.Protocol {
+	case ProtocolUDP, ProtocolTCP:
+	case "":
+		c.Protocol = ProtocolUDP
+	default:
+		panic("config proxy protocol must be udp or tcp")
+	}
+	if c.MTU < 512 {
+		fmt.Println("warn config proxy mtu can't smaller than 512, set to 1432")
+		c.MTU = DefaultMTU
+	}
+	switch c.HealthCheck {
+	case HealthCheckTCP, HealthCheckAdmin, HealthCheckNone:
+	case "":
+		c.HealthCheck = HealthCheckNone
+	default:
+		panic("config proxy health_check must be tcp, admin or none")
+	}
+	if c.HealthCheckSeconds < 1 {
+		fmt.Println("warn config proxy health_check_seconds can't smaller than 1, set to 10")
+		c.HealthCheckSeconds = 10
+	}
+	if c.AdminPort < 1 {
+		c.AdminPort = 8126
+	}
+}
+
+func NewProxy(conf *ProxyConfig, in chan []byte) *Proxy {
+	p := &Proxy{
+		config: conf,
+		in:     in,
+		exit:   make(chan bool),
+		ring:   newRing(conf.Nodes),
+		stat:   nopStat{},
+		logger: log.GetLogger("statsd.Proxy", log.RotateModeMonth),
+	}
+	for _, addr := range conf.Nodes {
+		p.nodes = append(p.nodes, &node{
+			target: newTarget(addr, conf.Protocol, conf.MTU, p.logger),
+			up:     1,
+		})
+	}
+	p.isUp = p.nodeUp
+	return p
+}
+
+type node struct {
+	*target
+	// up 由健康检查的 goroutine 修改, 1 健康 0 故障
+	up int32
+}
+
+// Stat records the self-metrics of the proxy.
+type Stat interface {
+	CounterInc(key string, i interface{})
+}
+
+type nopStat struct{}
+
+func (nopStat) CounterInc(key string, i interface{}) {}
+
+type Proxy struct {
+	config *ProxyConfig
+	in     chan []byte
+	exit   chan bool
+	ring   *ring
+	nodes  []*node
+	drops  int64
+	stat   Stat
+	logger *log.Vlogger
+	// isUp 是 nodeUp 的 method value, 避免每行都分配一次
+	isUp func(int) bool
+}
+
+// SetStat sets where the proxy records dropped lines, it must be called
+// before Start.
+func (p *Proxy) SetStat(stat Stat) {
+	p.stat = stat
+}
+
+func (p *Proxy) nodeUp(i int) bool {
+	n := p.nodes[i]
+	return atomic.LoadInt32(&n.up) == 1 && n.ready()
+}
+
+func (p *Proxy) run(shutdown chan bool) {
+	defer close(p.exit)
+
+	stopCheck := make(chan bool)
+	if p.config.HealthCheck != HealthCheckNone {
+		go p.healthCheck(stopCheck)
+	}
+
+	p.logger.Println("Statsd Proxy started")
+	for {
+		select {
+		case <-shutdown:
+			close(stopCheck)
+			for len(p.in) > 0 {
+				p.route(<-p.in)
+			}
+			for _, n := range p.nodes {
+				n.flush()
+				n.close()
+			}
+			p.countDropped()
+			p.logger.Println("Statsd Proxy stoped")
+			return
+		case packet := <-p.in:
+			p.route(packet)
+			if len(p.in) == 0 {
+				for _, n := range p.nodes {
+					n.flush()
+				}
+			}
+			p.countDropped()
+		}
+	}
+}
+
+// countDropped records the lines the nodes could not send, e.g. the lines
+// coalesced for a node that went down.
+func (p *Proxy) countDropped() {
+	for _, n := range p.nodes {
+		if d := n.takeDropped(); d > 0 {
+			p.stat.CounterInc("proxy.dropped_lines", d)
+		}
+	}
+}
+
+// route hands every line of packet to the node owning its metric name.
+func (p *Proxy) route(packet []byte) {
+	for line, rest := parser.NextLine(packet); line != nil; line, rest = parser.NextLine(rest) {
+		i := p.ring.get(parser.Name(line), p.isUp)
+		if i < 0 {
+			p.stat.CounterInc("proxy.dropped_lines", 1)
+			if n := atomic.AddInt64(&p.drops, 1); n&(n-1) == 0 {
+				p.logger.Printf("ERROR: proxy has no healthy node, dropped %d lines", n)
+			}
+			continue
+		}
+		p.nodes[i].add(line)
+	}
+}
+
+func (p *Proxy) healthCheck(stop chan bool) {
+	ticker := time.NewTicker(time.Duration(p.config.HealthCheckSeconds) * time.Second)
+	defer ticker.Stop()
+	for {
+		for _, n := range p.nodes {
+			err := p.check(n.addr)
+			up := int32(1)
+			if err != nil {
+				up = 0
+			}
+			if old := atomic.SwapInt32(&n.up, up); old != up {
+				if up == 1 {
+					p.logger.Printf("proxy node %s is up", n.addr)
+				} else {
+					p.logger.Printf("proxy node %s is down, %s", n.addr, err)
+				}
+			}
+		}
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (p *Proxy) check(addr string) error {
+	timeout := time.Duration(p.config.HealthCheckSeconds) * time.Second / 2
+	if p.config.HealthCheck == HealthCheckTCP {
+		c, err := net.DialTimeout("tcp", addr, timeout)
+		if err != nil {
+			return err
+		}
+		return c.Close()
+	}
+
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	c, err := net.DialTimeout("tcp", net.JoinHostPort(host, strconv.Itoa(p.config.AdminPort)), timeout)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(timeout))
+	if _, err := c.Write([]byte("health\n")); err != nil {
+		return err
+	}
+	line, err := bufio.NewReader(c).ReadString('\n')
+	if err != nil {
+		return err
+	}
+	if !strings.Contains(line, "up") {
+		return fmt.Errorf("admin health reports %q", strings.TrimSpace(line))
+	}
+	return nil
+}
+
+func (p *Proxy) Start() {
+	p.logger.Println("Statsd Proxy starting")
+	go p.run(p.exit)
+}
+
+func (p *Proxy) Stop() {
+	p.logger.Println("Statsd Proxy stoping")
+	p.exit <- true
+	// run 发送完队列中剩下的数据包, 关闭连接后关闭 exit
+	<-p.exit
+}
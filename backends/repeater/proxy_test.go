@@ -0,0 +1,90 @@
+package repeater
+
+import (
+	"bufio"
+	"net"
+	"testing"
+	"time"
+)
+
+type countStat map[string]int
+
+func (s countStat) CounterInc(key string, i interface{}) {
+	s[key] += i.(int)
+}
+
+func TestProxyDroppedLines(t *testing.T) {
+	// 拿到一个没有监听的端口
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	conf := &ProxyConfig{Nodes: []string{addr}, Protocol: ProtocolTCP}
+	conf.Check()
+	p := NewProxy(conf, make(chan []byte))
+	stat := countStat{}
+	p.SetStat(stat)
+
+	// 合并中的两行在连接失败时被丢弃
+	p.route([]byte("a:1|c\nb:2|c"))
+	for _, n := range p.nodes {
+		n.flush()
+	}
+	p.countDropped()
+	if stat["proxy.dropped_lines"] != 2 {
+		t.Fatalf("got %d dropped lines, want 2", stat["proxy.dropped_lines"])
+	}
+	// 等待重连期间没有可用的节点
+	p.route([]byte("c:1|c"))
+	p.countDropped()
+	if stat["proxy.dropped_lines"] != 3 {
+		t.Fatalf("got %d dropped lines, want 3", stat["proxy.dropped_lines"])
+	}
+}
+
+func TestProxyStop(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	lines := make(chan string, 2)
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		line, _ := bufio.NewReader(c).ReadString('\n')
+		lines <- line
+	}()
+
+	conf := &ProxyConfig{Nodes: []string{l.Addr().String()}, Protocol: ProtocolTCP}
+	conf.Check()
+	in := make(chan []byte, 16)
+	p := NewProxy(conf, in)
+	p.Start()
+	in <- []byte("a:1|c")
+	p.Stop()
+
+	// Stop 返回时 run 已经退出, 队列中的数据包已经发送
+	select {
+	case <-p.exit:
+	default:
+		t.Fatal("Stop returned before run exited")
+	}
+	if len(in) != 0 {
+		t.Fatalf("%d packets left in the queue", len(in))
+	}
+	select {
+	case line := <-lines:
+		if line != "a:1|c\n" {
+			t.Fatalf("got %q", line)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("timeout waiting for the forwarded line")
+	}
+}
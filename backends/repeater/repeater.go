@@ -1 +1,186 @@
 package repeater
+
+import (
+	"fmt"
+	"strings"
+	"sync/atomic"
+
+	"github.com/coder-van/v-stats/parser"
+	"github.com/coder-van/v-util/log"
+)
+
+/*
+ 和 Etsy statsd 的 repeater 一样, 在聚合之前把收到的原始数据包原样转发给下游的 statsd
+ receiver 收到数据包后调用 Repeat, 数据包进入队列后由单独的 goroutine 发送, 不会阻塞接收
+ prefixes: 只转发名字以这些前缀开头的行, 为空时转发所有行
+ coalesce: 把多个数据包的行合并成不超过 mtu 的数据包再发送, 队列空了就立刻发送, 不会额外等待
+*/
+const (
+	ProtocolUDP = "udp"
+	ProtocolTCP = "tcp"
+
+	// 和 graphite udp 一样, 以太网 MTU 1500 减去 IP 和 UDP 头
+	DefaultMTU = 1432
+)
+
+// Config is the [backends.repeater] section of the config file.
+type Config struct {
+	Targets   []string `toml:"targets"`
+	Protocol  string   `toml:"protocol"`
+	Prefixes  []string `toml:"prefixes"`
+	Coalesce  bool     `toml:"coalesce"`
+	MTU       int      `toml:"mtu"`
+	QueueSize int      `toml:"queue_size"`
+}
+
+func (c *Config) Check() {
+	if len(c.Targets) == 0 {
+		panic("config backends.repeater targets is empty")
+	}
+	for _, t := range c.Targets {
+		if strings.Index(t, ":") < 0 {
+			panic("config backends.repeater target " + t + " is invail")
+		}
+	}
+	switch c.Protocol {
+	case ProtocolUDP, ProtocolTCP:
+	case "":
+		c.Protocol = ProtocolUDP
+	default:
+		panic("config backends.repeater protocol must be udp or tcp")
+	}
+	if c.MTU < 512 {
+		fmt.Println("warn config backends.repeater mtu can't smaller than 512, set to 1432")
+		c.MTU = DefaultMTU
+	}
+	if c.QueueSize < 1024 {
+		fmt.Println("warn config backends.repeater queue_size can't smaller than 1024, set to 10000")
+		c.QueueSize = 10000
+	}
+}
+
+func NewRepeater(conf *Config) *Repeater {
+	r := &Repeater{
+		config: conf,
+		in:     make(chan []byte, conf.QueueSize),
+		exit:   make(chan bool),
+		logger: log.GetLogger("statsd.Repeater", log.RotateModeMonth),
+	}
+	for _, addr := range conf.Targets {
+		r.targets = append(r.targets, newTarget(addr, conf.Protocol, conf.MTU, r.logger))
+	}
+	return r
+}
+
+type Repeater struct {
+	config  *Config
+	in      chan []byte
+	exit    chan bool
+	targets []*target
+	drops   int64
+	logger  *log.Vlogger
+	// lines 是过滤后还没有发送的行, 不合并时复用
+	lines []byte
+}
+
+// Repeat queues a raw packet for forwarding, the packet must not be modified
+// afterwards. It never blocks, packets are dropped when the queue is full.
+func (r *Repeater) Repeat(packet []byte) {
+	if len(packet) == 0 {
+		// 空的 udp 数据包, 没有需要转发的内容
+		return
+	}
+	select {
+	case r.in <- packet:
+	default:
+		if n := atomic.AddInt64(&r.drops, 1); n&(n-1) == 0 {
+			// 只在丢弃数是 2 的幂时记录, 避免刷屏
+			r.logger.Printf("ERROR: repeater queue full, dropped %d packets", n)
+		}
+	}
+}
+
+func (r *Repeater) run(shutdown chan bool) {
+	defer close(r.exit)
+	r.logger.Println("Statsd Repeater started")
+	for {
+		select {
+		case <-shutdown:
+			for len(r.in) > 0 {
+				r.handle(<-r.in)
+			}
+			r.flush()
+			for _, t := range r.targets {
+				t.close()
+			}
+			r.logger.Println("Statsd Repeater stoped")
+			return
+		case p := <-r.in:
+			r.handle(p)
+			if len(r.in) == 0 {
+				r.flush()
+			}
+		}
+	}
+}
+
+func (r *Repeater) handle(packet []byte) {
+	if len(r.config.Prefixes) == 0 && !r.config.Coalesce {
+		for _, t := range r.targets {
+			t.send(packet)
+		}
+		return
+	}
+
+	r.lines = r.lines[:0]
+	for line, rest := parser.NextLine(packet); line != nil; line, rest = parser.NextLine(rest) {
+		if !r.match(line) {
+			continue
+		}
+		if r.config.Coalesce {
+			for _, t := range r.targets {
+				t.add(line)
+			}
+			continue
+		}
+		r.lines = append(r.lines, line...)
+		r.lines = append(r.lines, '\n')
+	}
+	if len(r.lines) > 0 {
+		for _, t := range r.targets {
+			t.send(r.lines)
+		}
+	}
+}
+
+// match tells whether the name of line starts with one of the prefixes.
+func (r *Repeater) match(line []byte) bool {
+	if len(r.config.Prefixes) == 0 {
+		return true
+	}
+	name := parser.Name(line)
+	for _, p := range r.config.Prefixes {
+		if len(name) >= len(p) && string(name[:len(p)]) == p {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *Repeater) flush() {
+	for _, t := range r.targets {
+		t.flush()
+	}
+}
+
+func (r *Repeater) Start() {
+	r.logger.Println("Statsd Repeater starting")
+	go r.run(r.exit)
+}
+
+func (r *Repeater) Stop() {
+	r.logger.Println("Statsd Repeater stoping")
+	r.exit <- true
+	// run 发送完队列中剩下的数据包, 关闭连接后关闭 exit
+	<-r.exit
+}
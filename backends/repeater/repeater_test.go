@@ -0,0 +1,107 @@
+package repeater
+
+import (
+	"bufio"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/coder-van/v-util/log"
+)
+
+// An empty udp datagram used to crash the tcp target with index out of range.
+func TestEmptyPacket(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	lines := make(chan string, 1)
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		line, _ := bufio.NewReader(c).ReadString('\n')
+		lines <- line
+	}()
+
+	r := NewRepeater(&Config{
+		Targets:   []string{l.Addr().String()},
+		Protocol:  ProtocolTCP,
+		MTU:       DefaultMTU,
+		QueueSize: 16,
+	})
+	r.Repeat(nil)
+	r.Repeat([]byte{})
+	if len(r.in) != 0 {
+		t.Fatalf("empty packets queued: %d", len(r.in))
+	}
+
+	tg := newTarget(l.Addr().String(), ProtocolTCP, DefaultMTU, log.GetLogger("test", log.RotateModeMonth))
+	defer tg.close()
+	tg.send([]byte{})
+	r.targets = []*target{tg}
+	r.handle([]byte{})
+	tg.send([]byte("a:1|c"))
+
+	select {
+	case line := <-lines:
+		if line != "a:1|c\n" {
+			t.Fatalf("got %q", line)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("timeout waiting for the forwarded line")
+	}
+}
+
+func TestRepeaterStop(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	lines := make(chan string, 2)
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		r := bufio.NewReader(c)
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				close(lines)
+				return
+			}
+			lines <- line
+		}
+	}()
+
+	conf := &Config{Targets: []string{l.Addr().String()}, Protocol: ProtocolTCP, Coalesce: true, QueueSize: 1024}
+	conf.Check()
+	r := NewRepeater(conf)
+	r.Start()
+	r.Repeat([]byte("a:1|c"))
+	r.Stop()
+
+	// Stop 返回时 run 已经退出
+	select {
+	case <-r.exit:
+	default:
+		t.Fatal("Stop returned before run exited")
+	}
+	if line := <-lines; line != "a:1|c\n" {
+		t.Fatalf("got %q", line)
+	}
+	select {
+	case _, ok := <-lines:
+		if ok {
+			t.Fatal("got an extra line")
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("the target connection is still open after Stop")
+	}
+}
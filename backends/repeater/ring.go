@@ -0,0 +1,58 @@
+package repeater
+
+import (
+	"sort"
+	"strconv"
+
+	"github.com/coder-van/v-stats/hashing"
+)
+
+/*
+ 一致性哈希环, 每个节点在环上有 ringReplicas 个虚拟节点
+ 节点故障时不重建环, 而是从原来的位置顺时针找下一个健康的节点,
+ 这样只有故障节点上的 metric 会被迁移, 节点恢复后它们又回到原来的节点
+*/
+const ringReplicas = 128
+
+type ring struct {
+	hashes []uint64
+	// owners[i] 是 hashes[i] 所属节点的下标
+	owners []int
+}
+
+func newRing(nodes []string) *ring {
+	r := &ring{}
+	type vnode struct {
+		hash  uint64
+		owner int
+	}
+	vs := make([]vnode, 0, len(nodes)*ringReplicas)
+	for i, n := range nodes {
+		for j := 0; j < ringReplicas; j++ {
+			vs = append(vs, vnode{hashing.String(n + "#" + strconv.Itoa(j)), i})
+		}
+	}
+	sort.Slice(vs, func(i, j int) bool { return vs[i].hash < vs[j].hash })
+	for _, v := range vs {
+		r.hashes = append(r.hashes, v.hash)
+		r.owners = append(r.owners, v.owner)
+	}
+	return r
+}
+
+// get returns the first node at or after the position of key for which up
+// returns true, or -1 when no node is up.
+func (r *ring) get(key []byte, up func(int) bool) int {
+	if len(r.hashes) == 0 {
+		return -1
+	}
+	h := hashing.Bytes(key)
+	i := sort.Search(len(r.hashes), func(i int) bool { return r.hashes[i] >= h })
+	for n := 0; n < len(r.hashes); n++ {
+		owner := r.owners[(i+n)%len(r.hashes)]
+		if up(owner) {
+			return owner
+		}
+	}
+	return -1
+}
@@ -0,0 +1,127 @@
+package repeater
+
+import (
+	"bytes"
+	"net"
+	"time"
+
+	"github.com/coder-van/v-util/log"
+)
+
+const (
+	writeTimeout = 5 * time.Second
+	// 重连等待时间从 minBackoff 开始每次失败翻倍, 最长 maxBackoff, 等待期间的数据包直接丢弃
+	minBackoff = time.Second
+	maxBackoff = time.Minute
+)
+
+// target is one downstream statsd server.
+type target struct {
+	addr    string
+	network string
+	mtu     int
+	logger  *log.Vlogger
+
+	c       net.Conn
+	backoff time.Duration
+	retryAt time.Time
+	// pending 是合并中的数据包
+	pending []byte
+	// dropped 是连接失败或等待重连时丢弃的行数, 由使用者取走计入统计
+	dropped int
+}
+
+func newTarget(addr, network string, mtu int, logger *log.Vlogger) *target {
+	return &target{
+		addr:    addr,
+		network: network,
+		mtu:     mtu,
+		logger:  logger,
+		pending: make([]byte, 0, mtu),
+	}
+}
+
+// ready tells whether the target is connected or may be dialed.
+func (t *target) ready() bool {
+	return t.c != nil || !time.Now().Before(t.retryAt)
+}
+
+// add appends a line to the pending packet, sending it first when the line
+// would not fit into mtu.
+func (t *target) add(line []byte) {
+	if len(t.pending) > 0 && len(t.pending)+len(line)+1 > t.mtu {
+		t.flush()
+	}
+	t.pending = append(t.pending, line...)
+	t.pending = append(t.pending, '\n')
+}
+
+func (t *target) flush() {
+	if len(t.pending) == 0 {
+		return
+	}
+	t.send(t.pending)
+	t.pending = t.pending[:0]
+}
+
+func (t *target) send(b []byte) {
+	if len(b) == 0 {
+		return
+	}
+	if t.c == nil {
+		if time.Now().Before(t.retryAt) {
+			t.drop(b)
+			return
+		}
+		c, err := net.DialTimeout(t.network, t.addr, writeTimeout)
+		if err != nil {
+			t.fail(err)
+			t.drop(b)
+			return
+		}
+		t.c = c
+		t.backoff = 0
+	}
+	if t.network == ProtocolTCP && b[len(b)-1] != '\n' {
+		// tcp 按行分割, 没有换行的数据包会和下一个数据包连在一起
+		b = append(b[:len(b):len(b)], '\n')
+	}
+	t.c.SetWriteDeadline(time.Now().Add(writeTimeout))
+	if _, err := t.c.Write(b); err != nil {
+		t.fail(err)
+		t.drop(b)
+	}
+}
+
+// drop counts the lines of a packet that could not be sent.
+func (t *target) drop(b []byte) {
+	t.dropped += bytes.Count(b, []byte{'\n'})
+	if b[len(b)-1] != '\n' {
+		t.dropped++
+	}
+}
+
+// takeDropped returns the lines dropped since the last call.
+func (t *target) takeDropped() int {
+	n := t.dropped
+	t.dropped = 0
+	return n
+}
+
+func (t *target) fail(err error) {
+	t.close()
+	if t.backoff == 0 {
+		t.backoff = minBackoff
+	} else if t.backoff *= 2; t.backoff > maxBackoff {
+		t.backoff = maxBackoff
+	}
+	t.retryAt = time.Now().Add(t.backoff)
+	t.logger.Printf("ERROR: repeater %s %s, retry in %s", t.addr, err, t.backoff)
+}
+
+func (t *target) close() {
+	if t.c != nil {
+		t.c.Close()
+		t.c = nil
+	}
+}
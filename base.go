@@ -78,7 +78,7 @@ func (c *BaseStat) gaugeOption(key string, i interface{}, op int) {
 		case GaugeOptionInc:
 			m.(metrics.Gauge).Inc(value)
 		case GaugeOptionDec:
-			m.(metrics.Gauge).Inc(value)
+			m.(metrics.Gauge).Inc(-value)
 		case GaugeOptionUpdate:
 			m.(metrics.Gauge).Update(value)
 		default:
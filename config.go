@@ -4,30 +4,118 @@ import (
 	"fmt"
 	"github.com/BurntSushi/toml"
 	"os"
+	"runtime"
 	"strings"
+
+	ci "github.com/coder-van/v-stats/backends/cloudinsight"
+	"github.com/coder-van/v-stats/backends/console"
+	gb "github.com/coder-van/v-stats/backends/graghite"
+	"github.com/coder-van/v-stats/backends/influxdb"
+	"github.com/coder-van/v-stats/backends/opentsdb"
+	"github.com/coder-van/v-stats/backends/otlp"
+	"github.com/coder-van/v-stats/backends/prometheus"
+	"github.com/coder-van/v-stats/backends/repeater"
+	"github.com/coder-van/v-stats/receivers"
 )
 
 type Config struct {
 	IsLocal                bool   `toml:"is_local"`
+	Mode                   string `toml:"mode"`
 	ReceiverAddr           string `toml:"receiver_addr"`
 	ReceiverQueueSize      int    `toml:"receiver_queue_size"`
+	TcpReceiverAddr        string `toml:"tcp_receiver_addr"`
+	TcpMaxLineBytes        int    `toml:"tcp_max_line_bytes"`
+	TcpIdleTimeoutSeconds  int    `toml:"tcp_idle_timeout_seconds"`
+	UnixSocketPath         string `toml:"unix_socket_path"`
+	UnixgramSocketPath     string `toml:"unixgram_socket_path"`
+	UnixSocketMode         string `toml:"unix_socket_mode"`
+	// UnixPeerCred tags metrics received on unix sockets with the sender's
+	// pid, uid and cgroup, linux only
+	UnixPeerCred           bool   `toml:"unix_peer_cred"`
+	HttpReceiverAddr       string `toml:"http_receiver_addr"`
+	HttpReceiverPath       string `toml:"http_receiver_path"`
+	HttpMaxBodyBytes       int64  `toml:"http_max_body_bytes"`
+	// HttpAllowOrigin enables CORS so that browsers may push, e.g. "*"
+	HttpAllowOrigin        string `toml:"http_allow_origin"`
+	// GraphiteReceiverAddr accepts graphite plaintext over tcp and udp,
+	// GraphitePickleAddr the pickle protocol over tcp
+	GraphiteReceiverAddr   string `toml:"graphite_receiver_addr"`
+	GraphitePickleAddr     string `toml:"graphite_pickle_addr"`
+	// GraphiteReceiverMode is gauge to aggregate received points as gauges
+	// or direct to pass them to backends as they are
+	GraphiteReceiverMode   string `toml:"graphite_receiver_mode"`
 	GraphiteAddr           string `toml:"graphite_addr"`
+	GraphiteProtocol       string `toml:"graphite_protocol"`
+	GraphiteTimeoutSeconds int    `toml:"graphite_timeout_seconds"`
+	GraphiteRoundRobin     bool   `toml:"graphite_round_robin"`
+	GraphiteTagMode        string `toml:"graphite_tag_mode"`
+	GraphiteTagOrder       []string `toml:"graphite_tag_order"`
 	DataPointQueueSize     int    `toml:"datapoint_queue_size"`
 	BackendFlushSeconds    int    `toml:"backend_flush_seconds"`
 	BackendFlushSize       int    `toml:"backend_flush_size"`
 	FlushSeconds 		   int    `toml:"flush_seconds"`
+	FlushAlign             bool   `toml:"flush_align"`
+	FlushJitterMillis      int    `toml:"flush_jitter_ms"`
+	AggregatorWorkers      int    `toml:"aggregator_workers"`
+	SetMode                string `toml:"set_mode"`
+	SetHLLPrecision        int    `toml:"set_hll_precision"`
+	// DeleteIdleCounters stops emitting a counter after a flush interval
+	// without data, by default it keeps emitting count=0 and rate=0
+	DeleteIdleCounters     bool   `toml:"delete_idle_counters"`
+	Backends               BackendsConfig `toml:"backends"`
+	// Proxy is required in proxy mode
+	Proxy *repeater.ProxyConfig `toml:"proxy"`
+}
+
+const (
+	// ModeAggregate aggregates received metrics and flushes them to backends
+	ModeAggregate = "aggregate"
+	// ModeProxy only forwards received lines to the nodes in [proxy]
+	ModeProxy = "proxy"
+)
+
+// BackendsConfig holds the optional [backends.*] sections, a backend is
+// registered when its section is present.
+type BackendsConfig struct {
+	CloudInsight          *ci.CiConfig                  `toml:"cloudinsight"`
+	InfluxDB              *influxdb.Config              `toml:"influxdb"`
+	Prometheus            *prometheus.Config            `toml:"prometheus"`
+	PrometheusRemoteWrite *prometheus.RemoteWriteConfig `toml:"prometheus_remote_write"`
+	OTLP                  *otlp.Config                  `toml:"otlp"`
+	OpenTSDB              *opentsdb.Config              `toml:"opentsdb"`
+	// Console prints flushed points for debugging
+	Console *console.Config `toml:"console"`
+	// Repeater forwards raw packets before aggregation
+	Repeater *repeater.Config `toml:"repeater"`
 }
 
 func NewConfig() *Config {
 	return &Config{
 		IsLocal:                true,
+		Mode:                   ModeAggregate,
 		ReceiverAddr:           ":2016",
 		ReceiverQueueSize:      100000,
+		TcpMaxLineBytes:        64 * 1024,
+		TcpIdleTimeoutSeconds:  300,
+		UnixSocketMode:         "0666",
+		HttpReceiverPath:       receivers.DefaultHttpPath,
+		HttpMaxBodyBytes:       receivers.DefaultHttpMaxBodyBytes,
+		GraphiteReceiverMode:   receivers.GraphiteModeGauge,
 		GraphiteAddr:           ":2017",
+		GraphiteProtocol:       gb.ProtocolPlaintext,
+		GraphiteTimeoutSeconds: 10,
+		GraphiteRoundRobin:     false,
+		GraphiteTagMode:        gb.TagModeTagged,
 		DataPointQueueSize:     100000,
 		BackendFlushSeconds:    5,
 		BackendFlushSize:       64,
 		FlushSeconds:           5,
+		FlushAlign:             true,
+		FlushJitterMillis:      0,
+		AggregatorWorkers:      runtime.NumCPU(),
+		SetMode:                SetModeExact,
+		SetHLLPrecision:        14,
+		DeleteIdleCounters:     false,
 	}
 }
 
@@ -35,13 +123,78 @@ func (c *Config) Check() {
 	if !c.IsLocal && c.ReceiverAddr == ""  {
 		panic("config is_local is false but receiver_addr empty")
 	}
+	switch c.Mode {
+	case ModeAggregate:
+	case ModeProxy:
+		if c.IsLocal {
+			panic("config mode is proxy but is_local is true")
+		}
+		if c.Proxy == nil {
+			panic("config mode is proxy but [proxy] is missing")
+		}
+		c.Proxy.Check()
+	default:
+		fmt.Println("warn config mode must be aggregate or proxy, set to aggregate")
+		c.Mode = ModeAggregate
+	}
 	if c.ReceiverQueueSize < 1024 {
 		fmt.Println("warn config receiver_queue_size can't smaller than 1024, set to 1M")
 		c.ReceiverQueueSize = 1024*1024
 	}
+	if c.TcpReceiverAddr != "" && strings.Index(c.TcpReceiverAddr, ":") < 0 {
+		panic("config tcp_receiver_addr is invail")
+	}
+	if c.TcpMaxLineBytes < 1024 {
+		fmt.Println("warn config tcp_max_line_bytes can't smaller than 1024, set to 64K")
+		c.TcpMaxLineBytes = 64 * 1024
+	}
+	if c.TcpIdleTimeoutSeconds < 1 {
+		fmt.Println("warn config tcp_idle_timeout_seconds can't smaller than 1, set to 300")
+		c.TcpIdleTimeoutSeconds = 300
+	}
+	if c.UnixSocketPath != "" && c.UnixSocketPath == c.UnixgramSocketPath {
+		panic("config unix_socket_path and unixgram_socket_path can't be the same")
+	}
+	if _, err := receivers.ParseSocketMode(c.UnixSocketMode); err != nil {
+		fmt.Println("warn config unix_socket_mode is invail, set to 0666")
+		c.UnixSocketMode = "0666"
+	}
+	if c.HttpReceiverAddr != "" && strings.Index(c.HttpReceiverAddr, ":") < 0 {
+		panic("config http_receiver_addr is invail")
+	}
+	if !strings.HasPrefix(c.HttpReceiverPath, "/") {
+		fmt.Println("warn config http_receiver_path must start with /, set to /statsd")
+		c.HttpReceiverPath = receivers.DefaultHttpPath
+	}
+	if c.HttpMaxBodyBytes < 1024 {
+		fmt.Println("warn config http_max_body_bytes can't smaller than 1024, set to 1M")
+		c.HttpMaxBodyBytes = receivers.DefaultHttpMaxBodyBytes
+	}
+	if c.GraphiteReceiverAddr != "" && strings.Index(c.GraphiteReceiverAddr, ":") < 0 {
+		panic("config graphite_receiver_addr is invail")
+	}
+	if c.GraphitePickleAddr != "" && strings.Index(c.GraphitePickleAddr, ":") < 0 {
+		panic("config graphite_pickle_addr is invail")
+	}
+	if err := receivers.CheckGraphiteMode(c.GraphiteReceiverMode); err != nil {
+		panic("config graphite_receiver_mode is invail, " + err.Error())
+	}
+	if c.Mode == ModeProxy && c.GraphiteReceiverMode == receivers.GraphiteModeDirect {
+		panic("config graphite_receiver_mode can't be direct in proxy mode, there are no backends")
+	}
 	if c.GraphiteAddr == "" || strings.Index(c.GraphiteAddr, ":") < 0{
 		panic("config graphite_addr is invail")
 	}
+	if err := gb.CheckProtocol(c.GraphiteProtocol); err != nil {
+		panic("config graphite_protocol is invail, " + err.Error())
+	}
+	if err := gb.CheckTagMode(c.GraphiteTagMode); err != nil {
+		panic("config graphite_tag_mode is invail, " + err.Error())
+	}
+	if c.GraphiteTimeoutSeconds < 1 {
+		fmt.Println("warn config graphite_timeout_seconds can't smaller than 1, set to 10")
+		c.GraphiteTimeoutSeconds = 10
+	}
 	if c.DataPointQueueSize < 1024 {
 		fmt.Println("warn config datapoint_queue_size not in range, set to 1M")
 		c.DataPointQueueSize = 1024*1024
@@ -58,6 +211,46 @@ func (c *Config) Check() {
 		fmt.Println("warn config flush_seconds can't smaller than 1, set to 5")
 		c.FlushSeconds = 5
 	}
+	if c.FlushJitterMillis < 0 || c.FlushJitterMillis >= c.FlushSeconds*1000 {
+		fmt.Println("warn config flush_jitter_ms must be in [0, flush_seconds), set to 0")
+		c.FlushJitterMillis = 0
+	}
+	if c.AggregatorWorkers < 1 {
+		fmt.Println("warn config aggregator_workers can't smaller than 1, set to 1")
+		c.AggregatorWorkers = 1
+	}
+	if c.SetHLLPrecision < hllMinPrecision || c.SetHLLPrecision > hllMaxPrecision {
+		fmt.Println("warn config set_hll_precision not in range [4, 16], set to 14")
+		c.SetHLLPrecision = 14
+	}
+	if c.SetMode != SetModeExact && c.SetMode != SetModeHLL {
+		fmt.Println("warn config set_mode must be exact or hll, set to exact")
+		c.SetMode = SetModeExact
+	}
+	if c.Backends.CloudInsight != nil {
+		c.Backends.CloudInsight.Check()
+	}
+	if c.Backends.InfluxDB != nil {
+		c.Backends.InfluxDB.Check()
+	}
+	if c.Backends.Prometheus != nil {
+		c.Backends.Prometheus.Check()
+	}
+	if c.Backends.PrometheusRemoteWrite != nil {
+		c.Backends.PrometheusRemoteWrite.Check()
+	}
+	if c.Backends.OTLP != nil {
+		c.Backends.OTLP.Check()
+	}
+	if c.Backends.OpenTSDB != nil {
+		c.Backends.OpenTSDB.Check()
+	}
+	if c.Backends.Console != nil {
+		c.Backends.Console.Check()
+	}
+	if c.Backends.Repeater != nil {
+		c.Backends.Repeater.Check()
+	}
 }
 
 func (c *Config) LoadConfig(confPath string) (*Config, error) {
@@ -0,0 +1,40 @@
+package hashing
+
+/*
+ shard 的分配, set 的 HyperLogLog 和 proxy 的一致性哈希环共用的哈希函数
+ FNV-1a 之后再做一次 murmur3 的 finalizer, fnv 本身对短的 key 在高位上分布不够均匀,
+ 而 HyperLogLog 用高位选择寄存器, 名字相近的 metric 也需要分散到环上不同的位置
+*/
+const (
+	offset64 = 14695981039346656037
+	prime64  = 1099511628211
+)
+
+// Bytes hashes b, it does not allocate.
+func Bytes(b []byte) uint64 {
+	x := uint64(offset64)
+	for _, c := range b {
+		x ^= uint64(c)
+		x *= prime64
+	}
+	return mix(x)
+}
+
+// String hashes s, String(s) == Bytes([]byte(s)).
+func String(s string) uint64 {
+	x := uint64(offset64)
+	for i := 0; i < len(s); i++ {
+		x ^= uint64(s[i])
+		x *= prime64
+	}
+	return mix(x)
+}
+
+func mix(x uint64) uint64 {
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	return x
+}
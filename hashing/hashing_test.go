@@ -0,0 +1,23 @@
+package hashing
+
+import "testing"
+
+func TestStringMatchesBytes(t *testing.T) {
+	for _, s := range []string{"", "a", "api.requests", "api.requests#127", "\xff\x00"} {
+		if String(s) != Bytes([]byte(s)) {
+			t.Errorf("String(%q) != Bytes(%q)", s, s)
+		}
+	}
+}
+
+func TestHighBitsSpread(t *testing.T) {
+	// 相近的短 key 的最高 4 位应该覆盖所有取值, HyperLogLog 用它们选择寄存器
+	seen := make(map[uint64]bool)
+	for _, s := range []string{"a1", "a2", "a3", "a4", "a5", "a6", "a7", "a8", "a9", "b1", "b2", "b3", "b4", "b5", "b6", "b7",
+		"b8", "b9", "c1", "c2", "c3", "c4", "c5", "c6", "c7", "c8", "c9", "d1", "d2", "d3", "d4", "d5", "d6", "d7", "d8", "d9"} {
+		seen[String(s)>>60] = true
+	}
+	if len(seen) < 12 {
+		t.Errorf("36 keys hit only %d of 16 top nibbles", len(seen))
+	}
+}
@@ -0,0 +1,74 @@
+package statsd
+
+import (
+	"math"
+	"math/bits"
+
+	"github.com/coder-van/v-stats/hashing"
+)
+
+const (
+	hllMinPrecision = 4
+	hllMaxPrecision = 16
+)
+
+func newHyperLogLog(precision uint8) *hyperLogLog {
+	return &hyperLogLog{
+		precision: precision,
+		registers: make([]uint8, 1<<precision),
+	}
+}
+
+// hyperLogLog is a cardinality estimator with a standard error of about
+// 1.04/sqrt(2^precision).
+type hyperLogLog struct {
+	precision uint8
+	registers []uint8
+}
+
+func (h *hyperLogLog) Add(value []byte) {
+	x := hashing.Bytes(value)
+	idx := x >> (64 - h.precision)
+	// 剩余位中第一个 1 出现的位置
+	rank := uint8(bits.LeadingZeros64(x<<h.precision|1<<(h.precision-1))) + 1
+	if rank > h.registers[idx] {
+		h.registers[idx] = rank
+	}
+}
+
+func (h *hyperLogLog) Count() int64 {
+	m := float64(len(h.registers))
+	sum := 0.0
+	zeros := 0
+	for _, r := range h.registers {
+		sum += 1 / float64(uint64(1)<<r)
+		if r == 0 {
+			zeros++
+		}
+	}
+	estimate := hllAlpha(m) * m * m / sum
+	// 小基数时使用 linear counting 修正
+	if estimate <= 2.5*m && zeros > 0 {
+		estimate = m * math.Log(m/float64(zeros))
+	}
+	return int64(estimate + 0.5)
+}
+
+func (h *hyperLogLog) Clear() {
+	for i := range h.registers {
+		h.registers[i] = 0
+	}
+}
+
+func hllAlpha(m float64) float64 {
+	switch m {
+	case 16:
+		return 0.673
+	case 32:
+		return 0.697
+	case 64:
+		return 0.709
+	default:
+		return 0.7213 / (1 + 1.079/m)
+	}
+}
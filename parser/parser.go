@@ -0,0 +1,270 @@
+package parser
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strconv"
+	"unsafe"
+)
+
+/*
+ statsd 数据行解析, 直接在收到的 []byte 上遍历, 解析结果引用原始数据, 正常路径上不做堆分配.
+ 一个 packet 由 \n 分隔的多行组成, 每行格式如下
+ <name>:<value>|<type>[|@<rate>][|#<tag1>=<v1>,<tag2>=<v2>][|T<timestamp>][:<value>|<type>...]
+ 同一个 name 后面可以跟多个以 : 分隔的值
+ type 之后的空字段(例如结尾多出的 |)和不认识的字段被忽略, 和原来的解析一样, 以兼容其他 statsd 扩展
+*/
+
+type MetricType uint8
+
+const (
+	Counter MetricType = iota + 1
+	Gauge
+	Timer
+	Histogram
+	Set
+)
+
+func (t MetricType) String() string {
+	switch t {
+	case Counter:
+		return "c"
+	case Gauge:
+		return "g"
+	case Timer:
+		return "ms"
+	case Histogram:
+		return "h"
+	case Set:
+		return "s"
+	default:
+		return "unknown"
+	}
+}
+
+// ParsedMetric is one value of a statsd line. Name, Raw and Tags point into
+// the parsed line and are only valid as long as it is.
+type ParsedMetric struct {
+	Name []byte
+	// Raw is the value as sent, set members are only available here
+	Raw   []byte
+	Value float64
+	// Signed is true when the value starts with '+' or '-', gauges treat such
+	// values as deltas
+	Signed bool
+	Type   MetricType
+	// Rate is the sample rate in (0, 1], 1 when not sent
+	Rate float64
+	// Tags is the body of the "#" section without the '#', use NextTag to
+	// walk it
+	Tags []byte
+	// Timestamp is the unix time sent in the "T" section, 0 when not sent
+	Timestamp int64
+}
+
+var (
+	ErrEmptyName    = errors.New("empty metric name")
+	ErrMissingValue = errors.New("missing value")
+	ErrMissingType  = errors.New("missing metric type")
+	ErrUnknownType  = errors.New("unknown metric type")
+	ErrInvalidValue = errors.New("invalid value")
+	ErrSampleRate   = errors.New("invalid sample rate")
+	ErrTimestamp    = errors.New("invalid timestamp")
+	ErrEmptySection = errors.New("empty section")
+	ErrMissingColon = errors.New("missing ':' after metric name")
+)
+
+// Error reports where a line failed to parse.
+type Error struct {
+	Err    error
+	Offset int
+	Line   string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("statsd parse error: %s at offset %d of %q", e.Err, e.Offset, e.Line)
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+func newError(err error, line []byte, offset int) *Error {
+	return &Error{Err: err, Offset: offset, Line: string(line)}
+}
+
+// NextLine returns the first non empty line of packet and what follows it.
+// line is nil when packet holds no more lines.
+func NextLine(packet []byte) (line, rest []byte) {
+	for len(packet) > 0 {
+		i := bytes.IndexByte(packet, '\n')
+		if i < 0 {
+			line, packet = packet, nil
+		} else {
+			line, packet = packet[:i], packet[i+1:]
+		}
+		line = bytes.TrimSpace(line)
+		if len(line) > 0 {
+			return line, packet
+		}
+	}
+	return nil, nil
+}
+
+// Name returns the metric name of line without parsing the rest of it.
+func Name(line []byte) []byte {
+	if i := bytes.IndexByte(line, ':'); i >= 0 {
+		return line[:i]
+	}
+	return line
+}
+
+// ParseLine parses every value of line and appends them to ms. Reusing ms
+// between calls avoids allocating. On error ms is returned as passed in.
+func ParseLine(line []byte, ms []ParsedMetric) ([]ParsedMetric, error) {
+	i := bytes.IndexByte(line, ':')
+	if i < 0 {
+		return ms, newError(ErrMissingColon, line, len(line))
+	}
+	if i == 0 {
+		return ms, newError(ErrEmptyName, line, 0)
+	}
+	name := line[:i]
+
+	n := len(ms)
+	offset := i + 1
+	for offset <= len(line) {
+		end := bytes.IndexByte(line[offset:], ':')
+		if end < 0 {
+			end = len(line)
+		} else {
+			end += offset
+		}
+		m := ParsedMetric{Name: name}
+		if err := parseSection(line, offset, end, &m); err != nil {
+			return ms[:n], err
+		}
+		ms = append(ms, m)
+		offset = end + 1
+	}
+	return ms, nil
+}
+
+// parseSection parses line[start:end] which is one "<value>|<type>|..." section.
+func parseSection(line []byte, start, end int, m *ParsedMetric) error {
+	if start == end {
+		return newError(ErrEmptySection, line, start)
+	}
+	m.Rate = 1
+
+	field, pos, next := nextField(line, start, end)
+	if len(field) == 0 {
+		return newError(ErrMissingValue, line, pos)
+	}
+	m.Raw = field
+	valuePos := pos
+
+	if next > end {
+		return newError(ErrMissingType, line, end)
+	}
+	field, pos, next = nextField(line, next, end)
+	switch string(field) {
+	case "c":
+		m.Type = Counter
+	case "g":
+		m.Type = Gauge
+	case "ms":
+		m.Type = Timer
+	case "h":
+		m.Type = Histogram
+	case "s":
+		m.Type = Set
+	case "":
+		return newError(ErrMissingType, line, pos)
+	default:
+		return newError(ErrUnknownType, line, pos)
+	}
+
+	if m.Type != Set {
+		if !isDecimal(m.Raw) {
+			return newError(ErrInvalidValue, line, valuePos)
+		}
+		v, err := strconv.ParseFloat(bytesToString(m.Raw), 64)
+		if err != nil {
+			return newError(ErrInvalidValue, line, valuePos)
+		}
+		m.Value = v
+		m.Signed = m.Raw[0] == '+' || m.Raw[0] == '-'
+	}
+
+	for next <= end {
+		field, pos, next = nextField(line, next, end)
+		if len(field) == 0 {
+			continue
+		}
+		switch field[0] {
+		case '@':
+			rate, err := strconv.ParseFloat(bytesToString(field[1:]), 64)
+			if err != nil || !isDecimal(field[1:]) || !(rate > 0 && rate <= 1) {
+				return newError(ErrSampleRate, line, pos)
+			}
+			m.Rate = rate
+		case '#':
+			m.Tags = field[1:]
+		case 'T':
+			ts, err := strconv.ParseInt(bytesToString(field[1:]), 10, 64)
+			if err != nil || ts < 0 {
+				return newError(ErrTimestamp, line, pos)
+			}
+			m.Timestamp = ts
+		}
+	}
+	return nil
+}
+
+// isDecimal tells whether b only holds the characters of a decimal number.
+// strconv.ParseFloat also accepts NaN, Inf and hex floats, which no client
+// sends on purpose and which would poison counters and timers.
+func isDecimal(b []byte) bool {
+	for _, c := range b {
+		if (c < '0' || c > '9') && c != '.' && c != '-' && c != '+' && c != 'e' && c != 'E' {
+			return false
+		}
+	}
+	return true
+}
+
+// nextField returns the field of line[start:end] up to the next '|', its
+// offset and the offset after the '|'. next is end+1 for the last field.
+func nextField(line []byte, start, end int) (field []byte, pos, next int) {
+	i := bytes.IndexByte(line[start:end], '|')
+	if i < 0 {
+		return line[start:end], start, end + 1
+	}
+	return line[start : start+i], start, start + i + 1
+}
+
+// NextTag returns the first tag of a tag list and what follows it, empty
+// tags are skipped. tag is nil when tags holds no more tags.
+func NextTag(tags []byte) (tag, rest []byte) {
+	for len(tags) > 0 {
+		i := bytes.IndexByte(tags, ',')
+		if i < 0 {
+			tag, tags = tags, nil
+		} else {
+			tag, tags = tags[:i], tags[i+1:]
+		}
+		tag = bytes.TrimSpace(tag)
+		if len(tag) > 0 {
+			return tag, tags
+		}
+	}
+	return nil, nil
+}
+
+// bytesToString views b as a string without copying, the result must not
+// outlive b or be kept by the callee.
+func bytesToString(b []byte) string {
+	return *(*string)(unsafe.Pointer(&b))
+}
@@ -0,0 +1,206 @@
+package parser
+
+import (
+	"errors"
+	"math"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestParseLine(t *testing.T) {
+	tests := []struct {
+		line string
+		want []ParsedMetric
+		err  error
+	}{
+		{line: "a:1|c", want: []ParsedMetric{{Name: []byte("a"), Raw: []byte("1"), Value: 1, Type: Counter, Rate: 1}}},
+		{line: "a:-2.5|g", want: []ParsedMetric{{Name: []byte("a"), Raw: []byte("-2.5"), Value: -2.5, Signed: true, Type: Gauge, Rate: 1}}},
+		{line: "a:3|ms|@0.1|#x=y,z|T1700000000", want: []ParsedMetric{{Name: []byte("a"), Raw: []byte("3"), Value: 3, Type: Timer, Rate: 0.1, Tags: []byte("x=y,z"), Timestamp: 1700000000}}},
+		{line: "a:u1|s:2|h", want: []ParsedMetric{
+			{Name: []byte("a"), Raw: []byte("u1"), Type: Set, Rate: 1},
+			{Name: []byte("a"), Raw: []byte("2"), Value: 2, Type: Histogram, Rate: 1},
+		}},
+		// 空字段和不认识的字段被忽略
+		{line: "a:1|c|", want: []ParsedMetric{{Name: []byte("a"), Raw: []byte("1"), Value: 1, Type: Counter, Rate: 1}}},
+		{line: "a:1|c|c:abc", err: ErrMissingType},
+		{line: "a:1|c|c:abc|c", err: ErrInvalidValue},
+		{line: "a:1|c|x1", want: []ParsedMetric{{Name: []byte("a"), Raw: []byte("1"), Value: 1, Type: Counter, Rate: 1}}},
+		{line: "a", err: ErrMissingColon},
+		{line: ":1|c", err: ErrEmptyName},
+		{line: "a:", err: ErrEmptySection},
+		{line: "a:1", err: ErrMissingType},
+		{line: "a:1|", err: ErrMissingType},
+		{line: "a:|c", err: ErrMissingValue},
+		{line: "a:1|x", err: ErrUnknownType},
+		{line: "a:x|c", err: ErrInvalidValue},
+		{line: "a:NaN|c", err: ErrInvalidValue},
+		{line: "a:Inf|g", err: ErrInvalidValue},
+		{line: "a:0x10|c", err: ErrInvalidValue},
+		{line: "a:1e999|c", err: ErrInvalidValue},
+		{line: "a:1|c|@0", err: ErrSampleRate},
+		{line: "a:1|c|@1.5", err: ErrSampleRate},
+		{line: "a:1|c|@NaN", err: ErrSampleRate},
+		{line: "a:1|c|T-1", err: ErrTimestamp},
+		{line: "a:1|c::2|c", err: ErrEmptySection},
+	}
+	for _, tt := range tests {
+		got, err := ParseLine([]byte(tt.line), nil)
+		if tt.err != nil {
+			if !errors.Is(err, tt.err) {
+				t.Errorf("%q: got error %v, want %v", tt.line, err, tt.err)
+			}
+			if len(got) != 0 {
+				t.Errorf("%q: got %d metrics on error", tt.line, len(got))
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: unexpected error %v", tt.line, err)
+			continue
+		}
+		if len(got) != len(tt.want) {
+			t.Errorf("%q: got %d metrics, want %d", tt.line, len(got), len(tt.want))
+			continue
+		}
+		for i := range got {
+			if !equalMetric(got[i], tt.want[i]) {
+				t.Errorf("%q: metric %d is %+v, want %+v", tt.line, i, got[i], tt.want[i])
+			}
+		}
+	}
+}
+
+func TestNextLine(t *testing.T) {
+	var lines []string
+	packet := []byte("a:1|c\n\n  \r\nb:2|g \nc:3|ms")
+	for line, rest := NextLine(packet); line != nil; line, rest = NextLine(rest) {
+		lines = append(lines, string(line))
+	}
+	if strings.Join(lines, ",") != "a:1|c,b:2|g,c:3|ms" {
+		t.Fatalf("got %q", lines)
+	}
+}
+
+func equalMetric(a, b ParsedMetric) bool {
+	return string(a.Name) == string(b.Name) && string(a.Raw) == string(b.Raw) &&
+		a.Value == b.Value && a.Signed == b.Signed && a.Type == b.Type && a.Rate == b.Rate &&
+		string(a.Tags) == string(b.Tags) && a.Timestamp == b.Timestamp
+}
+
+// refParse is a straightforward strings based implementation of the line
+// format, ParseLine must agree with it.
+func refParse(line string) ([]ParsedMetric, bool) {
+	i := strings.Index(line, ":")
+	if i <= 0 {
+		return nil, false
+	}
+	var ms []ParsedMetric
+	for _, sec := range strings.Split(line[i+1:], ":") {
+		fields := strings.Split(sec, "|")
+		if fields[0] == "" || len(fields) < 2 {
+			return nil, false
+		}
+		m := ParsedMetric{Name: []byte(line[:i]), Raw: []byte(fields[0]), Rate: 1}
+		switch fields[1] {
+		case "c":
+			m.Type = Counter
+		case "g":
+			m.Type = Gauge
+		case "ms":
+			m.Type = Timer
+		case "h":
+			m.Type = Histogram
+		case "s":
+			m.Type = Set
+		default:
+			return nil, false
+		}
+		if m.Type != Set {
+			if strings.Trim(fields[0], "0123456789.+-eE") != "" {
+				return nil, false
+			}
+			v, err := strconv.ParseFloat(fields[0], 64)
+			if err != nil {
+				return nil, false
+			}
+			m.Value = v
+			m.Signed = fields[0][0] == '+' || fields[0][0] == '-'
+		}
+		for _, f := range fields[2:] {
+			if f == "" {
+				continue
+			}
+			switch f[0] {
+			case '@':
+				r, err := strconv.ParseFloat(f[1:], 64)
+				if err != nil || strings.Trim(f[1:], "0123456789.+-eE") != "" || !(r > 0 && r <= 1) {
+					return nil, false
+				}
+				m.Rate = r
+			case '#':
+				m.Tags = []byte(f[1:])
+			case 'T':
+				ts, err := strconv.ParseInt(f[1:], 10, 64)
+				if err != nil || ts < 0 {
+					return nil, false
+				}
+				m.Timestamp = ts
+			}
+		}
+		ms = append(ms, m)
+	}
+	return ms, true
+}
+
+func FuzzParseLine(f *testing.F) {
+	for _, s := range []string{
+		"a:1|c", "a:-2.5|g", "a:3|ms|@0.1|#x=y,z|T1700000000", "a:u1|s:2|h",
+		"a:1|c|", "a:1|c|x", "a:NaN|c", "a:0x10|c", "a:1|c|@0", "a:", ":1|c", "a:1|c::2|c",
+	} {
+		f.Add([]byte(s))
+	}
+	f.Fuzz(func(t *testing.T, line []byte) {
+		got, err := ParseLine(line, nil)
+		want, ok := refParse(string(line))
+		if (err == nil) != ok {
+			t.Fatalf("%q: ParseLine error %v, reference ok %v", line, err, ok)
+		}
+		if err != nil {
+			if _, isParseErr := err.(*Error); !isParseErr {
+				t.Fatalf("%q: error %T is not *Error", line, err)
+			}
+			return
+		}
+		if len(got) != len(want) {
+			t.Fatalf("%q: got %d metrics, reference %d", line, len(got), len(want))
+		}
+		for i := range got {
+			if !equalMetric(got[i], want[i]) {
+				t.Fatalf("%q: metric %d is %+v, reference %+v", line, i, got[i], want[i])
+			}
+			if math.IsNaN(got[i].Value) || math.IsInf(got[i].Value, 0) {
+				t.Fatalf("%q: non-finite value %v", line, got[i].Value)
+			}
+		}
+	})
+}
+
+func BenchmarkParseLine(b *testing.B) {
+	lines := [][]byte{
+		[]byte("api.requests:1|c"),
+		[]byte("api.latency:320|ms|@0.1|#host=web1,env=prod"),
+		[]byte("queue.depth:-3|g|#queue=mail"),
+		[]byte("users.online:u123|s"),
+		[]byte("api.size:512|h:1024|h:2048|h"),
+	}
+	ms := make([]ParsedMetric, 0, 8)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var err error
+		if ms, err = ParseLine(lines[i%len(lines)], ms[:0]); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,118 @@
+package point
+
+import (
+	"strconv"
+	"strings"
+)
+
+/*
+ aggregator 刷新时输出的数据点, backend 收到的是结构化的数据, 由各 backend 自己编码成需要的格式
+ 一个 series 的一次刷新会输出多个数据点, 例如 timer 输出 count, min, max, p99 等,
+ 它们的 Name 相同, Field 不同
+*/
+
+type Kind uint8
+
+const (
+	Counter Kind = iota + 1
+	Gauge
+	Timer
+	Histogram
+	Set
+)
+
+func (k Kind) String() string {
+	switch k {
+	case Counter:
+		return "counter"
+	case Gauge:
+		return "gauge"
+	case Timer:
+		return "timer"
+	case Histogram:
+		return "histogram"
+	case Set:
+		return "set"
+	default:
+		return "unknown"
+	}
+}
+
+type Point struct {
+	// Name is the series name without tags
+	Name string
+	// Field is the aggregated value of the series, e.g. "count", "value", "p99"
+	Field string
+	// Tags are sorted, deduplicated "name=value" pairs
+	Tags      []string
+	Value     float64
+	Timestamp int64
+	Kind      Kind
+}
+
+func New(name, field string, tags []string, value float64, ts int64, kind Kind) Point {
+	return Point{
+		Name:      name,
+		Field:     field,
+		Tags:      tags,
+		Value:     value,
+		Timestamp: ts,
+		Kind:      kind,
+	}
+}
+
+// Path returns the dotted name of the point, "<name>.<field>".
+func (p Point) Path() string {
+	if p.Field == "" {
+		return p.Name
+	}
+	return p.Name + "." + p.Field
+}
+
+// String returns the point as a Graphite plaintext line.
+func (p Point) String() string {
+	path := p.Path()
+	if len(p.Tags) > 0 {
+		path += ";" + strings.Join(p.Tags, ";")
+	}
+	return path + " " + FormatValue(p.Value) + " " + strconv.FormatInt(p.Timestamp, 10) + "\n"
+}
+
+// SplitTag splits a "name=value" tag, value is empty for bare tags.
+func SplitTag(tag string) (string, string) {
+	if i := strings.Index(tag, "="); i >= 0 {
+		return tag[:i], tag[i+1:]
+	}
+	return tag, ""
+}
+
+// FormatValue formats v in the shortest form that parses back to v.
+func FormatValue(v float64) string {
+	return strconv.FormatFloat(v, 'f', -1, 64)
+}
+
+// Quantile parses a percentile field, "p50" -> 0.5, "p5" -> 0.05,
+// "p99_9" -> 0.999. The digits are a percent, '_' is the decimal point.
+func Quantile(field string) (float64, bool) {
+	// 数字部分按整数解析再除以 10 的幂, 逐位累加 0.1 的幂会有误差, p75 会得到 0.7500000000000001
+	if len(field) < 2 || len(field) > 16 || field[0] != 'p' {
+		return 0, false
+	}
+	n, den := uint64(0), 100.0
+	dot := -1
+	for i, c := range field[1:] {
+		switch {
+		case c == '_' && dot < 0 && i > 0 && i < len(field)-2:
+			dot = i
+		case c >= '0' && c <= '9':
+			n = n*10 + uint64(c-'0')
+			if dot >= 0 {
+				den *= 10
+			}
+		default:
+			return 0, false
+		}
+	}
+	q := float64(n) / den
+	return q, q <= 1
+}
@@ -0,0 +1,35 @@
+package point
+
+import "testing"
+
+func TestQuantile(t *testing.T) {
+	tests := []struct {
+		field string
+		q     float64
+		ok    bool
+	}{
+		{"p50", 0.5, true},
+		{"p75", 0.75, true},
+		{"p90", 0.9, true},
+		{"p95", 0.95, true},
+		{"p99", 0.99, true},
+		{"p99_9", 0.999, true},
+		{"p5", 0.05, true},
+		{"p0_05", 0.0005, true},
+		{"p100", 1, true},
+		{"p0", 0, true},
+		{"p999", 0, false},
+		{"p", 0, false},
+		{"p_5", 0, false},
+		{"p5_", 0, false},
+		{"p9_9_9", 0, false},
+		{"count", 0, false},
+		{"p9x", 0, false},
+	}
+	for _, tt := range tests {
+		q, ok := Quantile(tt.field)
+		if ok != tt.ok || ok && q != tt.q {
+			t.Errorf("Quantile(%q) = %v, %v, want %v, %v", tt.field, q, ok, tt.q, tt.ok)
+		}
+	}
+}
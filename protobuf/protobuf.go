@@ -0,0 +1,123 @@
+package protobuf
+
+import (
+	"encoding/binary"
+	"math"
+)
+
+/*
+ 只实现了 backend 需要的 protobuf 编码, 没有解码, 消息结构由调用方按 .proto 的字段号手工写出
+ 嵌套消息先编码到单独的 Buffer, 再作为 length-delimited 字段写入父消息
+*/
+
+const (
+	wireVarint  = 0
+	wireFixed64 = 1
+	wireBytes   = 2
+)
+
+// Buffer accumulates the encoding of one message.
+type Buffer struct {
+	b []byte
+}
+
+func NewBuffer() *Buffer {
+	return &Buffer{}
+}
+
+// Bytes returns the encoded message.
+func (b *Buffer) Bytes() []byte {
+	return b.b
+}
+
+func (b *Buffer) Len() int {
+	return len(b.b)
+}
+
+func (b *Buffer) Reset() {
+	b.b = b.b[:0]
+}
+
+func (b *Buffer) varint(v uint64) {
+	for v >= 0x80 {
+		b.b = append(b.b, byte(v)|0x80)
+		v >>= 7
+	}
+	b.b = append(b.b, byte(v))
+}
+
+func (b *Buffer) fixed64(v uint64) {
+	var buf [8]byte
+	binary.LittleEndian.PutUint64(buf[:], v)
+	b.b = append(b.b, buf[:]...)
+}
+
+func (b *Buffer) tag(field int, wire int) {
+	b.varint(uint64(field)<<3 | uint64(wire))
+}
+
+// Uint64 writes a uint64 or enum field.
+func (b *Buffer) Uint64(field int, v uint64) {
+	b.tag(field, wireVarint)
+	b.varint(v)
+}
+
+// Int64 writes an int64 field, negative values take ten bytes.
+func (b *Buffer) Int64(field int, v int64) {
+	b.Uint64(field, uint64(v))
+}
+
+func (b *Buffer) Bool(field int, v bool) {
+	if v {
+		b.Uint64(field, 1)
+	} else {
+		b.Uint64(field, 0)
+	}
+}
+
+// Fixed64 writes a fixed64 or sfixed64 field.
+func (b *Buffer) Fixed64(field int, v uint64) {
+	b.tag(field, wireFixed64)
+	b.fixed64(v)
+}
+
+func (b *Buffer) Double(field int, v float64) {
+	b.Fixed64(field, math.Float64bits(v))
+}
+
+func (b *Buffer) String(field int, v string) {
+	b.tag(field, wireBytes)
+	b.varint(uint64(len(v)))
+	b.b = append(b.b, v...)
+}
+
+// Message writes m as an embedded message field.
+func (b *Buffer) Message(field int, m *Buffer) {
+	b.tag(field, wireBytes)
+	b.varint(uint64(len(m.b)))
+	b.b = append(b.b, m.b...)
+}
+
+// PackedDoubles writes a packed repeated double field.
+func (b *Buffer) PackedDoubles(field int, vs []float64) {
+	if len(vs) == 0 {
+		return
+	}
+	b.tag(field, wireBytes)
+	b.varint(uint64(8 * len(vs)))
+	for _, v := range vs {
+		b.fixed64(math.Float64bits(v))
+	}
+}
+
+// PackedFixed64s writes a packed repeated fixed64 field.
+func (b *Buffer) PackedFixed64s(field int, vs []uint64) {
+	if len(vs) == 0 {
+		return
+	}
+	b.tag(field, wireBytes)
+	b.varint(uint64(8 * len(vs)))
+	for _, v := range vs {
+		b.fixed64(v)
+	}
+}
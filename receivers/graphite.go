@@ -0,0 +1,442 @@
+package receivers
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/coder-van/v-stats/point"
+	"github.com/coder-van/v-util/log"
+)
+
+/*
+ Graphite 协议的 receiver, 让 v-stats 可以替换已有的 carbon relay
+ plaintext: Addr 上同时监听 tcp 和 udp, 每行 <path> <value> <timestamp>,
+ path 可以是 Graphite 1.1 的 tagged 格式 <name>;<tag1>=<v1>;<tag2>=<v2>,
+ timestamp 缺失或为 -1 时使用收到的时间
+ pickle: PickleAddr 上监听 tcp, 每帧是 4 字节大端长度加 pickle 数据 [(path, (timestamp, value)), ...]
+ 收到的数据按 Mode 处理:
+ gauge: 转换成带 T 时间戳的 statsd gauge 放入 PacketInChannel, 和其他 gauge 一样聚合,
+ 刷新时输出 <path>.value, 时间戳是最后一次收到的时间戳, 见 shard.go 的 stampedGauge
+ direct: 不聚合, 作为 Field 为空的 gauge 数据点直接交给 backends, path 和时间戳保持不变
+ self-metrics(前缀 statsd.graphite.): points, errors.parse, errors.pickle, 以及 stream.go 中的连接统计
+*/
+const (
+	GraphiteModeGauge  = "gauge"
+	GraphiteModeDirect = "direct"
+
+	// 和 carbon 的限制相同
+	maxPickleBytes = 1024 * 1024
+	// 一次交给 PacketInChannel 或 backends 的最多点数
+	graphiteBatchSize = 1000
+)
+
+// CheckGraphiteMode returns an error if mode is not gauge or direct.
+func CheckGraphiteMode(mode string) error {
+	switch mode {
+	case GraphiteModeGauge, GraphiteModeDirect:
+		return nil
+	}
+	return fmt.Errorf("graphite mode must be %s or %s", GraphiteModeGauge, GraphiteModeDirect)
+}
+
+// graphitePoint is one received point, tags are sorted "name=value" pairs.
+type graphitePoint struct {
+	name  string
+	tags  []string
+	value float64
+	ts    int64
+}
+
+// NewGraphiteReceiver creates a receiver that feeds ch in gauge mode and
+// points in direct mode. Addr or PickleAddr may be empty to disable them.
+func NewGraphiteReceiver(addr, pickleAddr, mode string, ch chan []byte, points chan point.Point) *GraphiteReceiver {
+	logger := log.GetLogger("statsd.GraphiteReceiver", log.RotateModeMonth)
+	return &GraphiteReceiver{
+		Addr:       addr,
+		PickleAddr: pickleAddr,
+		Mode:       mode,
+		plain:      newStream("graphite", ch, logger),
+		pickle:     newStream("graphite.pickle", ch, logger),
+		points:     points,
+		stat:       nopStat{},
+		exit:       make(chan bool),
+		logger:     logger,
+	}
+}
+
+type GraphiteReceiver struct {
+	Addr       string
+	PickleAddr string
+	Mode       string
+
+	plain  stream
+	pickle stream
+	udp    net.PacketConn
+	points chan point.Point
+	stat   Stat
+	exit   chan bool
+	logger *log.Vlogger
+}
+
+// SetStat sets where the self-metrics are recorded.
+func (g *GraphiteReceiver) SetStat(stat Stat) {
+	g.stat = stat
+	g.plain.SetStat(stat)
+	g.pickle.SetStat(stat)
+}
+
+func (g *GraphiteReceiver) Start() {
+	g.logger.Println("Statsd GraphiteReceiver starting")
+	if g.Addr != "" {
+		if l, err := net.Listen("tcp", g.Addr); err != nil {
+			g.logger.Printf("ERROR: graphite listening on tcp %s, %s", g.Addr, err)
+		} else {
+			g.plain.listener = l
+			g.logger.Println("Statsd GraphiteReceiver listening on tcp:", l.Addr())
+			go g.plain.serve(l, g.handlePlain)
+		}
+		if c, err := net.ListenPacket("udp", g.Addr); err != nil {
+			g.logger.Printf("ERROR: graphite listening on udp %s, %s", g.Addr, err)
+		} else {
+			g.udp = c
+			g.logger.Println("Statsd GraphiteReceiver listening on udp:", c.LocalAddr())
+			go g.listenUDP()
+		}
+	}
+	if g.PickleAddr != "" {
+		if l, err := net.Listen("tcp", g.PickleAddr); err != nil {
+			g.logger.Printf("ERROR: graphite pickle listening on %s, %s", g.PickleAddr, err)
+		} else {
+			g.pickle.listener = l
+			g.logger.Println("Statsd GraphiteReceiver pickle listening on:", l.Addr())
+			go g.pickle.serve(l, g.handlePickle)
+		}
+	}
+}
+
+func (g *GraphiteReceiver) Stop() {
+	g.logger.Println("Statsd GraphiteReceiver stoping")
+	// 先关闭 exit, 阻塞在 emit 中的连接才能退出
+	close(g.exit)
+	if g.udp != nil {
+		g.udp.Close()
+	}
+	g.plain.stop()
+	g.pickle.stop()
+	g.logger.Println("Statsd GraphiteReceiver stoped")
+}
+
+func (g *GraphiteReceiver) listenUDP() {
+	buf := make([]byte, UDPMaxPacketSize)
+	for {
+		n, _, err := g.udp.ReadFrom(buf)
+		if err != nil {
+			select {
+			case <-g.exit:
+				return
+			default:
+			}
+			g.stat.CounterInc("graphite.errors.read", 1)
+			g.logger.Error("ERROR: failed to read graphite udp msg because of ", err.Error())
+			continue
+		}
+		var ps []graphitePoint
+		now := time.Now().Unix()
+		packet := buf[:n]
+		for len(packet) > 0 {
+			var line []byte
+			if i := bytes.IndexByte(packet, '\n'); i >= 0 {
+				line, packet = packet[:i], packet[i+1:]
+			} else {
+				line, packet = packet, nil
+			}
+			ps = g.parseLine(ps, line, now)
+		}
+		if !g.emit(ps) {
+			return
+		}
+	}
+}
+
+// handlePlain reads plaintext lines from c, see stream.handle.
+func (g *GraphiteReceiver) handlePlain(c net.Conn) {
+	r := bufio.NewReaderSize(c, g.plain.MaxLineBytes)
+	var ps []graphitePoint
+	tooLong := false
+	for {
+		c.SetReadDeadline(time.Now().Add(g.plain.IdleTimeout))
+		line, err := r.ReadSlice('\n')
+		switch {
+		case err == bufio.ErrBufferFull:
+			if !tooLong {
+				g.stat.CounterInc("graphite.errors.line_too_long", 1)
+			}
+			tooLong = true
+			continue
+		case tooLong:
+			tooLong = false
+		default:
+			ps = g.parseLine(ps, line, time.Now().Unix())
+		}
+		if len(ps) > 0 && (r.Buffered() == 0 || len(ps) >= graphiteBatchSize || err != nil) {
+			if !g.emit(ps) {
+				return
+			}
+			ps = ps[:0]
+		}
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				g.stat.CounterInc("graphite.errors.idle_timeout", 1)
+			} else if !isClosed(err) {
+				g.stat.CounterInc("graphite.errors.read", 1)
+				g.logger.Printf("ERROR: failed to read graphite connection, %s", err)
+			}
+			return
+		}
+	}
+}
+
+// handlePickle reads length prefixed pickle frames from c.
+func (g *GraphiteReceiver) handlePickle(c net.Conn) {
+	r := bufio.NewReader(c)
+	var header [4]byte
+	var frame []byte
+	for {
+		c.SetReadDeadline(time.Now().Add(g.pickle.IdleTimeout))
+		if _, err := io.ReadFull(r, header[:]); err != nil {
+			g.onPickleReadError(err)
+			return
+		}
+		n := binary.BigEndian.Uint32(header[:])
+		if n > maxPickleBytes {
+			// 无法找到下一帧的开始, 只能断开连接
+			g.stat.CounterInc("graphite.errors.pickle", 1)
+			g.logger.Printf("ERROR: graphite pickle frame of %d bytes from %s is too large", n, c.RemoteAddr())
+			return
+		}
+		if cap(frame) < int(n) {
+			frame = make([]byte, n)
+		}
+		frame = frame[:n]
+		if _, err := io.ReadFull(r, frame); err != nil {
+			g.onPickleReadError(err)
+			return
+		}
+		ps, err := parsePickle(frame, time.Now().Unix())
+		if err != nil {
+			g.stat.CounterInc("graphite.errors.pickle", 1)
+			g.logger.Printf("ERROR: invalid graphite pickle frame, %s", err)
+		}
+		// 一帧中错误之前的数据点仍然有效
+		for len(ps) > 0 {
+			batch := ps
+			if len(batch) > graphiteBatchSize {
+				batch = batch[:graphiteBatchSize]
+			}
+			if !g.emit(batch) {
+				return
+			}
+			ps = ps[len(batch):]
+		}
+	}
+}
+
+func (g *GraphiteReceiver) onPickleReadError(err error) {
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		g.stat.CounterInc("graphite.pickle.errors.idle_timeout", 1)
+	} else if err != io.ErrUnexpectedEOF && !isClosed(err) {
+		g.stat.CounterInc("graphite.pickle.errors.read", 1)
+		g.logger.Printf("ERROR: failed to read graphite pickle connection, %s", err)
+	}
+}
+
+// parseLine appends the point of a plaintext line to ps, empty lines are
+// skipped and invalid ones are counted and logged.
+func (g *GraphiteReceiver) parseLine(ps []graphitePoint, line []byte, now int64) []graphitePoint {
+	line = bytes.TrimSpace(line)
+	if len(line) == 0 {
+		return ps
+	}
+	p, err := parsePlaintext(string(line), now)
+	if err != nil {
+		g.stat.CounterInc("graphite.errors.parse", 1)
+		g.logger.Printf("Error parsing graphite line, %s", err)
+		return ps
+	}
+	return append(ps, p)
+}
+
+// emit hands ps over according to Mode, it returns false when the receiver
+// is stopping.
+func (g *GraphiteReceiver) emit(ps []graphitePoint) bool {
+	if len(ps) == 0 {
+		return true
+	}
+	g.stat.CounterInc("graphite.points", len(ps))
+	if g.Mode == GraphiteModeDirect {
+		for _, p := range ps {
+			select {
+			case g.points <- point.New(p.name, "", p.tags, p.value, p.ts, point.Gauge):
+			case <-g.exit:
+				return false
+			}
+		}
+		return true
+	}
+
+	var packet []byte
+	for _, p := range ps {
+		packet = appendGauge(packet, p)
+	}
+	select {
+	case g.plain.packetInChannel <- packet:
+		return true
+	case <-g.exit:
+		return false
+	}
+}
+
+// parsePlaintext parses "<path> <value> [<timestamp>]".
+func parsePlaintext(line string, now int64) (graphitePoint, error) {
+	var p graphitePoint
+	fields := strings.Fields(line)
+	if len(fields) < 2 || len(fields) > 3 {
+		return p, fmt.Errorf("%q is not <path> <value> <timestamp>", line)
+	}
+	name, tags, err := parsePath(fields[0])
+	if err != nil {
+		return p, err
+	}
+	value, err := strconv.ParseFloat(fields[1], 64)
+	if err != nil || math.IsNaN(value) || math.IsInf(value, 0) {
+		return p, fmt.Errorf("invalid value in %q", line)
+	}
+	ts := now
+	if len(fields) == 3 {
+		f, err := strconv.ParseFloat(fields[2], 64)
+		if err != nil || (f < 0 && f != -1) {
+			return p, fmt.Errorf("invalid timestamp in %q", line)
+		}
+		if f > 0 {
+			ts = int64(f)
+		}
+	}
+	return graphitePoint{name: name, tags: tags, value: value, ts: ts}, nil
+}
+
+// parsePath splits a tagged path "<name>;<tag1>=<v1>;..." into its name and
+// sorted tags.
+func parsePath(path string) (string, []string, error) {
+	parts := strings.Split(path, ";")
+	if parts[0] == "" {
+		return "", nil, fmt.Errorf("empty name in path %q", path)
+	}
+	if len(parts) == 1 {
+		return path, nil, nil
+	}
+	tags := parts[1:]
+	for _, t := range tags {
+		if i := strings.IndexByte(t, '='); i <= 0 || i == len(t)-1 {
+			return "", nil, fmt.Errorf("invalid tag %q in path %q", t, path)
+		}
+	}
+	sort.Strings(tags)
+	return parts[0], tags, nil
+}
+
+// parsePickle decodes a pickle frame. On error the points decoded before it
+// are returned as well.
+func parsePickle(frame []byte, now int64) ([]graphitePoint, error) {
+	obj, err := unpickle(frame)
+	if err != nil {
+		return nil, err
+	}
+	items, ok := obj.([]interface{})
+	if !ok {
+		return nil, errors.New("pickle frame is not a list")
+	}
+	ps := make([]graphitePoint, 0, len(items))
+	// 错误信息中不能打印 item, 用 memo 和 DUP 可以构造出共享甚至循环引用的对象
+	for i, item := range items {
+		// (path, (timestamp, value))
+		pair, ok := item.([]interface{})
+		if !ok || len(pair) != 2 {
+			return ps, fmt.Errorf("pickle item %d is not (path, (timestamp, value))", i)
+		}
+		path, ok := pair[0].(string)
+		tv, ok2 := pair[1].([]interface{})
+		if !ok || !ok2 || len(tv) != 2 {
+			return ps, fmt.Errorf("pickle item %d is not (path, (timestamp, value))", i)
+		}
+		name, tags, err := parsePath(path)
+		if err != nil {
+			return ps, err
+		}
+		ts, err1 := pickleFloat(tv[0])
+		value, err2 := pickleFloat(tv[1])
+		if err1 != nil || err2 != nil || math.IsNaN(value) || math.IsInf(value, 0) {
+			return ps, fmt.Errorf("invalid timestamp or value in pickle item %d", i)
+		}
+		p := graphitePoint{name: name, tags: tags, value: value, ts: int64(ts)}
+		if ts <= 0 {
+			p.ts = now
+		}
+		ps = append(ps, p)
+	}
+	return ps, nil
+}
+
+func pickleFloat(v interface{}) (float64, error) {
+	switch n := v.(type) {
+	case int64:
+		return float64(n), nil
+	case float64:
+		return n, nil
+	case string:
+		return strconv.ParseFloat(n, 64)
+	}
+	return 0, fmt.Errorf("%v is not a number", v)
+}
+
+// appendGauge appends p to dst as a statsd gauge line with its timestamp,
+// "<name>:<value>|g[|#tags]|T<ts>". statsd treats a signed gauge value as a
+// delta, so a negative value is sent as a reset to 0 followed by it.
+func appendGauge(dst []byte, p graphitePoint) []byte {
+	dst = append(dst, graphiteEscaper.Replace(p.name)...)
+	dst = append(dst, ':')
+	if p.value < 0 {
+		dst = appendGaugeSection(dst, 0, p)
+		dst = append(dst, ':')
+	}
+	dst = appendGaugeSection(dst, p.value, p)
+	return append(dst, '\n')
+}
+
+func appendGaugeSection(dst []byte, value float64, p graphitePoint) []byte {
+	dst = strconv.AppendFloat(dst, value, 'g', -1, 64)
+	dst = append(dst, "|g"...)
+	for i, t := range p.tags {
+		if i == 0 {
+			dst = append(dst, "|#"...)
+		} else {
+			dst = append(dst, ',')
+		}
+		dst = append(dst, graphiteEscaper.Replace(t)...)
+	}
+	dst = append(dst, "|T"...)
+	return strconv.AppendInt(dst, p.ts, 10)
+}
+
+// graphiteEscaper replaces the characters that separate statsd sections,
+// fields and tags.
+var graphiteEscaper = strings.NewReplacer(":", "_", "|", "_", ",", "_")
@@ -0,0 +1,401 @@
+package receivers
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/coder-van/v-stats/parser"
+	"github.com/coder-van/v-util/log"
+)
+
+/*
+ http push receiver, 给不能发送 udp 的 serverless 任务和浏览器使用
+ POST <Path>, 支持 Content-Encoding: gzip
+ Content-Type: text/plain(或不设置), body 是 statsd 数据行, 和 udp 数据包相同
+ Content-Type: application/json, body 是数组:
+ [{"name": "api.hits", "value": 1, "type": "c", "rate": 0.5, "tags": {"host": "a"}}]
+ type 可以是 c, g, ms, h, s 或 counter, gauge, timer, histogram, set; rate 和 tags 可选,
+ tags 也可以是 ["host=a"] 这样的数组; value 是字符串时原样使用, 和文本相同, 带符号的 gauge 值是增量
+ 每一行都先用 parser.ParseLine 校验, 正确的行合并成一个数据包放入 PacketInChannel,
+ 回复 202 和每一行的错误:
+ {"accepted": 1, "rejected": 1, "errors": [{"line": 2, "error": "..."}]}
+ line 是文本的行号或 JSON 数组中的位置, 从 1 开始
+ 队列满时回复 503, 整个请求都没有被接受, 客户端可以重试
+ self-metrics(前缀 statsd.http.): requests, lines.accepted, lines.rejected, drops, errors.body
+*/
+const (
+	DefaultHttpPath         = "/statsd"
+	DefaultHttpMaxBodyBytes = 1024 * 1024
+)
+
+// LineError is the error of one line in the reply.
+type LineError struct {
+	Line  int    `json:"line"`
+	Error string `json:"error"`
+}
+
+// PushReply is the body of a 202 reply.
+type PushReply struct {
+	Accepted int         `json:"accepted"`
+	Rejected int         `json:"rejected"`
+	Errors   []LineError `json:"errors,omitempty"`
+}
+
+func NewHttpReceiver(addr string, ch chan []byte) *HttpReceiver {
+	return &HttpReceiver{
+		Addr:            addr,
+		Path:            DefaultHttpPath,
+		MaxBodyBytes:    DefaultHttpMaxBodyBytes,
+		packetInChannel: ch,
+		stat:            nopStat{},
+		logger:          log.GetLogger("statsd.HttpReceiver", log.RotateModeMonth),
+	}
+}
+
+type HttpReceiver struct {
+	Addr string
+	Path string
+	// MaxBodyBytes limits the body, after gzip decoding as well
+	MaxBodyBytes int64
+	// AllowOrigin is sent as Access-Control-Allow-Origin so that browsers
+	// may push, CORS is disabled when empty
+	AllowOrigin string
+
+	packetInChannel chan []byte
+	repeater        Repeater
+	stat            Stat
+	server          *http.Server
+	logger          *log.Vlogger
+}
+
+// SetRepeater forwards every received packet to r as well.
+func (h *HttpReceiver) SetRepeater(r Repeater) {
+	h.repeater = r
+}
+
+// SetStat sets where the self-metrics are recorded.
+func (h *HttpReceiver) SetStat(stat Stat) {
+	h.stat = stat
+}
+
+func (h *HttpReceiver) Start() {
+	h.logger.Println("Statsd HttpReceiver starting")
+	l, err := net.Listen("tcp", h.Addr)
+	if err != nil {
+		h.logger.Printf("ERROR: http listening on %s, %s", h.Addr, err)
+		return
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc(h.Path, h.handle)
+	h.server = &http.Server{
+		Handler:      mux,
+		ReadTimeout:  30 * time.Second,
+		WriteTimeout: 30 * time.Second,
+	}
+	h.logger.Println("Statsd HttpReceiver listening on:", l.Addr())
+	go func() {
+		if err := h.server.Serve(l); err != nil && err != http.ErrServerClosed {
+			h.logger.Printf("ERROR: serving http pushes, %s", err)
+		}
+	}()
+}
+
+func (h *HttpReceiver) Stop() {
+	h.logger.Println("Statsd HttpReceiver stoping")
+	if h.server != nil {
+		h.server.Close()
+	}
+	h.logger.Println("Statsd HttpReceiver stoped")
+}
+
+func (h *HttpReceiver) handle(w http.ResponseWriter, r *http.Request) {
+	if h.AllowOrigin != "" {
+		w.Header().Set("Access-Control-Allow-Origin", h.AllowOrigin)
+	}
+	switch r.Method {
+	case http.MethodPost:
+	case http.MethodOptions:
+		if h.AllowOrigin != "" {
+			w.Header().Set("Access-Control-Allow-Methods", "POST, OPTIONS")
+			w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Content-Encoding")
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	default:
+		w.Header().Set("Allow", "POST, OPTIONS")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	h.stat.CounterInc("http.requests", 1)
+
+	isJSON := false
+	if ct := r.Header.Get("Content-Type"); ct != "" {
+		mt, _, err := mime.ParseMediaType(ct)
+		switch {
+		case err != nil:
+			http.Error(w, "invalid content type", http.StatusUnsupportedMediaType)
+			return
+		case mt == "application/json":
+			isJSON = true
+		case mt != "text/plain":
+			http.Error(w, "content type must be text/plain or application/json", http.StatusUnsupportedMediaType)
+			return
+		}
+	}
+
+	body, status, err := h.readBody(w, r)
+	if err != nil {
+		h.stat.CounterInc("http.errors.body", 1)
+		http.Error(w, err.Error(), status)
+		return
+	}
+
+	var packet []byte
+	var reply PushReply
+	if isJSON {
+		packet, reply, err = parseJSONBody(body)
+		if err != nil {
+			h.stat.CounterInc("http.errors.body", 1)
+			http.Error(w, "invalid json body, "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	} else {
+		packet, reply = parseTextBody(body)
+	}
+
+	if len(packet) > 0 {
+		select {
+		case h.packetInChannel <- packet:
+		default:
+			h.stat.CounterInc("http.drops", 1)
+			w.Header().Set("Retry-After", "1")
+			http.Error(w, "statsd message queue full", http.StatusServiceUnavailable)
+			return
+		}
+		// 客户端会重试 503 的请求, 只转发进入队列的数据包
+		if h.repeater != nil {
+			h.repeater.Repeat(packet)
+		}
+	}
+	h.stat.CounterInc("http.lines.accepted", reply.Accepted)
+	h.stat.CounterInc("http.lines.rejected", reply.Rejected)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(reply)
+}
+
+// readBody reads the body, gzip decoded, and returns the status code to
+// reply with on error.
+func (h *HttpReceiver) readBody(w http.ResponseWriter, r *http.Request) ([]byte, int, error) {
+	var rd io.Reader = http.MaxBytesReader(w, r.Body, h.MaxBodyBytes)
+	switch strings.ToLower(r.Header.Get("Content-Encoding")) {
+	case "", "identity":
+	case "gzip":
+		gr, err := gzip.NewReader(rd)
+		if err != nil {
+			return nil, http.StatusBadRequest, fmt.Errorf("invalid gzip body, %s", err)
+		}
+		defer gr.Close()
+		rd = gr
+	default:
+		return nil, http.StatusUnsupportedMediaType, errors.New("content encoding must be gzip or identity")
+	}
+	// 多读一个字节, 判断解压后的大小是否超过限制
+	body, err := ioutil.ReadAll(io.LimitReader(rd, h.MaxBodyBytes+1))
+	if err != nil {
+		if strings.Contains(err.Error(), "request body too large") {
+			return nil, http.StatusRequestEntityTooLarge, err
+		}
+		return nil, http.StatusBadRequest, fmt.Errorf("failed to read body, %s", err)
+	}
+	if int64(len(body)) > h.MaxBodyBytes {
+		return nil, http.StatusRequestEntityTooLarge, errors.New("http: request body too large")
+	}
+	return body, 0, nil
+}
+
+// parseTextBody checks every statsd line of body and joins the valid ones
+// into a packet.
+func parseTextBody(body []byte) ([]byte, PushReply) {
+	var reply PushReply
+	packet := make([]byte, 0, len(body)+1)
+	ms := make([]parser.ParsedMetric, 0, 4)
+	n := 0
+	for len(body) > 0 {
+		var line []byte
+		if i := bytes.IndexByte(body, '\n'); i >= 0 {
+			line, body = body[:i], body[i+1:]
+		} else {
+			line, body = body, nil
+		}
+		n++
+		line = bytes.TrimSpace(line)
+		if len(line) == 0 {
+			continue
+		}
+		var err error
+		if ms, err = parser.ParseLine(line, ms[:0]); err != nil {
+			reply.reject(n, err)
+			continue
+		}
+		reply.Accepted++
+		packet = append(packet, line...)
+		packet = append(packet, '\n')
+	}
+	return packet, reply
+}
+
+// jsonMetric is one element of a JSON body.
+type jsonMetric struct {
+	Name  string          `json:"name"`
+	Value json.RawMessage `json:"value"`
+	Type  string          `json:"type"`
+	Rate  float64         `json:"rate"`
+	// Tags is either {"k": "v"} or ["k=v"]
+	Tags json.RawMessage `json:"tags"`
+}
+
+var jsonTypes = map[string]string{
+	"c": "c", "counter": "c",
+	"g": "g", "gauge": "g",
+	"ms": "ms", "timer": "ms",
+	"h": "h", "histogram": "h",
+	"s": "s", "set": "s",
+}
+
+// parseJSONBody converts every element of body to a statsd line, checks it
+// with the statsd parser and joins the valid ones into a packet. err is only
+// set when body is not a JSON array.
+func parseJSONBody(body []byte) ([]byte, PushReply, error) {
+	var reply PushReply
+	var raws []json.RawMessage
+	if err := json.Unmarshal(body, &raws); err != nil {
+		return nil, reply, err
+	}
+	var packet []byte
+	ms := make([]parser.ParsedMetric, 0, 1)
+	for i, raw := range raws {
+		var m jsonMetric
+		if err := json.Unmarshal(raw, &m); err != nil {
+			reply.reject(i+1, err)
+			continue
+		}
+		line, err := m.line()
+		if err == nil {
+			ms, err = parser.ParseLine(line, ms[:0])
+		}
+		if err != nil {
+			reply.reject(i+1, err)
+			continue
+		}
+		reply.Accepted++
+		packet = append(packet, line...)
+		packet = append(packet, '\n')
+	}
+	return packet, reply, nil
+}
+
+// line formats m as "<name>:<value>|<type>[|@<rate>][|#<tags>]".
+func (m *jsonMetric) line() ([]byte, error) {
+	if m.Name == "" {
+		return nil, parser.ErrEmptyName
+	}
+	if strings.ContainsAny(m.Name, ":|\n") {
+		return nil, fmt.Errorf("invalid metric name %q", m.Name)
+	}
+	t, ok := jsonTypes[m.Type]
+	if !ok {
+		return nil, fmt.Errorf("%s %q", parser.ErrUnknownType, m.Type)
+	}
+	value, err := m.value()
+	if err != nil {
+		return nil, err
+	}
+	tags, err := m.tags()
+	if err != nil {
+		return nil, err
+	}
+
+	line := make([]byte, 0, len(m.Name)+len(value)+len(tags)+16)
+	line = append(line, m.Name...)
+	line = append(line, ':')
+	line = append(line, value...)
+	line = append(line, '|')
+	line = append(line, t...)
+	if m.Rate != 0 {
+		line = append(line, "|@"...)
+		line = strconv.AppendFloat(line, m.Rate, 'g', -1, 64)
+	}
+	if len(tags) > 0 {
+		line = append(line, "|#"...)
+		line = append(line, tags...)
+	}
+	return line, nil
+}
+
+func (m *jsonMetric) value() (string, error) {
+	if len(m.Value) == 0 || string(m.Value) == "null" {
+		return "", parser.ErrMissingValue
+	}
+	if m.Value[0] == '"' {
+		var s string
+		if err := json.Unmarshal(m.Value, &s); err != nil {
+			return "", err
+		}
+		if strings.ContainsAny(s, ":|\n") {
+			return "", fmt.Errorf("%s %q", parser.ErrInvalidValue, s)
+		}
+		return s, nil
+	}
+	var f json.Number
+	if err := json.Unmarshal(m.Value, &f); err != nil {
+		return "", fmt.Errorf("%s %s", parser.ErrInvalidValue, m.Value)
+	}
+	return f.String(), nil
+}
+
+func (m *jsonMetric) tags() (string, error) {
+	if len(m.Tags) == 0 || string(m.Tags) == "null" {
+		return "", nil
+	}
+	var tags []string
+	if m.Tags[0] == '{' {
+		var kv map[string]string
+		if err := json.Unmarshal(m.Tags, &kv); err != nil {
+			return "", err
+		}
+		for k, v := range kv {
+			if k == "" || strings.ContainsRune(k, '=') {
+				return "", fmt.Errorf("invalid tag name %q", k)
+			}
+			tags = append(tags, k+"="+v)
+		}
+		sort.Strings(tags)
+	} else if err := json.Unmarshal(m.Tags, &tags); err != nil {
+		return "", err
+	}
+	for _, t := range tags {
+		if strings.ContainsAny(t, ",:|\n") {
+			return "", fmt.Errorf("invalid tag %q", t)
+		}
+	}
+	return strings.Join(tags, ","), nil
+}
+
+func (reply *PushReply) reject(line int, err error) {
+	reply.Rejected++
+	reply.Errors = append(reply.Errors, LineError{Line: line, Error: err.Error()})
+}
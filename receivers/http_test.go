@@ -0,0 +1,171 @@
+package receivers
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func newTestHttpReceiver(queue int) (*HttpReceiver, *countStat, chan []byte) {
+	ch := make(chan []byte, queue)
+	h := NewHttpReceiver("127.0.0.1:0", ch)
+	stat := newCountStat()
+	h.SetStat(stat)
+	return h, stat, ch
+}
+
+func push(h *HttpReceiver, body []byte, header map[string]string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodPost, DefaultHttpPath, bytes.NewReader(body))
+	for k, v := range header {
+		r.Header.Set(k, v)
+	}
+	w := httptest.NewRecorder()
+	h.handle(w, r)
+	return w
+}
+
+func gzipped(t *testing.T, s string) []byte {
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	if _, err := gw.Write([]byte(s)); err != nil {
+		t.Fatal(err)
+	}
+	if err := gw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func decodeReply(t *testing.T, w *httptest.ResponseRecorder) PushReply {
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("got status %d, %s", w.Code, w.Body)
+	}
+	var reply PushReply
+	if err := json.Unmarshal(w.Body.Bytes(), &reply); err != nil {
+		t.Fatalf("%q: %s", w.Body, err)
+	}
+	return reply
+}
+
+func TestHttpTextBody(t *testing.T) {
+	h, stat, ch := newTestHttpReceiver(1)
+	w := push(h, []byte("a:1|c\nbad\n\n b:2|g \nc:x|ms"), nil)
+	reply := decodeReply(t, w)
+	if reply.Accepted != 2 || reply.Rejected != 2 {
+		t.Errorf("got %+v", reply)
+	}
+	var lines []int
+	for _, e := range reply.Errors {
+		lines = append(lines, e.Line)
+		if e.Error == "" {
+			t.Errorf("line %d has no error message", e.Line)
+		}
+	}
+	if !reflect.DeepEqual(lines, []int{2, 5}) {
+		t.Errorf("got errors on lines %v, want [2 5]", lines)
+	}
+	if p := string(<-ch); p != "a:1|c\nb:2|g\n" {
+		t.Errorf("got packet %q", p)
+	}
+	if stat.get("http.lines.accepted") != 2 || stat.get("http.lines.rejected") != 2 {
+		t.Errorf("got stats %v", stat.counts)
+	}
+}
+
+func TestHttpJSONBody(t *testing.T) {
+	h, _, ch := newTestHttpReceiver(1)
+	body := `[
+		{"name": "api.hits", "value": 1, "type": "c", "rate": 0.5, "tags": {"host": "a", "dc": "x"}},
+		{"name": "temp", "value": "-2", "type": "gauge", "tags": ["room=1"]},
+		{"name": "", "value": 1, "type": "c"},
+		{"name": "a", "value": 1, "type": "q"}
+	]`
+	reply := decodeReply(t, push(h, []byte(body), map[string]string{"Content-Type": "application/json; charset=utf-8"}))
+	if reply.Accepted != 2 || reply.Rejected != 2 || reply.Errors[0].Line != 3 || reply.Errors[1].Line != 4 {
+		t.Errorf("got %+v", reply)
+	}
+	if p := string(<-ch); p != "api.hits:1|c|@0.5|#dc=x,host=a\ntemp:-2|g|#room=1\n" {
+		t.Errorf("got packet %q", p)
+	}
+
+	if w := push(h, []byte(`{"name": "a"}`), map[string]string{"Content-Type": "application/json"}); w.Code != http.StatusBadRequest {
+		t.Errorf("got status %d for a json object", w.Code)
+	}
+}
+
+func TestHttpGzip(t *testing.T) {
+	h, _, ch := newTestHttpReceiver(1)
+	reply := decodeReply(t, push(h, gzipped(t, "a:1|c\n"), map[string]string{"Content-Encoding": "gzip"}))
+	if reply.Accepted != 1 {
+		t.Errorf("got %+v", reply)
+	}
+	if p := string(<-ch); p != "a:1|c\n" {
+		t.Errorf("got packet %q", p)
+	}
+
+	if w := push(h, []byte("a:1|c\n"), map[string]string{"Content-Encoding": "gzip"}); w.Code != http.StatusBadRequest {
+		t.Errorf("got status %d for a plain body", w.Code)
+	}
+	if w := push(h, []byte("a:1|c\n"), map[string]string{"Content-Encoding": "br"}); w.Code != http.StatusUnsupportedMediaType {
+		t.Errorf("got status %d for br", w.Code)
+	}
+}
+
+func TestHttpBodyTooLarge(t *testing.T) {
+	h, stat, ch := newTestHttpReceiver(1)
+	h.MaxBodyBytes = 1024
+	large := strings.Repeat("a:1|c\n", 1000)
+
+	if w := push(h, []byte(large), nil); w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("got status %d for a large body", w.Code)
+	}
+	// 压缩后很小, 解压后超过限制
+	body := gzipped(t, large)
+	if int64(len(body)) > h.MaxBodyBytes {
+		t.Fatalf("the gzipped body is %d bytes", len(body))
+	}
+	if w := push(h, body, map[string]string{"Content-Encoding": "gzip"}); w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("got status %d for a large gzipped body", w.Code)
+	}
+	if len(ch) != 0 {
+		t.Errorf("a too large body was queued")
+	}
+	if n := stat.get("http.errors.body"); n != 2 {
+		t.Errorf("got %d body errors, want 2", n)
+	}
+}
+
+func TestHttpQueueFull(t *testing.T) {
+	h, stat, ch := newTestHttpReceiver(1)
+	ch <- []byte("x:1|c\n")
+	w := push(h, []byte("a:1|c\n"), nil)
+	if w.Code != http.StatusServiceUnavailable || w.Header().Get("Retry-After") == "" {
+		t.Errorf("got status %d, Retry-After %q", w.Code, w.Header().Get("Retry-After"))
+	}
+	if stat.get("http.drops") != 1 || stat.get("http.lines.accepted") != 0 {
+		t.Errorf("got stats %v", stat.counts)
+	}
+}
+
+func TestHttpMethods(t *testing.T) {
+	h, _, _ := newTestHttpReceiver(1)
+	h.AllowOrigin = "*"
+	for method, code := range map[string]int{
+		http.MethodGet:     http.StatusMethodNotAllowed,
+		http.MethodOptions: http.StatusNoContent,
+	} {
+		w := httptest.NewRecorder()
+		h.handle(w, httptest.NewRequest(method, DefaultHttpPath, nil))
+		if w.Code != code || w.Header().Get("Access-Control-Allow-Origin") != "*" {
+			t.Errorf("%s: got status %d, headers %v", method, w.Code, w.Header())
+		}
+	}
+	if w := push(h, []byte("a:1|c"), map[string]string{"Content-Type": "text/html"}); w.Code != http.StatusUnsupportedMediaType {
+		t.Errorf("got status %d for text/html", w.Code)
+	}
+}
@@ -0,0 +1,86 @@
+package receivers
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// credOOBSize is the room needed for one SCM_CREDENTIALS message.
+var credOOBSize = syscall.CmsgSpace(syscall.SizeofUcred)
+
+// streamPeerCred reads SO_PEERCRED of a connected unix stream socket.
+func streamPeerCred(c *net.UnixConn) (pid, uid int, err error) {
+	raw, err := c.SyscallConn()
+	if err != nil {
+		return 0, 0, err
+	}
+	var cred *syscall.Ucred
+	var credErr error
+	err = raw.Control(func(fd uintptr) {
+		cred, credErr = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+	if credErr != nil {
+		return 0, 0, credErr
+	}
+	return int(cred.Pid), int(cred.Uid), nil
+}
+
+// enablePassCred makes the kernel attach SCM_CREDENTIALS to every datagram.
+func enablePassCred(c *net.UnixConn) error {
+	raw, err := c.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var optErr error
+	err = raw.Control(func(fd uintptr) {
+		optErr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_PASSCRED, 1)
+	})
+	if err != nil {
+		return err
+	}
+	return optErr
+}
+
+func parsePassCred(oob []byte) (pid, uid int, err error) {
+	msgs, err := syscall.ParseSocketControlMessage(oob)
+	if err != nil {
+		return 0, 0, err
+	}
+	for i := range msgs {
+		if msgs[i].Header.Level == syscall.SOL_SOCKET && msgs[i].Header.Type == syscall.SCM_CREDENTIALS {
+			cred, err := syscall.ParseUnixCredentials(&msgs[i])
+			if err != nil {
+				return 0, 0, err
+			}
+			return int(cred.Pid), int(cred.Uid), nil
+		}
+	}
+	return 0, 0, errors.New("no SCM_CREDENTIALS message")
+}
+
+// cgroupOf returns the cgroup path of pid, for cgroup v1 the path of the
+// first hierarchy. It is empty when the process is gone.
+func cgroupOf(pid int) string {
+	f, err := os.Open("/proc/" + strconv.Itoa(pid) + "/cgroup")
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		// <id>:<controllers>:<path>, cgroup v2 只有一行 0::<path>
+		parts := strings.SplitN(s.Text(), ":", 3)
+		if len(parts) == 3 && parts[2] != "" {
+			return parts[2]
+		}
+	}
+	return ""
+}
@@ -0,0 +1,29 @@
+//go:build !linux
+// +build !linux
+
+package receivers
+
+import (
+	"errors"
+	"net"
+)
+
+var errPeerCred = errors.New("peer credentials are only supported on linux")
+
+var credOOBSize = 0
+
+func streamPeerCred(c *net.UnixConn) (pid, uid int, err error) {
+	return 0, 0, errPeerCred
+}
+
+func enablePassCred(c *net.UnixConn) error {
+	return errPeerCred
+}
+
+func parsePassCred(oob []byte) (pid, uid int, err error) {
+	return 0, 0, errPeerCred
+}
+
+func cgroupOf(pid int) string {
+	return ""
+}
@@ -0,0 +1,378 @@
+package receivers
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+/*
+ Graphite pickle 协议的解码, carbon-relay 和很多客户端用它批量发送:
+ [(path, (timestamp, value)), ...]
+ 只实现表示这种数据需要的 opcode(协议 0 到 4 的数字, 字符串, 列表, 元组和 memo),
+ GLOBAL, REDUCE 这类会构造任意对象的 opcode 一律拒绝, 不能信任发送方
+ list 和 tuple 都解码为 []interface{}, 整数为 int64, 浮点数为 float64, 字符串和 bytes 为 string
+*/
+
+var (
+	errPickleTruncated = errors.New("pickle: truncated data")
+	errPickleStack     = errors.New("pickle: stack underflow")
+	errPickleNoMark    = errors.New("pickle: mark not found")
+)
+
+type pickleMark struct{}
+
+type unpickler struct {
+	data  []byte
+	pos   int
+	stack []interface{}
+	memo  map[int]interface{}
+}
+
+// unpickle decodes one pickled object.
+func unpickle(data []byte) (interface{}, error) {
+	u := &unpickler{data: data, memo: make(map[int]interface{})}
+	for {
+		if u.pos >= len(u.data) {
+			return nil, errPickleTruncated
+		}
+		op := u.data[u.pos]
+		u.pos++
+		if op == '.' {
+			// STOP
+			return u.pop()
+		}
+		if err := u.exec(op); err != nil {
+			return nil, err
+		}
+	}
+}
+
+func (u *unpickler) exec(op byte) error {
+	switch op {
+	case 0x80:
+		// PROTO
+		_, err := u.read(1)
+		return err
+	case 0x95:
+		// FRAME, 只是读取时的分块提示
+		_, err := u.read(8)
+		return err
+	case '(':
+		u.push(pickleMark{})
+	case ']':
+		u.push([]interface{}{})
+	case ')':
+		u.push([]interface{}{})
+	case 'N':
+		u.push(nil)
+	case 0x88:
+		u.push(true)
+	case 0x89:
+		u.push(false)
+
+	case 'l', 't':
+		// LIST, TUPLE
+		items, err := u.popMark()
+		if err != nil {
+			return err
+		}
+		u.push(items)
+	case 0x85, 0x86, 0x87:
+		// TUPLE1, TUPLE2, TUPLE3
+		n := int(op - 0x84)
+		if len(u.stack) < n {
+			return errPickleStack
+		}
+		items := make([]interface{}, n)
+		copy(items, u.stack[len(u.stack)-n:])
+		u.stack = u.stack[:len(u.stack)-n]
+		u.push(items)
+	case 'a':
+		// APPEND
+		v, err := u.pop()
+		if err != nil {
+			return err
+		}
+		return u.appendTop(v)
+	case 'e':
+		// APPENDS
+		items, err := u.popMark()
+		if err != nil {
+			return err
+		}
+		return u.appendTop(items...)
+
+	case 'J':
+		b, err := u.read(4)
+		if err != nil {
+			return err
+		}
+		u.push(int64(int32(binary.LittleEndian.Uint32(b))))
+	case 'K':
+		b, err := u.read(1)
+		if err != nil {
+			return err
+		}
+		u.push(int64(b[0]))
+	case 'M':
+		b, err := u.read(2)
+		if err != nil {
+			return err
+		}
+		u.push(int64(binary.LittleEndian.Uint16(b)))
+	case 'I':
+		line, err := u.readLine()
+		if err != nil {
+			return err
+		}
+		// 协议 0 中 True 和 False 编码为 I01 和 I00
+		switch line {
+		case "01":
+			u.push(true)
+		case "00":
+			u.push(false)
+		default:
+			i, err := strconv.ParseInt(line, 10, 64)
+			if err != nil {
+				return fmt.Errorf("pickle: invalid int %q", line)
+			}
+			u.push(i)
+		}
+	case 'L':
+		line, err := u.readLine()
+		if err != nil {
+			return err
+		}
+		i, err := strconv.ParseInt(strings.TrimSuffix(line, "L"), 10, 64)
+		if err != nil {
+			return fmt.Errorf("pickle: invalid long %q", line)
+		}
+		u.push(i)
+	case 0x8a:
+		// LONG1, 小端补码
+		b, err := u.read(1)
+		if err != nil {
+			return err
+		}
+		n := int(b[0])
+		if n > 8 {
+			return fmt.Errorf("pickle: long of %d bytes is too large", n)
+		}
+		if b, err = u.read(n); err != nil {
+			return err
+		}
+		var v uint64
+		for i := n - 1; i >= 0; i-- {
+			v = v<<8 | uint64(b[i])
+		}
+		if n > 0 && n < 8 && b[n-1]&0x80 != 0 {
+			v |= ^uint64(0) << (8 * uint(n))
+		}
+		u.push(int64(v))
+	case 'G':
+		b, err := u.read(8)
+		if err != nil {
+			return err
+		}
+		u.push(math.Float64frombits(binary.BigEndian.Uint64(b)))
+	case 'F':
+		line, err := u.readLine()
+		if err != nil {
+			return err
+		}
+		f, err := strconv.ParseFloat(line, 64)
+		if err != nil {
+			return fmt.Errorf("pickle: invalid float %q", line)
+		}
+		u.push(f)
+
+	case 'S':
+		line, err := u.readLine()
+		if err != nil {
+			return err
+		}
+		s, err := strconv.Unquote(line)
+		if err != nil {
+			// python 的 repr 用单引号
+			if len(line) < 2 || line[0] != '\'' || line[len(line)-1] != '\'' {
+				return fmt.Errorf("pickle: invalid string %q", line)
+			}
+			s = line[1 : len(line)-1]
+		}
+		u.push(s)
+	case 'V':
+		line, err := u.readLine()
+		if err != nil {
+			return err
+		}
+		u.push(line)
+	case 'T', 'X', 'B':
+		// BINSTRING, BINUNICODE, BINBYTES
+		b, err := u.read(4)
+		if err != nil {
+			return err
+		}
+		return u.pushString(int(binary.LittleEndian.Uint32(b)))
+	case 'U', 0x8c, 'C':
+		// SHORT_BINSTRING, SHORT_BINUNICODE, SHORT_BINBYTES
+		b, err := u.read(1)
+		if err != nil {
+			return err
+		}
+		return u.pushString(int(b[0]))
+
+	case 'p':
+		line, err := u.readLine()
+		if err != nil {
+			return err
+		}
+		i, err := strconv.Atoi(line)
+		if err != nil {
+			return fmt.Errorf("pickle: invalid memo index %q", line)
+		}
+		return u.put(i)
+	case 'q':
+		b, err := u.read(1)
+		if err != nil {
+			return err
+		}
+		return u.put(int(b[0]))
+	case 'r':
+		b, err := u.read(4)
+		if err != nil {
+			return err
+		}
+		return u.put(int(binary.LittleEndian.Uint32(b)))
+	case 0x94:
+		// MEMOIZE
+		return u.put(len(u.memo))
+	case 'g':
+		line, err := u.readLine()
+		if err != nil {
+			return err
+		}
+		i, err := strconv.Atoi(line)
+		if err != nil {
+			return fmt.Errorf("pickle: invalid memo index %q", line)
+		}
+		return u.get(i)
+	case 'h':
+		b, err := u.read(1)
+		if err != nil {
+			return err
+		}
+		return u.get(int(b[0]))
+	case 'j':
+		b, err := u.read(4)
+		if err != nil {
+			return err
+		}
+		return u.get(int(binary.LittleEndian.Uint32(b)))
+
+	case '0':
+		_, err := u.pop()
+		return err
+	case '1':
+		_, err := u.popMark()
+		return err
+	case '2':
+		if len(u.stack) == 0 {
+			return errPickleStack
+		}
+		u.push(u.stack[len(u.stack)-1])
+	default:
+		return fmt.Errorf("pickle: unsupported opcode 0x%02x", op)
+	}
+	return nil
+}
+
+func (u *unpickler) read(n int) ([]byte, error) {
+	if n < 0 || len(u.data)-u.pos < n {
+		return nil, errPickleTruncated
+	}
+	b := u.data[u.pos : u.pos+n]
+	u.pos += n
+	return b, nil
+}
+
+func (u *unpickler) readLine() (string, error) {
+	i := bytes.IndexByte(u.data[u.pos:], '\n')
+	if i < 0 {
+		return "", errPickleTruncated
+	}
+	line := string(u.data[u.pos : u.pos+i])
+	u.pos += i + 1
+	return line, nil
+}
+
+func (u *unpickler) pushString(n int) error {
+	b, err := u.read(n)
+	if err != nil {
+		return err
+	}
+	u.push(string(b))
+	return nil
+}
+
+func (u *unpickler) push(v interface{}) {
+	u.stack = append(u.stack, v)
+}
+
+func (u *unpickler) pop() (interface{}, error) {
+	if len(u.stack) == 0 {
+		return nil, errPickleStack
+	}
+	v := u.stack[len(u.stack)-1]
+	u.stack = u.stack[:len(u.stack)-1]
+	if _, ok := v.(pickleMark); ok {
+		return nil, errPickleStack
+	}
+	return v, nil
+}
+
+// popMark pops the objects above the topmost mark and the mark itself.
+func (u *unpickler) popMark() ([]interface{}, error) {
+	for i := len(u.stack) - 1; i >= 0; i-- {
+		if _, ok := u.stack[i].(pickleMark); ok {
+			items := make([]interface{}, len(u.stack)-i-1)
+			copy(items, u.stack[i+1:])
+			u.stack = u.stack[:i]
+			return items, nil
+		}
+	}
+	return nil, errPickleNoMark
+}
+
+func (u *unpickler) appendTop(items ...interface{}) error {
+	if len(u.stack) == 0 {
+		return errPickleStack
+	}
+	l, ok := u.stack[len(u.stack)-1].([]interface{})
+	if !ok {
+		return errors.New("pickle: append to a non list")
+	}
+	u.stack[len(u.stack)-1] = append(l, items...)
+	return nil
+}
+
+func (u *unpickler) put(i int) error {
+	if len(u.stack) == 0 {
+		return errPickleStack
+	}
+	u.memo[i] = u.stack[len(u.stack)-1]
+	return nil
+}
+
+func (u *unpickler) get(i int) error {
+	v, ok := u.memo[i]
+	if !ok {
+		return fmt.Errorf("pickle: memo %d not found", i)
+	}
+	u.push(v)
+	return nil
+}
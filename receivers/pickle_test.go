@@ -0,0 +1,169 @@
+package receivers
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// 以下数据由 python 的 pickle.dumps([('a.b', (1700000000, 1.5)), ('c;x=1', (1700000000, 2))], protocol=N) 生成
+var pickleCases = []struct {
+	name string
+	data string
+}{
+	{"py2 protocol 0", "(lp0\n(S'a.b'\np1\n(I1700000000\nF1.5\ntp2\ntp3\na(S'c;x=1'\np4\n(L1700000000L\nI2\ntp5\ntp6\na."},
+	{"py2 protocol 1", "]q\x00((U\x03a.bq\x01(J\x00\xf1SeG?\xf8\x00\x00\x00\x00\x00\x00tq\x02tq\x03(U\x05c;x=1q\x04(L1700000000L\nK\x02tq\x05tq\x06e."},
+	{"py2 protocol 2", "\x80\x02]q\x00(U\x03a.bq\x01J\x00\xf1SeG?\xf8\x00\x00\x00\x00\x00\x00\x86q\x02\x86q\x03U\x05c;x=1q\x04\x8a\x04\x00\xf1SeK\x02\x86q\x05\x86q\x06e."},
+	{"py3 protocol 0", "(lp0\n(Va.b\np1\n(I1700000000\nF1.5\ntp2\ntp3\na(Vc;x=1\np4\n(I1700000000\nI2\ntp5\ntp6\na."},
+	{"py3 protocol 2", "\x80\x02]q\x00(X\x03\x00\x00\x00a.bq\x01J\x00\xf1SeG?\xf8\x00\x00\x00\x00\x00\x00\x86q\x02\x86q\x03X\x05\x00\x00\x00c;x=1q\x04J\x00\xf1SeK\x02\x86q\x05\x86q\x06e."},
+	{"py3 protocol 4", "\x80\x04\x950\x00\x00\x00\x00\x00\x00\x00]\x94(\x8c\x03a.b\x94J\x00\xf1SeG?\xf8\x00\x00\x00\x00\x00\x00\x86\x94\x86\x94\x8c\x05c;x=1\x94J\x00\xf1SeK\x02\x86\x94\x86\x94e."},
+}
+
+func TestUnpickle(t *testing.T) {
+	want := []interface{}{
+		[]interface{}{"a.b", []interface{}{int64(1700000000), 1.5}},
+		[]interface{}{"c;x=1", []interface{}{int64(1700000000), int64(2)}},
+	}
+	for _, c := range pickleCases {
+		got, err := unpickle([]byte(c.data))
+		if err != nil {
+			t.Errorf("%s: %s", c.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: got %#v", c.name, got)
+		}
+	}
+}
+
+func TestUnpickleNumbers(t *testing.T) {
+	// pickle.dumps([('n', (-1, -300)), ('big', (2**40, True))], protocol=2)
+	data := "\x80\x02]q\x00(X\x01\x00\x00\x00nq\x01J\xff\xff\xff\xffJ\xd4\xfe\xff\xff\x86q\x02\x86q\x03X\x03\x00\x00\x00bigq\x04\x8a\x06\x00\x00\x00\x00\x00\x01\x88\x86q\x05\x86q\x06e."
+	want := []interface{}{
+		[]interface{}{"n", []interface{}{int64(-1), int64(-300)}},
+		[]interface{}{"big", []interface{}{int64(1) << 40, true}},
+	}
+	got, err := unpickle([]byte(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %#v", got)
+	}
+}
+
+func TestUnpickleErrors(t *testing.T) {
+	for _, data := range []string{
+		"",
+		"]",
+		".",
+		"(t",
+		"ta.",
+		"K",
+		"J\x00\x00",
+		"X\xff\xff\xff\x7fabc.",
+		"h\x05.",
+		"\x8a\x09\x00\x00\x00\x00\x00\x00\x00\x00\x00.",
+		"K\x01a.",
+		// GLOBAL 和 REDUCE 可以构造任意对象, 必须拒绝
+		"cos\nsystem\n(S'echo'\ntR.",
+	} {
+		if v, err := unpickle([]byte(data)); err == nil {
+			t.Errorf("%q: expected an error, got %#v", data, v)
+		}
+	}
+}
+
+func TestParsePickle(t *testing.T) {
+	ps, err := parsePickle([]byte(pickleCases[0].data), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []graphitePoint{
+		{name: "a.b", value: 1.5, ts: 1700000000},
+		{name: "c", tags: []string{"x=1"}, value: 2, ts: 1700000000},
+	}
+	if !reflect.DeepEqual(ps, want) {
+		t.Errorf("got %+v", ps)
+	}
+
+	// 不是 [(path, (timestamp, value)), ...] 的数据
+	for _, data := range []string{
+		"K\x01.",
+		"](K\x01K\x02\x86e.",
+		"](X\x01\x00\x00\x00aK\x01\x86e.",
+		"](X\x01\x00\x00\x00aK\x01X\x01\x00\x00\x00b\x86\x86e.",
+		// 深度 60 的 ((x, x), (x, x)) 共享同一个对象, 展开打印需要 2^60 步
+		"](K\x01" + strings.Repeat("2\x86", 60) + "e.",
+	} {
+		if ps, err := parsePickle([]byte(data), 1); err == nil {
+			t.Errorf("%q: expected an error, got %+v", data, ps)
+		}
+	}
+}
+
+func TestParsePath(t *testing.T) {
+	for _, c := range []struct {
+		path string
+		name string
+		tags []string
+		ok   bool
+	}{
+		{"a.b.c", "a.b.c", nil, true},
+		{"a;z=1;b=2", "a", []string{"b=2", "z=1"}, true},
+		{"a;x=1=2", "a", []string{"x=1=2"}, true},
+		{"", "", nil, false},
+		{";x=1", "", nil, false},
+		{"a;", "", nil, false},
+		{"a;x", "", nil, false},
+		{"a;=1", "", nil, false},
+		{"a;x=", "", nil, false},
+	} {
+		name, tags, err := parsePath(c.path)
+		if (err == nil) != c.ok {
+			t.Errorf("%q: got error %v", c.path, err)
+			continue
+		}
+		if name != c.name || !reflect.DeepEqual(tags, c.tags) {
+			t.Errorf("%q: got %q %q, want %q %q", c.path, name, tags, c.name, c.tags)
+		}
+	}
+}
+
+func TestParsePlaintext(t *testing.T) {
+	for _, c := range []struct {
+		line string
+		want graphitePoint
+		ok   bool
+	}{
+		{"a.b 1.5 100", graphitePoint{name: "a.b", value: 1.5, ts: 100}, true},
+		{"a.b 1.5", graphitePoint{name: "a.b", value: 1.5, ts: 7}, true},
+		{"a.b 1.5 -1", graphitePoint{name: "a.b", value: 1.5, ts: 7}, true},
+		{"a;h=x 2 100.9", graphitePoint{name: "a", tags: []string{"h=x"}, value: 2, ts: 100}, true},
+		{"a.b", graphitePoint{}, false},
+		{"a.b 1 2 3", graphitePoint{}, false},
+		{"a.b x 100", graphitePoint{}, false},
+		{"a.b NaN 100", graphitePoint{}, false},
+		{"a.b 1 -5", graphitePoint{}, false},
+	} {
+		p, err := parsePlaintext(c.line, 7)
+		if (err == nil) != c.ok {
+			t.Errorf("%q: got error %v", c.line, err)
+			continue
+		}
+		if c.ok && !reflect.DeepEqual(p, c.want) {
+			t.Errorf("%q: got %+v, want %+v", c.line, p, c.want)
+		}
+	}
+}
+
+func FuzzUnpickle(f *testing.F) {
+	for _, c := range pickleCases {
+		f.Add([]byte(c.data))
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		// 任意输入都不能 panic 或者死循环
+		unpickle(data)
+		parsePickle(data, 1)
+	})
+}
@@ -1,6 +1,36 @@
 package receivers
 
+import (
+	"io"
+	"strings"
+)
+
 type Receiver interface {
 	Start()
 	Stop()
 }
+
+// Repeater receives every raw packet before it is queued for aggregation,
+// Repeat must not block and must not modify the packet.
+type Repeater interface {
+	Repeat(packet []byte)
+}
+
+// Stat records the self-metrics of a receiver, statsd.BaseStat implements it.
+type Stat interface {
+	CounterInc(key string, i interface{})
+	GaugeInc(key string, i interface{})
+	GaugeDec(key string, i interface{})
+}
+
+type nopStat struct{}
+
+func (nopStat) CounterInc(key string, i interface{}) {}
+func (nopStat) GaugeInc(key string, i interface{})   {}
+func (nopStat) GaugeDec(key string, i interface{})   {}
+
+// isClosed tells whether err only means that the peer or Stop closed the
+// connection.
+func isClosed(err error) bool {
+	return err == io.EOF || strings.Contains(err.Error(), "use of closed network connection")
+}
@@ -0,0 +1,192 @@
+package receivers
+
+import (
+	"bufio"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/coder-van/v-util/log"
+)
+
+/*
+ tcp 和 unix stream 共用的按行读取逻辑
+ 连接上的数据按 \n 分行, 连续读到的多行合并成一个数据包放入 PacketInChannel
+ 超过 MaxLineBytes 的行被丢弃, 直到下一个 \n; IdleTimeout 内没有数据的连接被关闭
+ 和 udp 不同, 队列满时阻塞读取, 由流控让客户端变慢, 而不是丢弃数据
+ self-metrics(前缀 statsd.<name>.):
+ connections: 当前连接数
+ accepted: 累计接受的连接数
+ errors.line_too_long, errors.idle_timeout, errors.read, errors.accept: 各类错误数
+*/
+const (
+	DefaultMaxLineBytes = 64 * 1024
+	DefaultIdleTimeout  = 5 * time.Minute
+	// 合并后的数据包不超过 maxPacketBytes
+	maxPacketBytes = 64 * 1024
+)
+
+type stream struct {
+	MaxLineBytes int
+	IdleTimeout  time.Duration
+
+	// name 是 self-metrics 和日志中使用的名字, 例如 tcp
+	name            string
+	packetInChannel chan []byte
+	repeater        Repeater
+	stat            Stat
+	// tagger 返回需要附加到这个连接上每一行的 tags, 为空时不修改
+	tagger   func(c net.Conn) []byte
+	exit     chan bool
+	listener net.Listener
+	logger   *log.Vlogger
+
+	mu    sync.Mutex
+	conns map[net.Conn]bool
+	wg    sync.WaitGroup
+}
+
+func newStream(name string, ch chan []byte, logger *log.Vlogger) stream {
+	return stream{
+		MaxLineBytes:    DefaultMaxLineBytes,
+		IdleTimeout:     DefaultIdleTimeout,
+		name:            name,
+		packetInChannel: ch,
+		stat:            nopStat{},
+		exit:            make(chan bool),
+		conns:           make(map[net.Conn]bool),
+		logger:          logger,
+	}
+}
+
+// SetRepeater forwards every received packet to r as well.
+func (s *stream) SetRepeater(r Repeater) {
+	s.repeater = r
+}
+
+// SetStat sets where the self-metrics are recorded.
+func (s *stream) SetStat(stat Stat) {
+	s.stat = stat
+}
+
+// serve accepts connections until stop and runs handle for each of them in
+// its own goroutine, s.listener must be l.
+func (s *stream) serve(l net.Listener, handle func(c net.Conn)) {
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			select {
+			case <-s.exit:
+				return
+			default:
+			}
+			s.stat.CounterInc(s.name+".errors.accept", 1)
+			s.logger.Printf("ERROR: failed to accept %s connection, %s", s.name, err)
+			time.Sleep(100 * time.Millisecond)
+			continue
+		}
+		// 和 stop 在同一把锁下检查 exit, 保证 wg.Add 不会发生在 stop 的 wg.Wait 之后
+		s.mu.Lock()
+		select {
+		case <-s.exit:
+			s.mu.Unlock()
+			c.Close()
+			return
+		default:
+		}
+		s.conns[c] = true
+		s.wg.Add(1)
+		s.mu.Unlock()
+		s.stat.CounterInc(s.name+".accepted", 1)
+		s.stat.GaugeInc(s.name+".connections", 1)
+
+		go func() {
+			defer s.release(c)
+			handle(c)
+		}()
+	}
+}
+
+func (s *stream) release(c net.Conn) {
+	c.Close()
+	s.mu.Lock()
+	delete(s.conns, c)
+	s.mu.Unlock()
+	s.stat.GaugeDec(s.name+".connections", 1)
+	s.wg.Done()
+}
+
+// handle reads statsd lines from c.
+func (s *stream) handle(c net.Conn) {
+	var tags []byte
+	if s.tagger != nil {
+		tags = s.tagger(c)
+	}
+	r := bufio.NewReaderSize(c, s.MaxLineBytes)
+	var packet []byte
+	tooLong := false
+	for {
+		c.SetReadDeadline(time.Now().Add(s.IdleTimeout))
+		line, err := r.ReadSlice('\n')
+		switch {
+		case err == bufio.ErrBufferFull:
+			// 丢弃这一行剩下的部分
+			if !tooLong {
+				s.stat.CounterInc(s.name+".errors.line_too_long", 1)
+			}
+			tooLong = true
+			continue
+		case tooLong:
+			tooLong = false
+		case len(line) == 0:
+		case len(tags) > 0:
+			packet = appendTags(packet, line, tags)
+		default:
+			packet = append(packet, line...)
+		}
+		// 缓冲区里没有更多数据, 或者数据包足够大时发送
+		if len(packet) > 0 && (r.Buffered() == 0 || len(packet) >= maxPacketBytes || err != nil) {
+			if !s.push(packet) {
+				return
+			}
+			packet = nil
+		}
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				s.stat.CounterInc(s.name+".errors.idle_timeout", 1)
+			} else if !isClosed(err) {
+				s.stat.CounterInc(s.name+".errors.read", 1)
+				s.logger.Printf("ERROR: failed to read %s connection, %s", s.name, err)
+			}
+			return
+		}
+	}
+}
+
+// push queues packet, it returns false when the receiver is stopping.
+func (s *stream) push(packet []byte) bool {
+	if s.repeater != nil {
+		s.repeater.Repeat(packet)
+	}
+	select {
+	case s.packetInChannel <- packet:
+		return true
+	case <-s.exit:
+		return false
+	}
+}
+
+// stop closes the listener and every connection and waits for them.
+func (s *stream) stop() {
+	if s.listener == nil {
+		return
+	}
+	s.mu.Lock()
+	close(s.exit)
+	for c := range s.conns {
+		c.Close()
+	}
+	s.mu.Unlock()
+	s.listener.Close()
+	s.wg.Wait()
+}
@@ -0,0 +1,133 @@
+package receivers
+
+import (
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/coder-van/v-util/log"
+)
+
+type countStat struct {
+	mu     sync.Mutex
+	counts map[string]int
+}
+
+func newCountStat() *countStat {
+	return &countStat{counts: make(map[string]int)}
+}
+
+func (s *countStat) add(key string, i interface{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.counts[key] += i.(int)
+}
+
+func (s *countStat) get(key string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.counts[key]
+}
+
+func (s *countStat) CounterInc(key string, i interface{}) { s.add(key, i) }
+func (s *countStat) GaugeInc(key string, i interface{})   { s.add(key, i) }
+func (s *countStat) GaugeDec(key string, i interface{})   { s.add(key, -i.(int)) }
+
+func newTestStream() (*stream, *countStat, chan []byte) {
+	ch := make(chan []byte, 100)
+	s := newStream("tcp", ch, log.GetLogger("statsd.TcpReceiver", log.RotateModeMonth))
+	stat := newCountStat()
+	s.stat = stat
+	return &s, stat, ch
+}
+
+// readAll runs handle on one end of a pipe while write feeds the other one,
+// it returns the received packets joined together.
+func readAll(s *stream, ch chan []byte, write func(c net.Conn)) string {
+	server, client := net.Pipe()
+	go func() {
+		write(client)
+		client.Close()
+	}()
+	s.handle(server)
+	server.Close()
+	close(ch)
+	var b strings.Builder
+	for p := range ch {
+		b.Write(p)
+	}
+	return b.String()
+}
+
+func TestStreamPartialLastLine(t *testing.T) {
+	s, stat, ch := newTestStream()
+	got := readAll(s, ch, func(c net.Conn) {
+		c.Write([]byte("a:1|c\nb:2"))
+		c.Write([]byte("|c"))
+	})
+	if got != "a:1|c\nb:2|c" {
+		t.Fatalf("got %q", got)
+	}
+	if n := stat.get("tcp.errors.read"); n != 0 {
+		t.Errorf("got %d read errors", n)
+	}
+}
+
+func TestStreamLineTooLong(t *testing.T) {
+	s, stat, ch := newTestStream()
+	s.MaxLineBytes = 16
+	got := readAll(s, ch, func(c net.Conn) {
+		c.Write([]byte("a:1|c\n"))
+		c.Write([]byte(strings.Repeat("x", 40) + ":1|c\n"))
+		c.Write([]byte("b:2|c\n"))
+	})
+	if got != "a:1|c\nb:2|c\n" {
+		t.Fatalf("got %q", got)
+	}
+	if n := stat.get("tcp.errors.line_too_long"); n != 1 {
+		t.Errorf("got %d line_too_long errors, want 1", n)
+	}
+}
+
+func TestStreamIdleTimeout(t *testing.T) {
+	s, stat, ch := newTestStream()
+	s.IdleTimeout = 20 * time.Millisecond
+	done := make(chan bool)
+	got := readAll(s, ch, func(c net.Conn) {
+		c.Write([]byte("a:1|c\n"))
+		<-done
+	})
+	close(done)
+	if got != "a:1|c\n" {
+		t.Fatalf("got %q", got)
+	}
+	if n := stat.get("tcp.errors.idle_timeout"); n != 1 {
+		t.Errorf("got %d idle_timeout errors, want 1", n)
+	}
+}
+
+func TestStreamStop(t *testing.T) {
+	s, stat, ch := newTestStream()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.listener = l
+	go s.serve(l, s.handle)
+
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.Write([]byte("a:1|c\n"))
+	if p := <-ch; string(p) != "a:1|c\n" {
+		t.Fatalf("got %q", p)
+	}
+	s.stop()
+	if n := stat.get("tcp.connections"); n != 0 {
+		t.Errorf("%d connections left after stop", n)
+	}
+}
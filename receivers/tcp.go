@@ -0,0 +1,39 @@
+package receivers
+
+import (
+	"net"
+
+	"github.com/coder-van/v-util/log"
+)
+
+// TcpReceiver reads newline framed statsd lines over tcp, see stream.go.
+// Its self-metrics are prefixed with statsd.tcp.
+func NewTcpReceiver(addr string, ch chan []byte) *TcpReceiver {
+	return &TcpReceiver{
+		Addr:   addr,
+		stream: newStream("tcp", ch, log.GetLogger("statsd.TcpReceiver", log.RotateModeMonth)),
+	}
+}
+
+type TcpReceiver struct {
+	Addr string
+	stream
+}
+
+func (tcp *TcpReceiver) Start() {
+	tcp.logger.Println("Statsd TcpReceiver starting")
+	l, err := net.Listen("tcp", tcp.Addr)
+	if err != nil {
+		tcp.logger.Printf("ERROR: tcp listening on %s, %s", tcp.Addr, err)
+		return
+	}
+	tcp.listener = l
+	tcp.logger.Println("Statsd TcpReceiver listening on:", l.Addr())
+	go tcp.serve(l, tcp.handle)
+}
+
+func (tcp *TcpReceiver) Stop() {
+	tcp.logger.Println("Statsd TcpReceiver stoping")
+	tcp.stop()
+	tcp.logger.Println("Statsd TcpReceiver stoped")
+}
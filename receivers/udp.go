@@ -25,9 +25,15 @@ type UdpReceiver struct {
 	Addr            string
 	drops           int // drops tracks the number of dropped metrics.
 	packetInChannel chan []byte
+	repeater        Repeater
 	logger          *log.Vlogger
 }
 
+// SetRepeater forwards every received packet to r as well.
+func (udp *UdpReceiver) SetRepeater(r Repeater) {
+	udp.repeater = r
+}
+
 func (udp *UdpReceiver) listen(shutdown chan bool) {
 	defer close(shutdown)
 
@@ -71,6 +77,9 @@ func (udp *UdpReceiver) handle(conn *net.UDPConn) {
 
 	bufCopy := make([]byte, n)
 	copy(bufCopy, buf[:n])
+	if udp.repeater != nil {
+		udp.repeater.Repeat(bufCopy)
+	}
 
 	select {
 	case udp.packetInChannel <- bufCopy:
@@ -0,0 +1,364 @@
+package receivers
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/coder-van/v-stats/parser"
+	"github.com/coder-van/v-util/log"
+)
+
+/*
+ unix socket 上的 receiver, 同一台机器上的容器通过共享的 socket 文件发送, 不会像 loopback 上的 udp 一样丢包
+ UnixStreamReceiver: SOCK_STREAM, 按行读取, 和 tcp 相同(见 stream.go), self-metrics 前缀 statsd.unix.
+ UnixgramReceiver: SOCK_DGRAM, 一个数据报是一个数据包, 和 udp 相同
+ 启动时如果 socket 文件已经存在并且没有进程在监听, 认为是上次退出时遗留的, 删除后重新创建
+ PeerCred 为 true 时读取发送方的 pid, uid 和 cgroup, 作为 tags 加到每一行上:
+ name:1|c -> name:1|c|#pid=123,uid=0,cgroup=/docker/abc
+ 客户端自己带的 pid, uid 和 cgroup tag 被去掉, 否则可以冒充其他进程
+ 只在 linux 上支持, 见 peercred_linux.go
+*/
+
+// listenUnix removes a stale socket file at path, listens on it and sets
+// its permissions to mode.
+func listenUnix(network, path string, mode os.FileMode) (net.Listener, net.PacketConn, error) {
+	if err := removeStale(network, path); err != nil {
+		return nil, nil, err
+	}
+	var l net.Listener
+	var pc net.PacketConn
+	var err error
+	if network == "unix" {
+		l, err = net.Listen(network, path)
+	} else {
+		pc, err = net.ListenPacket(network, path)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := os.Chmod(path, mode); err != nil {
+		if l != nil {
+			l.Close()
+		} else {
+			pc.Close()
+			os.Remove(path)
+		}
+		return nil, nil, err
+	}
+	return l, pc, nil
+}
+
+func removeStale(network, path string) error {
+	fi, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if fi.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("%s exists and is not a socket", path)
+	}
+	if c, err := net.DialTimeout(network, path, time.Second); err == nil {
+		c.Close()
+		return fmt.Errorf("%s is in use by another process", path)
+	}
+	return os.Remove(path)
+}
+
+// ParseSocketMode parses an octal permission string such as "0666".
+func ParseSocketMode(s string) (os.FileMode, error) {
+	m, err := strconv.ParseUint(s, 8, 32)
+	if err != nil || m > 0777 {
+		return 0, fmt.Errorf("invalid socket mode %q", s)
+	}
+	return os.FileMode(m), nil
+}
+
+func NewUnixStreamReceiver(path string, mode os.FileMode, ch chan []byte) *UnixStreamReceiver {
+	return &UnixStreamReceiver{
+		Path:   path,
+		Mode:   mode,
+		stream: newStream("unix", ch, log.GetLogger("statsd.UnixStreamReceiver", log.RotateModeMonth)),
+	}
+}
+
+type UnixStreamReceiver struct {
+	Path string
+	Mode os.FileMode
+	// PeerCred tags every line with the pid, uid and cgroup of the sender
+	PeerCred bool
+	stream
+	creds credTags
+}
+
+func (u *UnixStreamReceiver) Start() {
+	u.logger.Println("Statsd UnixStreamReceiver starting")
+	l, _, err := listenUnix("unix", u.Path, u.Mode)
+	if err != nil {
+		u.logger.Printf("ERROR: unix listening on %s, %s", u.Path, err)
+		return
+	}
+	if u.PeerCred {
+		u.tagger = u.connTags
+	}
+	u.listener = l
+	u.logger.Println("Statsd UnixStreamReceiver listening on:", u.Path)
+	go u.serve(l, u.handle)
+}
+
+func (u *UnixStreamReceiver) connTags(c net.Conn) []byte {
+	uc, ok := c.(*net.UnixConn)
+	if !ok {
+		return nil
+	}
+	pid, uid, err := streamPeerCred(uc)
+	if err != nil {
+		u.stat.CounterInc("unix.errors.peer_cred", 1)
+		return nil
+	}
+	return u.creds.get(pid, uid)
+}
+
+func (u *UnixStreamReceiver) Stop() {
+	u.logger.Println("Statsd UnixStreamReceiver stoping")
+	// 关闭 listener 时会删除 socket 文件
+	u.stop()
+	u.logger.Println("Statsd UnixStreamReceiver stoped")
+}
+
+func NewUnixgramReceiver(path string, mode os.FileMode, ch chan []byte) *UnixgramReceiver {
+	return &UnixgramReceiver{
+		Path:            path,
+		Mode:            mode,
+		packetInChannel: ch,
+		stat:            nopStat{},
+		exit:            make(chan bool),
+		logger:          log.GetLogger("statsd.UnixgramReceiver", log.RotateModeMonth),
+	}
+}
+
+type UnixgramReceiver struct {
+	Path string
+	Mode os.FileMode
+	// PeerCred tags every line with the pid, uid and cgroup of the sender
+	PeerCred bool
+
+	packetInChannel chan []byte
+	repeater        Repeater
+	stat            Stat
+	exit            chan bool
+	conn            *net.UnixConn
+	creds           credTags
+	logger          *log.Vlogger
+}
+
+// SetRepeater forwards every received packet to r as well.
+func (u *UnixgramReceiver) SetRepeater(r Repeater) {
+	u.repeater = r
+}
+
+// SetStat sets where the self-metrics are recorded.
+func (u *UnixgramReceiver) SetStat(stat Stat) {
+	u.stat = stat
+}
+
+func (u *UnixgramReceiver) Start() {
+	u.logger.Println("Statsd UnixgramReceiver starting")
+	_, pc, err := listenUnix("unixgram", u.Path, u.Mode)
+	if err != nil {
+		u.logger.Printf("ERROR: unixgram listening on %s, %s", u.Path, err)
+		return
+	}
+	u.conn = pc.(*net.UnixConn)
+	if u.PeerCred {
+		if err := enablePassCred(u.conn); err != nil {
+			u.logger.Printf("ERROR: unixgram peer credentials disabled, %s", err)
+			u.PeerCred = false
+		}
+	}
+	u.logger.Println("Statsd UnixgramReceiver listening on:", u.Path)
+	go u.listen()
+}
+
+func (u *UnixgramReceiver) listen() {
+	buf := make([]byte, UDPMaxPacketSize)
+	oob := make([]byte, credOOBSize)
+	for {
+		n, oobn, _, _, err := u.conn.ReadMsgUnix(buf, oob)
+		if err != nil {
+			select {
+			case <-u.exit:
+				return
+			default:
+			}
+			u.stat.CounterInc("unixgram.errors.read", 1)
+			u.logger.Error("ERROR: failed to read unixgram msg because of ", err.Error())
+			continue
+		}
+		if n == 0 {
+			continue
+		}
+
+		var packet []byte
+		if u.PeerCred {
+			pid, uid, err := parsePassCred(oob[:oobn])
+			if err != nil {
+				u.stat.CounterInc("unixgram.errors.peer_cred", 1)
+			} else {
+				packet = tagPacket(buf[:n], u.creds.get(pid, uid))
+			}
+		}
+		if packet == nil {
+			packet = make([]byte, n)
+			copy(packet, buf[:n])
+		}
+		if u.repeater != nil {
+			u.repeater.Repeat(packet)
+		}
+
+		select {
+		case u.packetInChannel <- packet:
+		default:
+			u.stat.CounterInc("unixgram.drops", 1)
+		}
+	}
+}
+
+func (u *UnixgramReceiver) Stop() {
+	u.logger.Println("Statsd UnixgramReceiver stoping")
+	if u.conn == nil {
+		return
+	}
+	close(u.exit)
+	u.conn.Close()
+	os.Remove(u.Path)
+	u.logger.Println("Statsd UnixgramReceiver stoped")
+}
+
+// credTags caches the tags of a sender, reading /proc/<pid>/cgroup for every
+// packet would be too slow. The cache is cleared every minute as pids are
+// reused.
+type credTags struct {
+	mu      sync.Mutex
+	tags    map[[2]int][]byte
+	cleared time.Time
+}
+
+func (ct *credTags) get(pid, uid int) []byte {
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+	if ct.tags == nil || time.Since(ct.cleared) > time.Minute {
+		ct.tags = make(map[[2]int][]byte)
+		ct.cleared = time.Now()
+	}
+	k := [2]int{pid, uid}
+	if t, ok := ct.tags[k]; ok {
+		return t
+	}
+	t := []byte("pid=" + strconv.Itoa(pid) + ",uid=" + strconv.Itoa(uid))
+	if cg := cgroupOf(pid); cg != "" {
+		t = append(t, ",cgroup="...)
+		t = append(t, sanitizeTagValue(cg)...)
+	}
+	ct.tags[k] = t
+	return t
+}
+
+// sanitizeTagValue replaces the characters that separate lines, sections,
+// fields and tags.
+func sanitizeTagValue(s string) string {
+	b := []byte(s)
+	for i, c := range b {
+		switch c {
+		case ':', '|', ',', '#', '\n', ' ', '\t':
+			b[i] = '_'
+		}
+	}
+	return string(b)
+}
+
+// tagPacket appends tags to every line of packet.
+func tagPacket(packet, tags []byte) []byte {
+	out := make([]byte, 0, len(packet)+len(packet)/8+len(tags))
+	for len(packet) > 0 {
+		var line []byte
+		if i := bytes.IndexByte(packet, '\n'); i >= 0 {
+			line, packet = packet[:i+1], packet[i+1:]
+		} else {
+			line, packet = packet, nil
+		}
+		out = appendTags(out, line, tags)
+	}
+	return out
+}
+
+// appendTags appends line to dst with tags added to each of its sections,
+// either merged into an existing "#" field or as a new one. Tags of the line
+// with the same name as one of tags are dropped.
+func appendTags(dst, line, tags []byte) []byte {
+	line = bytes.TrimRight(line, "\r\n")
+	i := bytes.IndexByte(line, ':')
+	if len(bytes.TrimSpace(line)) == 0 || i < 0 {
+		// 空行和格式错误的行原样保留, 由 parser 报错
+		dst = append(dst, line...)
+		return append(dst, '\n')
+	}
+	dst = append(dst, line[:i+1]...)
+	rest := line[i+1:]
+	for {
+		sec := rest
+		end := bytes.IndexByte(rest, ':')
+		if end >= 0 {
+			sec = rest[:end]
+		}
+		if j := bytes.Index(sec, []byte("|#")); j >= 0 {
+			tagEnd := len(sec)
+			if k := bytes.IndexByte(sec[j+2:], '|'); k >= 0 {
+				tagEnd = j + 2 + k
+			}
+			dst = append(dst, sec[:j+2]...)
+			for tag, more := parser.NextTag(sec[j+2 : tagEnd]); tag != nil; tag, more = parser.NextTag(more) {
+				if hasTag(tags, tagName(tag)) {
+					continue
+				}
+				dst = append(dst, tag...)
+				dst = append(dst, ',')
+			}
+			dst = append(dst, tags...)
+			dst = append(dst, sec[tagEnd:]...)
+		} else {
+			dst = append(dst, sec...)
+			dst = append(dst, "|#"...)
+			dst = append(dst, tags...)
+		}
+		if end < 0 {
+			break
+		}
+		dst = append(dst, ':')
+		rest = rest[end+1:]
+	}
+	return append(dst, '\n')
+}
+
+func tagName(tag []byte) []byte {
+	if i := bytes.IndexByte(tag, '='); i >= 0 {
+		return tag[:i]
+	}
+	return tag
+}
+
+// hasTag tells whether the tag list tags has a tag called name.
+func hasTag(tags, name []byte) bool {
+	for tag, more := parser.NextTag(tags); tag != nil; tag, more = parser.NextTag(more) {
+		if bytes.Equal(tagName(tag), name) {
+			return true
+		}
+	}
+	return false
+}
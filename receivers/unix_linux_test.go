@@ -0,0 +1,80 @@
+package receivers
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// ownTags are the tags the receivers add to lines sent by this process.
+func ownTags() string {
+	return "pid=" + strconv.Itoa(os.Getpid()) + ",uid=" + strconv.Itoa(os.Getuid())
+}
+
+func TestUnixStreamPeerCred(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "s.sock")
+	ch := make(chan []byte, 10)
+	u := NewUnixStreamReceiver(path, 0666, ch)
+	u.PeerCred = true
+	u.Start()
+	defer u.Stop()
+
+	c, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.Write([]byte("a:1|c|#pid=1,env=prod\n"))
+	got := receive(t, ch)
+	if want := "a:1|c|#env=prod," + ownTags(); !strings.HasPrefix(got, want) {
+		t.Errorf("got %q, want it to start with %q", got, want)
+	}
+}
+
+func TestUnixgramPeerCred(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "s.sock")
+	ch := make(chan []byte, 10)
+	u := NewUnixgramReceiver(path, 0666, ch)
+	u.PeerCred = true
+	u.Start()
+	defer u.Stop()
+	if !u.PeerCred {
+		t.Fatal("SO_PASSCRED could not be enabled")
+	}
+
+	c, err := net.Dial("unixgram", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.Write([]byte("a:1|c\nb:2|g|#uid=12345"))
+	got := receive(t, ch)
+	lines := strings.Split(strings.TrimSuffix(got, "\n"), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("got %q", got)
+	}
+	for i, prefix := range []string{"a:1|c|#", "b:2|g|#"} {
+		if want := prefix + ownTags(); !strings.HasPrefix(lines[i], want) {
+			t.Errorf("got %q, want it to start with %q", lines[i], want)
+		}
+	}
+}
+
+func TestCredTagsCgroup(t *testing.T) {
+	var ct credTags
+	tags := string(ct.get(os.Getpid(), os.Getuid()))
+	if cg := cgroupOf(os.Getpid()); cg != "" {
+		if want := ownTags() + ",cgroup=" + sanitizeTagValue(cg); tags != want {
+			t.Errorf("got %q, want %q", tags, want)
+		}
+	} else if tags != ownTags() {
+		t.Errorf("got %q, want %q", tags, ownTags())
+	}
+	// 进程已经不存在时没有 cgroup
+	if cgroupOf(1<<22+1) != "" {
+		t.Error("got a cgroup for a pid that doesn't exist")
+	}
+}
@@ -0,0 +1,208 @@
+package receivers
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coder-van/v-stats/parser"
+)
+
+func TestAppendTags(t *testing.T) {
+	tags := []byte("pid=1,uid=0")
+	tests := []struct {
+		line, want string
+	}{
+		{"a:1|c", "a:1|c|#pid=1,uid=0\n"},
+		{"a:1|c\r\n", "a:1|c|#pid=1,uid=0\n"},
+		{"a:1|c|@0.5", "a:1|c|@0.5|#pid=1,uid=0\n"},
+		{"a:1|c|#env=prod", "a:1|c|#env=prod,pid=1,uid=0\n"},
+		{"a:1|c|#env=prod|@0.5", "a:1|c|#env=prod,pid=1,uid=0|@0.5\n"},
+		{"a:1|c|#", "a:1|c|#pid=1,uid=0\n"},
+		{"a:1|c|#env=prod,,", "a:1|c|#env=prod,pid=1,uid=0\n"},
+		// 每个 section 都加上 tags
+		{"a:1|c:2|ms|#x=y:3|g|T10", "a:1|c|#pid=1,uid=0:2|ms|#x=y,pid=1,uid=0:3|g|T10|#pid=1,uid=0\n"},
+		// 客户端带的同名 tag 被替换
+		{"a:1|c|#pid=999,env=prod,uid=5", "a:1|c|#env=prod,pid=1,uid=0\n"},
+		{"a:1|c|#pid,uid=", "a:1|c|#pid=1,uid=0\n"},
+		{"a:1|c|#pidx=2", "a:1|c|#pidx=2,pid=1,uid=0\n"},
+		// 格式错误的行原样保留
+		{"", "\n"},
+		{"garbage", "garbage\n"},
+	}
+	var ms []parser.ParsedMetric
+	for _, tt := range tests {
+		got := string(appendTags(nil, []byte(tt.line), tags))
+		if got != tt.want {
+			t.Errorf("appendTags(%q) = %q, want %q", tt.line, got, tt.want)
+			continue
+		}
+		if !strings.Contains(tt.line, ":") {
+			continue
+		}
+		line, _ := parser.NextLine([]byte(got))
+		var err error
+		ms, err = parser.ParseLine(line, ms[:0])
+		if err != nil {
+			t.Errorf("%q doesn't parse, %s", got, err)
+			continue
+		}
+		for _, m := range ms {
+			if n := strings.Count(string(m.Tags), "pid="); n != 1 {
+				t.Errorf("%q has %d pid tags", got, n)
+			}
+		}
+	}
+}
+
+func TestTagPacket(t *testing.T) {
+	got := string(tagPacket([]byte("a:1|c\n\nb:2|g|#x=y\nc:3|ms"), []byte("pid=1")))
+	want := "a:1|c|#pid=1\n\nb:2|g|#x=y,pid=1\nc:3|ms|#pid=1\n"
+	if got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestSanitizeTagValue(t *testing.T) {
+	got := sanitizeTagValue("/docker/a:b|c,d#e f\tg\nh")
+	if want := "/docker/a_b_c_d_e_f_g_h"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestParseSocketMode(t *testing.T) {
+	for s, want := range map[string]os.FileMode{"0666": 0666, "600": 0600, "0": 0} {
+		if m, err := ParseSocketMode(s); err != nil || m != want {
+			t.Errorf("ParseSocketMode(%q) = %o, %v", s, m, err)
+		}
+	}
+	for _, s := range []string{"", "0888", "01777", "rw"} {
+		if _, err := ParseSocketMode(s); err == nil {
+			t.Errorf("ParseSocketMode(%q) succeeded", s)
+		}
+	}
+}
+
+func TestListenUnixMode(t *testing.T) {
+	dir := t.TempDir()
+	for _, network := range []string{"unix", "unixgram"} {
+		path := filepath.Join(dir, network+".sock")
+		l, pc, err := listenUnix(network, path, 0620)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fi, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fi.Mode().Perm() != 0620 || fi.Mode()&os.ModeSocket == 0 {
+			t.Errorf("%s: socket mode is %s, want 0620", network, fi.Mode())
+		}
+		if l != nil {
+			l.Close()
+		} else {
+			pc.Close()
+		}
+	}
+}
+
+func TestRemoveStale(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "s.sock")
+
+	// 上次退出时没有删除的 socket 文件
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.(*net.UnixListener).SetUnlinkOnClose(false)
+	l.Close()
+	if _, err := os.Stat(path); err != nil {
+		t.Fatal("the stale socket was removed on close")
+	}
+	l, _, err = listenUnix("unix", path, 0666)
+	if err != nil {
+		t.Fatalf("listening over a stale socket, %s", err)
+	}
+	defer l.Close()
+
+	// 有进程在监听的 socket 不能删除
+	if _, _, err := listenUnix("unix", path, 0666); err == nil || !strings.Contains(err.Error(), "in use") {
+		t.Errorf("listening over a live socket got %v", err)
+	}
+	if c, err := net.Dial("unix", path); err != nil {
+		t.Errorf("the live socket is gone, %s", err)
+	} else {
+		c.Close()
+	}
+
+	// 不是 socket 的文件不删除
+	file := filepath.Join(dir, "file")
+	if err := ioutil.WriteFile(file, []byte("x"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := listenUnix("unixgram", file, 0666); err == nil || !strings.Contains(err.Error(), "not a socket") {
+		t.Errorf("listening over a regular file got %v", err)
+	}
+	if _, err := os.Stat(file); err != nil {
+		t.Error("the regular file was removed")
+	}
+}
+
+func receive(t *testing.T, ch chan []byte) string {
+	select {
+	case p := <-ch:
+		return string(p)
+	case <-time.After(time.Second):
+		t.Fatal("no packet received")
+		return ""
+	}
+}
+
+func TestUnixStreamReceiver(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "s.sock")
+	ch := make(chan []byte, 10)
+	u := NewUnixStreamReceiver(path, 0666, ch)
+	u.Start()
+
+	c, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Write([]byte("a:1|c\n"))
+	if got := receive(t, ch); got != "a:1|c\n" {
+		t.Errorf("got %q", got)
+	}
+	c.Close()
+
+	u.Stop()
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Error("the socket file is left after Stop")
+	}
+}
+
+func TestUnixgramReceiver(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "s.sock")
+	ch := make(chan []byte, 10)
+	u := NewUnixgramReceiver(path, 0666, ch)
+	u.Start()
+
+	c, err := net.Dial("unixgram", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.Write([]byte("a:1|c\nb:2|g"))
+	if got := receive(t, ch); got != "a:1|c\nb:2|g" {
+		t.Errorf("got %q", got)
+	}
+
+	u.Stop()
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Error("the socket file is left after Stop")
+	}
+}
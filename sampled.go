@@ -0,0 +1,72 @@
+package statsd
+
+import (
+	"sync"
+	"time"
+
+	"github.com/coder-van/v-stats/metrics"
+)
+
+/*
+ 客户端以 @<rate> 声明采样率, 例如 0.1 表示只上报了十分之一的事件
+ counter 的增量按 1/rate 放大, timer 的每个样本按 1/rate 计权,
+ 使得 flush 出去的 count 和 rate 反映真实的事件量, rate 的解析和校验见 parser 包
+*/
+
+// sampleCount scales a sampled counter increment back to the real one.
+func sampleCount(value float64, rate float64) int64 {
+	v := value / rate
+	if v < 0 {
+		return int64(v - 0.5)
+	}
+	return int64(v + 0.5)
+}
+
+func newSampledTimer() *sampledTimer {
+	return &sampledTimer{Timer: metrics.NewTimer()}
+}
+
+// sampledTimer is a metrics.Timer that also tracks the event count
+// weighted by each sample's 1/rate.
+type sampledTimer struct {
+	metrics.Timer
+	mu       sync.Mutex
+	weighted float64
+}
+
+func (t *sampledTimer) Update(d time.Duration) {
+	t.UpdateSampled(d, 1)
+}
+
+func (t *sampledTimer) UpdateSampled(d time.Duration, rate float64) {
+	t.Timer.Update(d)
+	t.mu.Lock()
+	t.weighted += 1 / rate
+	t.mu.Unlock()
+}
+
+// snapshot returns a read-only copy of the timer and its weighted count.
+func (t *sampledTimer) snapshot() *sampledTimer {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return &sampledTimer{Timer: t.Timer.Snapshot(), weighted: t.weighted}
+}
+
+// WeightedCount returns the estimated number of real events.
+func (t *sampledTimer) WeightedCount() int64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return int64(t.weighted + 0.5)
+}
+
+// Scale returns the ratio between the real and the received events, rates
+// computed from received samples are multiplied by it.
+func (t *sampledTimer) Scale() float64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	n := t.Timer.Count()
+	if n == 0 {
+		return 1
+	}
+	return t.weighted / float64(n)
+}
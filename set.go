@@ -0,0 +1,60 @@
+package statsd
+
+import (
+	"fmt"
+)
+
+/*
+ set 类型统计每个刷新周期内出现过的不同值的个数, flush 时输出 <name>.count 并清空
+ 默认精确计数, 对于高基数的 set 可以配置 set_mode = "hll" 使用 HyperLogLog 估算,
+ 内存占用固定为 2^precision 字节
+*/
+const (
+	SetModeExact = "exact"
+	SetModeHLL   = "hll"
+)
+
+type set interface {
+	Add(value []byte)
+	Count() int64
+	Clear()
+}
+
+// newSetFunc returns the constructor of sets for the given mode.
+func newSetFunc(mode string, precision uint8) (func() set, error) {
+	switch mode {
+	case "", SetModeExact:
+		return func() set { return newExactSet() }, nil
+	case SetModeHLL:
+		if precision < hllMinPrecision || precision > hllMaxPrecision {
+			return nil, fmt.Errorf("set hll precision %d out of range [%d, %d]",
+				precision, hllMinPrecision, hllMaxPrecision)
+		}
+		return func() set { return newHyperLogLog(precision) }, nil
+	default:
+		return nil, fmt.Errorf("unknown set mode %q", mode)
+	}
+}
+
+func newExactSet() *exactSet {
+	return &exactSet{values: make(map[string]struct{})}
+}
+
+type exactSet struct {
+	values map[string]struct{}
+}
+
+func (s *exactSet) Add(value []byte) {
+	// 已存在的值不分配
+	if _, ok := s.values[string(value)]; !ok {
+		s.values[string(value)] = struct{}{}
+	}
+}
+
+func (s *exactSet) Count() int64 {
+	return int64(len(s.values))
+}
+
+func (s *exactSet) Clear() {
+	s.values = make(map[string]struct{})
+}
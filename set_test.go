@@ -0,0 +1,66 @@
+package statsd
+
+import (
+	"math"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestSetCount(t *testing.T) {
+	for _, mode := range []string{SetModeExact, SetModeHLL} {
+		agg := newTestAggregator(2, mode)
+		stop := runShards(agg)
+		agg.HandlePackets([]byte("users:a|s\nusers:b|s\nusers:a|s\nusers:c|s|#x=1"))
+		values := flushValues(agg, 10*time.Second)
+		if values["users.count"] != 2 || values["users.count;x=1"] != 1 {
+			t.Errorf("%s: got %v", mode, values)
+		}
+		// set 每个周期清空
+		if _, ok := flushValues(agg, 10*time.Second)["users.count"]; ok {
+			t.Errorf("%s: the set was flushed again", mode)
+		}
+		stop()
+	}
+}
+
+func TestHyperLogLogError(t *testing.T) {
+	for _, precision := range []uint8{10, 12, 14, 16} {
+		h := newHyperLogLog(precision)
+		// 标准误差约为 1.04/sqrt(2^precision), 允许 3 倍
+		bound := 3 * 1.04 / math.Sqrt(float64(uint64(1)<<precision))
+		added := 0
+		for _, n := range []int{100, 1000, 10000, 100000} {
+			for ; added < n; added++ {
+				h.Add([]byte("value-" + strconv.Itoa(added)))
+			}
+			if e := math.Abs(float64(h.Count())-float64(n)) / float64(n); e > bound {
+				t.Errorf("precision %d: counted %d of %d, error %.3f over %.3f", precision, h.Count(), n, e, bound)
+			}
+		}
+		h.Clear()
+		if h.Count() != 0 {
+			t.Errorf("precision %d: got %d after Clear", precision, h.Count())
+		}
+	}
+}
+
+func TestNewSetFunc(t *testing.T) {
+	for _, c := range []struct {
+		mode      string
+		precision uint8
+		ok        bool
+	}{
+		{"", 0, true},
+		{SetModeExact, 0, true},
+		{SetModeHLL, hllMinPrecision, true},
+		{SetModeHLL, hllMaxPrecision, true},
+		{SetModeHLL, hllMinPrecision - 1, false},
+		{SetModeHLL, hllMaxPrecision + 1, false},
+		{"bloom", 14, false},
+	} {
+		if _, err := newSetFunc(c.mode, c.precision); (err == nil) != c.ok {
+			t.Errorf("%q %d: got error %v", c.mode, c.precision, err)
+		}
+	}
+}
@@ -0,0 +1,272 @@
+package statsd
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/coder-van/v-stats/hashing"
+	"github.com/coder-van/v-stats/metrics"
+	"github.com/coder-van/v-stats/parser"
+	"github.com/coder-van/v-util/log"
+)
+
+/*
+ 每个 shard 在独立的协程中解析和聚合分配给它的数据行, 同一个 metric 名字总是分配到同一个 shard,
+ 所以每个 series 只存在于一个 shard 中, 刷新时各 shard 的数据直接拼接即为完整的快照
+ 刷新标记和数据行走同一个队列, shard 收到标记时交出 counter 和 set 的 registry,
+ 同时复制一份 gauge 和 timer, 所有类型的数据都截止到同一时刻, flush 协程只读取这些副本
+*/
+const (
+	ShardQueueSize = 1024
+	// maxInterned 限制 intern 缓存的 key 数量, series 不断变化时缓存不会无限增长
+	maxInterned = 100000
+)
+
+func newShard(stat *BaseStat, newSet func() set, deleteIdleCounters bool, logger *log.Vlogger) *shard {
+	return &shard{
+		in:                 make(chan shardMsg, ShardQueueSize),
+		exit:               make(chan bool),
+		metricsRegister:    metrics.NewRegistry(),
+		intervalRegister:   metrics.NewRegistry(),
+		interned:           make(map[string]string),
+		stat:               stat,
+		newSet:             newSet,
+		deleteIdleCounters: deleteIdleCounters,
+		logger:             logger,
+	}
+}
+
+type shard struct {
+	in   chan shardMsg
+	exit chan bool
+	// gauge 和 timer 需要跨周期保留
+	metricsRegister metrics.Registry
+	// counter 和 set 只在一个刷新周期内有效, 每次刷新时整体换成新的 registry,
+	// 旧的交给 flush 协程输出, 接收数据不会因为刷新或 backend 阻塞而停顿.
+	intervalRegister metrics.Registry
+	stat             *BaseStat
+	newSet           func() set
+	// deleteIdleCounters 为 false 时, 出现过的 counter 在没有数据的周期也输出 0
+	deleteIdleCounters bool
+	logger             *log.Vlogger
+	// keys 和 interned 只在 shard 自己的协程中使用
+	keys     keyBuilder
+	interned map[string]string
+}
+
+// shardMsg carries either a batch of lines or a flush marker. Markers go
+// through the same queue so every line routed before the flush is counted
+// in the snapshot.
+type shardMsg struct {
+	lines [][]byte
+	swap  chan shardSnapshot
+}
+
+// shardSnapshot is what a shard hands to the flush goroutine.
+type shardSnapshot struct {
+	// interval 是换下来的 counter 和 set, 之后只由 flush 协程使用
+	interval metrics.Registry
+	// persistent 是 gauge 和 timer 在标记时刻的副本
+	persistent metrics.Registry
+}
+
+// shardIndex routes a metric line by the hash of its name.
+func shardIndex(line []byte, n int) int {
+	if n == 1 {
+		return 0
+	}
+	return int(hashing.Bytes(parser.Name(line)) % uint64(n))
+}
+
+func (sh *shard) run() {
+	defer close(sh.exit)
+	// 解析结果的缓存, 在各行之间复用
+	var ms []parser.ParsedMetric
+	for msg := range sh.in {
+		if msg.swap != nil {
+			msg.swap <- shardSnapshot{interval: sh.swap(), persistent: sh.snapshot()}
+			continue
+		}
+		for _, line := range msg.lines {
+			var err error
+			ms, err = parser.ParseLine(line, ms[:0])
+			if err != nil {
+				sh.onParseError(err)
+				continue
+			}
+			for i := range ms {
+				sh.update(&ms[i])
+			}
+		}
+	}
+}
+
+// swap replaces the interval registry with an empty one and returns the old one.
+// Unless idle counters are deleted, the counters of the old registry are
+// registered again at zero.
+func (sh *shard) swap() metrics.Registry {
+	r := sh.intervalRegister
+	sh.intervalRegister = metrics.NewRegistry()
+	if !sh.deleteIdleCounters {
+		r.Each(func(key string, i interface{}) {
+			if _, ok := i.(metrics.Counter); ok {
+				sh.intervalRegister.Register(key, metrics.NewCounter())
+			}
+		})
+	}
+	return r
+}
+
+// snapshot copies the gauges and timers, the copies don't change when the
+// shard keeps updating the originals.
+func (sh *shard) snapshot() metrics.Registry {
+	r := metrics.NewRegistry()
+	sh.metricsRegister.Each(func(key string, i interface{}) {
+		switch m := i.(type) {
+		case *stampedGauge:
+			r.Register(key, &stampedGauge{GaugeFloat64: m.GaugeFloat64.Snapshot(), ts: m.Timestamp()})
+		case *sampledTimer:
+			r.Register(key, m.snapshot())
+		case metrics.Gauge:
+			r.Register(key, m.Snapshot())
+		case metrics.GaugeFloat64:
+			r.Register(key, m.Snapshot())
+		}
+	})
+	return r
+}
+
+func (sh *shard) onParseError(err error) {
+	sh.logger.Printf("Error parsing packet, %s", err)
+	if e, ok := err.(*parser.Error); ok && e.Err == parser.ErrSampleRate {
+		sh.stat.CounterInc("invalid_sample_rate", 1)
+	}
+}
+
+func (sh *shard) update(m *parser.ParsedMetric) {
+	key := sh.intern(sh.keys.build(m.Name, m.Tags))
+
+	// 先 Get, 已存在时不用新建 metric 再丢弃
+	switch m.Type {
+	case parser.Counter:
+		c, ok := sh.intervalRegister.Get(key).(metrics.Counter)
+		if !ok {
+			c = sh.intervalRegister.GetOrRegister(key, metrics.NewCounter()).(metrics.Counter)
+		}
+		c.Inc(sampleCount(m.Value, m.Rate))
+	case parser.Gauge:
+		if err := sh.updateGauge(key, m); err != nil {
+			sh.logger.Printf("parse gauge %s, %s", key, err)
+		}
+	case parser.Set:
+		// hll 模式下 set 占用内存较大, 已存在时不再新建
+		st, ok := sh.intervalRegister.Get(key).(set)
+		if !ok {
+			st = sh.intervalRegister.GetOrRegister(key, sh.newSet()).(set)
+		}
+		st.Add(m.Raw)
+	case parser.Timer, parser.Histogram:
+		t, ok := sh.metricsRegister.Get(key).(*sampledTimer)
+		if !ok {
+			t = sh.metricsRegister.GetOrRegister(key, newSampledTimer()).(*sampledTimer)
+		}
+		t.UpdateSampled(time.Duration(m.Value*float64(time.Millisecond)), m.Rate)
+	}
+}
+
+// intern returns key as a string, reusing the string of an earlier line
+// with the same key. The cache is dropped when it grows past maxInterned.
+func (sh *shard) intern(key []byte) string {
+	if s, ok := sh.interned[string(key)]; ok {
+		return s
+	}
+	if len(sh.interned) >= maxInterned {
+		sh.interned = make(map[string]string)
+	}
+	s := string(key)
+	sh.interned[s] = s
+	return s
+}
+
+// updateGauge 以 +N/-N 形式出现的值是对当前值的增量, 否则直接更新.
+// gauge 的类型由第一次收到的值决定, 之后收到的值都按这个类型处理, 不会在 int64 和 float64 之间切换
+// 第一次收到的值带有时间戳(T 字段)时创建 stampedGauge, 刷新时使用最后收到的时间戳
+// 值已经由 parser 解析过, 这里不再重复解析
+func (sh *shard) updateGauge(key string, m *parser.ParsedMetric) error {
+	isFloat := bytes.ContainsAny(m.Raw, ".eE")
+
+	switch g := sh.metricsRegister.Get(key).(type) {
+	case nil:
+		if m.Timestamp > 0 {
+			g := sh.metricsRegister.GetOrRegister(key, newStampedGauge()).(*stampedGauge)
+			g.UpdateAt(m.Value, m.Timestamp)
+		} else if isFloat {
+			g := sh.metricsRegister.GetOrRegister(key, metrics.NewGaugeFloat64()).(metrics.GaugeFloat64)
+			g.Update(m.Value)
+		} else {
+			g := sh.metricsRegister.GetOrRegister(key, metrics.NewGauge()).(metrics.Gauge)
+			g.Update(gaugeInt(m))
+		}
+	case *stampedGauge:
+		value := m.Value
+		if m.Signed {
+			value += g.Value()
+		}
+		g.UpdateAt(value, m.Timestamp)
+	case metrics.Gauge:
+		if m.Signed {
+			g.Inc(gaugeInt(m))
+		} else {
+			g.Update(gaugeInt(m))
+		}
+	case metrics.GaugeFloat64:
+		value := m.Value
+		if m.Signed {
+			value += g.Value()
+		}
+		g.Update(value)
+	default:
+		return fmt.Errorf("metric %s already registered as %T", key, g)
+	}
+	return nil
+}
+
+// gaugeInt returns the value of an int64 gauge, floats are rounded.
+func gaugeInt(m *parser.ParsedMetric) int64 {
+	if math.Abs(m.Value) < 1<<53 {
+		return int64(math.Floor(m.Value + 0.5))
+	}
+	// 超出 float64 精度的整数重新精确解析
+	if v, err := strconv.ParseInt(string(m.Raw), 10, 64); err == nil {
+		return v
+	}
+	return int64(m.Value)
+}
+
+func newStampedGauge() *stampedGauge {
+	return &stampedGauge{GaugeFloat64: metrics.NewGaugeFloat64()}
+}
+
+// stampedGauge is a metrics.GaugeFloat64 that also keeps the timestamp sent
+// with its last value, e.g. by the graphite receiver.
+type stampedGauge struct {
+	metrics.GaugeFloat64
+	ts int64
+}
+
+// UpdateAt updates the value and, unless ts is 0, the timestamp.
+func (g *stampedGauge) UpdateAt(value float64, ts int64) {
+	g.GaugeFloat64.Update(value)
+	if ts > 0 {
+		atomic.StoreInt64(&g.ts, ts)
+	}
+}
+
+// Timestamp returns the unix time of the last value.
+func (g *stampedGauge) Timestamp() int64 {
+	return atomic.LoadInt64(&g.ts)
+}
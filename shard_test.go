@@ -0,0 +1,231 @@
+package statsd
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coder-van/v-stats/metrics"
+	"github.com/coder-van/v-stats/point"
+)
+
+func newTestAggregator(workers int, setMode string) *aggregator {
+	conf := NewConfig()
+	conf.FlushSeconds = 10
+	conf.AggregatorWorkers = workers
+	conf.SetMode = setMode
+	return NewAggregator(conf, metrics.NewRegistry(), make(chan []byte), make(chan point.Point, 10000))
+}
+
+// flushValues swaps every shard and returns the flushed points by
+// "<name>.<field>[;<tags>]", the shards must be running.
+func flushValues(agg *aggregator, elapsed time.Duration) map[string]float64 {
+	job := agg.swap(time.Unix(1000, 0), elapsed)
+	snapshots := make([]shardSnapshot, len(job.snapshots))
+	for i, ch := range job.snapshots {
+		snapshots[i] = <-ch
+	}
+	agg.Flush(snapshots, job.bucket, job.elapsed)
+	values := make(map[string]float64)
+	for len(agg.chanOut) > 0 {
+		p := <-agg.chanOut
+		values[seriesPath(p)] = p.Value
+	}
+	return values
+}
+
+func seriesPath(p point.Point) string {
+	if len(p.Tags) == 0 {
+		return p.Path()
+	}
+	return p.Path() + ";" + strings.Join(p.Tags, ";")
+}
+
+func runShards(agg *aggregator) func() {
+	for _, sh := range agg.shards {
+		go sh.run()
+	}
+	return func() {
+		for _, sh := range agg.shards {
+			close(sh.in)
+			<-sh.exit
+		}
+	}
+}
+
+func TestSampleRate(t *testing.T) {
+	agg := newTestAggregator(2, SetModeExact)
+	defer runShards(agg)()
+
+	agg.HandlePackets([]byte("hits:1|c|@0.1\nhits:1|c|@0.1\nhits:1|c|@0.1\n" +
+		"lat:10|ms|@0.1\nlat:10|ms|@0.1\nlat:20|ms\n" +
+		"bad:1|c|@0\nbad:1|c|@1.5\nbad:1|c|@x"))
+	values := flushValues(agg, 10*time.Second)
+
+	// 每个采样的事件代表 1/rate 个真实事件
+	if values["hits.count"] != 30 || values["hits.rate"] != 3 {
+		t.Errorf("hits: got count %v, rate %v, want 30 and 3", values["hits.count"], values["hits.rate"])
+	}
+	if values["lat.count"] != 21 {
+		t.Errorf("lat: got count %v, want 21", values["lat.count"])
+	}
+	if _, ok := values["bad.count"]; ok {
+		t.Error("lines with an invalid sample rate were counted")
+	}
+	if got := values["statsd.invalid_sample_rate.count"]; got != 3 {
+		t.Errorf("invalid_sample_rate is %v, want 3", got)
+	}
+}
+
+func TestIdleCounters(t *testing.T) {
+	for _, deleteIdle := range []bool{false, true} {
+		conf := NewConfig()
+		conf.FlushSeconds = 10
+		conf.AggregatorWorkers = 2
+		conf.DeleteIdleCounters = deleteIdle
+		agg := NewAggregator(conf, metrics.NewRegistry(), make(chan []byte), make(chan point.Point, 10000))
+		stop := runShards(agg)
+
+		agg.HandlePackets([]byte("hits:2|c\nhits:1|c|#host=a"))
+		values := flushValues(agg, 10*time.Second)
+		if values["hits.count"] != 2 || values["hits.count;host=a"] != 1 {
+			t.Errorf("delete_idle_counters=%v: got %v", deleteIdle, values)
+		}
+
+		// 没有数据的周期
+		values = flushValues(agg, 10*time.Second)
+		for _, key := range []string{"hits.count", "hits.rate", "hits.count;host=a"} {
+			v, ok := values[key]
+			if deleteIdle && ok {
+				t.Errorf("idle counter %s was emitted", key)
+			}
+			if !deleteIdle && (!ok || v != 0) {
+				t.Errorf("idle counter %s: got %v, %v, want 0", key, v, ok)
+			}
+		}
+
+		agg.HandlePackets([]byte("hits:3|c"))
+		values = flushValues(agg, 10*time.Second)
+		if values["hits.count"] != 3 {
+			t.Errorf("delete_idle_counters=%v: hits.count is %v after idle, want 3", deleteIdle, values["hits.count"])
+		}
+		stop()
+	}
+}
+
+func TestSampledTimer(t *testing.T) {
+	st := newSampledTimer()
+	st.UpdateSampled(10*time.Millisecond, 0.1)
+	st.UpdateSampled(10*time.Millisecond, 0.1)
+	st.Update(20 * time.Millisecond)
+	if st.Count() != 3 || st.WeightedCount() != 21 || st.Scale() != 7 {
+		t.Errorf("got count %d, weighted count %d, scale %v", st.Count(), st.WeightedCount(), st.Scale())
+	}
+	// 快照不随原来的 timer 变化
+	snap := st.snapshot()
+	st.UpdateSampled(time.Millisecond, 0.5)
+	if snap.Count() != 3 || snap.WeightedCount() != 21 {
+		t.Errorf("snapshot changed to count %d, weighted count %d", snap.Count(), snap.WeightedCount())
+	}
+	if newSampledTimer().Scale() != 1 {
+		t.Error("an empty timer is scaled")
+	}
+}
+
+func TestGaugeDelta(t *testing.T) {
+	agg := newTestAggregator(1, SetModeExact)
+	defer runShards(agg)()
+
+	agg.HandlePackets([]byte("int:1|g\nint:+2|g\nint:-5|g\nint:+2.4|g\n" +
+		"float:1.5|g\nfloat:+1|g\nfloat:-0.25|g\n" +
+		"set:3|g\nset:7|g"))
+	values := flushValues(agg, 10*time.Second)
+	for name, want := range map[string]float64{"int": 0, "float": 2.25, "set": 7} {
+		if got, ok := values[name+".value"]; !ok || got != want {
+			t.Errorf("%s: got %v, want %v", name, got, want)
+		}
+	}
+
+	// 增量不会改变 gauge 的类型
+	r := agg.shards[0].metricsRegister
+	if _, ok := r.Get("int").(metrics.Gauge); !ok {
+		t.Errorf("int gauge is %T", r.Get("int"))
+	}
+	if _, ok := r.Get("float").(metrics.GaugeFloat64); !ok {
+		t.Errorf("float gauge is %T", r.Get("float"))
+	}
+
+	// gauge 跨周期保留
+	agg.HandlePackets([]byte("int:+1|g"))
+	if got := flushValues(agg, 10*time.Second)["int.value"]; got != 1 {
+		t.Errorf("int: got %v after the next flush, want 1", got)
+	}
+}
+
+func TestSwapMarker(t *testing.T) {
+	agg := newTestAggregator(4, SetModeExact)
+
+	var before, after []string
+	for i := 0; i < 100; i++ {
+		before = append(before, "before:1|c")
+		after = append(after, "after:1|c")
+	}
+	// shard 还没有运行, 数据行和刷新标记都在队列中
+	agg.HandlePackets([]byte(strings.Join(before, "\n")))
+	job := agg.swap(time.Unix(1000, 0), 10*time.Second)
+	agg.HandlePackets([]byte(strings.Join(after, "\n")))
+	defer runShards(agg)()
+
+	snapshots := make([]shardSnapshot, len(job.snapshots))
+	for i, ch := range job.snapshots {
+		snapshots[i] = <-ch
+	}
+	agg.Flush(snapshots, job.bucket, job.elapsed)
+	values := make(map[string]float64)
+	for len(agg.chanOut) > 0 {
+		p := <-agg.chanOut
+		values[seriesPath(p)] = p.Value
+	}
+	if values["before.count"] != 100 {
+		t.Errorf("got %v lines queued before the marker, want 100", values["before.count"])
+	}
+	if _, ok := values["after.count"]; ok {
+		t.Error("lines queued after the marker are in the snapshot")
+	}
+	if got := flushValues(agg, 10*time.Second)["after.count"]; got != 100 {
+		t.Errorf("got %v lines in the next flush, want 100", got)
+	}
+}
+
+func TestShardIndex(t *testing.T) {
+	const n = 8
+	lines := []string{"api.hits:1|c", "api.hits:5|c|@0.5", "api.hits:1|c|#host=a", "api.hits:2|c|#host=b,dc=x"}
+	want := shardIndex([]byte(lines[0]), n)
+	for _, line := range lines[1:] {
+		if got := shardIndex([]byte(line), n); got != want {
+			t.Errorf("%q went to shard %d, want %d", line, got, want)
+		}
+	}
+
+	used := make(map[int]bool)
+	for i := 0; i < 100; i++ {
+		used[shardIndex([]byte("m"+strings.Repeat("x", i)+":1|c"), n)] = true
+	}
+	if len(used) != n {
+		t.Errorf("100 names used %d of %d shards", len(used), n)
+	}
+	if shardIndex([]byte("a:1|c"), 1) != 0 {
+		t.Error("a single shard is not 0")
+	}
+}
+
+func TestGaugeInt(t *testing.T) {
+	agg := newTestAggregator(1, SetModeExact)
+	defer runShards(agg)()
+	// 超过 2^53 的整数不经过 float64, 不会丢失精度
+	agg.HandlePackets([]byte("big:9007199254740993|g"))
+	flushValues(agg, 10*time.Second)
+	if g, ok := agg.shards[0].metricsRegister.Get("big").(metrics.Gauge); !ok || g.Value() != 9007199254740993 {
+		t.Errorf("got %v", agg.shards[0].metricsRegister.Get("big"))
+	}
+}
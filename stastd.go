@@ -1,8 +1,13 @@
 package statsd
 
 import (
+	"time"
+
 	"github.com/coder-van/v-stats/backends"
+	gb "github.com/coder-van/v-stats/backends/graghite"
+	"github.com/coder-van/v-stats/backends/repeater"
 	"github.com/coder-van/v-stats/metrics"
+	"github.com/coder-van/v-stats/point"
 	"github.com/coder-van/v-stats/receivers"
 	"github.com/coder-van/v-util/log"
 )
@@ -14,26 +19,96 @@ func NewStatsD(conf *Config) *StatsD {
 	conf.Check()
 	
 	ch1 := make(chan []byte, conf.ReceiverQueueSize)
-	ch2 := make(chan metrics.MetricDataPoint, conf.DataPointQueueSize)
-	return &StatsD{
+	ch2 := make(chan point.Point, conf.DataPointQueueSize)
+	s := &StatsD{
 		config:           conf,
 		PacketInChannel:  ch1,
 		dataPointChannel: ch2,
 		logger:           log.GetLogger("statsd", log.RotateModeMonth),
-		backendManger:    backends.NewBackendManger(conf.BackendFlushSeconds, ch2, conf.BackendFlushSize),
-		receiver:         receivers.NewUdpReceiver(conf.ReceiverAddr, ch1),
 	}
+	return s
+}
+
+// build creates the aggregator, the backend manager, the receivers, the
+// repeater and the proxy.
+// It runs in StartAll so that a config loaded by LoadConfig after NewStatsD
+// applies.
+func (s *StatsD) build() {
+	conf := s.config
+	s.receivers = newReceivers(conf, s.PacketInChannel, s.dataPointChannel)
+	if conf.Backends.Repeater != nil {
+		s.repeater = repeater.NewRepeater(conf.Backends.Repeater)
+	}
+	for _, r := range s.receivers {
+		if rr, ok := r.(interface{ SetRepeater(receivers.Repeater) }); ok && s.repeater != nil {
+			rr.SetRepeater(s.repeater)
+		}
+		if rs, ok := r.(interface{ SetStat(receivers.Stat) }); ok && s.stat != nil {
+			rs.SetStat(s.stat)
+		}
+	}
+	if conf.Mode == ModeProxy {
+		s.proxy = repeater.NewProxy(conf.Proxy, s.PacketInChannel)
+		if s.stat != nil {
+			s.proxy.SetStat(s.stat)
+		}
+	} else {
+		s.agg = NewAggregator(conf, s.metricRegistry, s.PacketInChannel, s.dataPointChannel)
+		s.backendManger = backends.NewBackendManger(conf.BackendFlushSeconds, s.dataPointChannel, conf.BackendFlushSize)
+	}
+}
+
+// newReceivers creates the udp receiver and the optional ones, all of them
+// feed ch except the graphite receiver in direct mode, which feeds points.
+func newReceivers(conf *Config, ch chan []byte, points chan point.Point) []receivers.Receiver {
+	rs := []receivers.Receiver{receivers.NewUdpReceiver(conf.ReceiverAddr, ch)}
+	if conf.TcpReceiverAddr != "" {
+		tcp := receivers.NewTcpReceiver(conf.TcpReceiverAddr, ch)
+		tcp.MaxLineBytes = conf.TcpMaxLineBytes
+		tcp.IdleTimeout = time.Duration(conf.TcpIdleTimeoutSeconds) * time.Second
+		rs = append(rs, tcp)
+	}
+	// Check 已经校验过 unix_socket_mode
+	mode, _ := receivers.ParseSocketMode(conf.UnixSocketMode)
+	if conf.UnixSocketPath != "" {
+		u := receivers.NewUnixStreamReceiver(conf.UnixSocketPath, mode, ch)
+		u.MaxLineBytes = conf.TcpMaxLineBytes
+		u.IdleTimeout = time.Duration(conf.TcpIdleTimeoutSeconds) * time.Second
+		u.PeerCred = conf.UnixPeerCred
+		rs = append(rs, u)
+	}
+	if conf.UnixgramSocketPath != "" {
+		u := receivers.NewUnixgramReceiver(conf.UnixgramSocketPath, mode, ch)
+		u.PeerCred = conf.UnixPeerCred
+		rs = append(rs, u)
+	}
+	if conf.HttpReceiverAddr != "" {
+		h := receivers.NewHttpReceiver(conf.HttpReceiverAddr, ch)
+		h.Path = conf.HttpReceiverPath
+		h.MaxBodyBytes = conf.HttpMaxBodyBytes
+		h.AllowOrigin = conf.HttpAllowOrigin
+		rs = append(rs, h)
+	}
+	if conf.GraphiteReceiverAddr != "" || conf.GraphitePickleAddr != "" {
+		rs = append(rs, receivers.NewGraphiteReceiver(conf.GraphiteReceiverAddr,
+			conf.GraphitePickleAddr, conf.GraphiteReceiverMode, ch, points))
+	}
+	return rs
 }
 
 type StatsD struct {
 	config           *Config
 	metricRegistry   metrics.Registry
 	PacketInChannel  chan []byte                  // Channel for all incoming statsd packets
-	dataPointChannel chan metrics.MetricDataPoint // channel for backends to read
+	dataPointChannel chan point.Point // channel for backends to read
 	logger           *log.Vlogger
 	agg              *aggregator
-	receiver         receivers.Receiver
+	receivers        []receivers.Receiver
+	repeater         *repeater.Repeater
+	proxy            *repeater.Proxy
 	backendManger    *backends.BackendManger
+	// stat records the self-metrics of the receivers, set by SetRegistry
+	stat *BaseStat
 }
 
 func (s *StatsD) ResetConfig(c *Config) {
@@ -43,37 +118,102 @@ func (s *StatsD) ResetConfig(c *Config) {
 
 func (s *StatsD) LoadConfig(fp string) {
 	s.config.LoadConfig(fp)
+	s.config.Check()
 }
 
 func (s *StatsD) SetRegistry(registry metrics.Registry) {
 	s.metricRegistry = registry
-	s.agg = NewAggregator(s.config.FlushSeconds, s.metricRegistry, s.PacketInChannel, s.dataPointChannel)
+	s.stat = NewBaseStat("statsd", registry)
 }
 
 func (s *StatsD) StartAll() {
 	s.logger.Println("Statsd starting")
+	s.build()
+	if s.proxy != nil {
+		// proxy 模式不聚合, 收到的数据包直接由 proxy 转发
+		s.proxy.Start()
+		s.startReceiver()
+		s.logger.Println("statsd started in proxy mode")
+		return
+	}
 	// first start aggregator
 	s.agg.Start()
 
 	// then start backend manager
-	s.backendManger.RegisterGraphite(s.config.GraphiteAddr)
+	s.registerBackends()
 	s.backendManger.Start()
 
 	// last start receiver
-	if !s.config.IsLocal {
-		s.receiver.Start()
-	}
+	s.startReceiver()
 	s.logger.Println("statsd started ")
 }
 
+// startReceiver starts the receivers, the repeater before them.
+func (s *StatsD) startReceiver() {
+	if s.config.IsLocal {
+		return
+	}
+	if s.repeater != nil {
+		s.repeater.Start()
+	}
+	for _, r := range s.receivers {
+		r.Start()
+	}
+}
+
+func (s *StatsD) stopReceiver() {
+	if s.config.IsLocal {
+		return
+	}
+	for _, r := range s.receivers {
+		r.Stop()
+	}
+	if s.repeater != nil {
+		s.repeater.Stop()
+	}
+}
+
+func (s *StatsD) registerBackends() {
+	s.backendManger.RegisterGraphite(s.config.GraphiteAddr, gb.Options{
+		Protocol:   s.config.GraphiteProtocol,
+		Timeout:    time.Duration(s.config.GraphiteTimeoutSeconds) * time.Second,
+		RoundRobin: s.config.GraphiteRoundRobin,
+		TagMode:    s.config.GraphiteTagMode,
+		TagOrder:   s.config.GraphiteTagOrder,
+	})
+	if s.config.Backends.CloudInsight != nil {
+		s.backendManger.RegisterCloudInsight(s.config.Backends.CloudInsight)
+	}
+	if s.config.Backends.InfluxDB != nil {
+		s.backendManger.RegisterInfluxDB(s.config.Backends.InfluxDB)
+	}
+	if s.config.Backends.Prometheus != nil {
+		s.backendManger.RegisterPrometheus(s.config.Backends.Prometheus)
+	}
+	if s.config.Backends.PrometheusRemoteWrite != nil {
+		s.backendManger.RegisterPrometheusRemoteWrite(s.config.Backends.PrometheusRemoteWrite)
+	}
+	if s.config.Backends.OTLP != nil {
+		s.backendManger.RegisterOTLP(s.config.Backends.OTLP)
+	}
+	if s.config.Backends.OpenTSDB != nil {
+		s.backendManger.RegisterOpenTSDB(s.config.Backends.OpenTSDB)
+	}
+	if s.config.Backends.Console != nil {
+		s.backendManger.RegisterConsole(s.config.Backends.Console)
+	}
+}
+
 func (s *StatsD) StopAll() {
 	s.logger.Println("Statsd stoping")
 
-	if !s.config.IsLocal {
-		s.receiver.Stop()
+	s.stopReceiver()
+	if s.proxy != nil {
+		s.proxy.Stop()
+	} else {
+		s.agg.Stop()
+		s.backendManger.Stop()
 	}
-	s.agg.Stop()
-	s.backendManger.Stop()
 
 	close(s.PacketInChannel)
 	close(s.dataPointChannel)
@@ -0,0 +1,32 @@
+package statsd
+
+import (
+	"testing"
+	"time"
+
+	"github.com/coder-van/v-stats/metrics"
+)
+
+// The aggregator and the backend manager are built from the config as it is
+// in StartAll, LoadConfig may change it after NewStatsD and SetRegistry.
+func TestBuildUsesLoadedConfig(t *testing.T) {
+	s := NewStatsD(nil)
+	s.SetRegistry(metrics.NewRegistry())
+
+	s.config.FlushAlign = false
+	s.config.FlushJitterMillis = 300
+	s.config.AggregatorWorkers = 3
+	s.config.SetMode = SetModeHLL
+	s.config.BackendFlushSeconds = 7
+	s.build()
+
+	if s.agg == nil || s.agg.FlushAlign || s.agg.FlushJitter != 300*time.Millisecond || len(s.agg.shards) != 3 {
+		t.Fatalf("the aggregator was built from the old config")
+	}
+	if _, ok := s.agg.shards[0].newSet().(*hyperLogLog); !ok {
+		t.Errorf("set_mode hll was ignored")
+	}
+	if s.backendManger == nil || s.backendManger.FlushInterval != 7*time.Second {
+		t.Fatalf("the backend manager was built from the old config")
+	}
+}
@@ -0,0 +1,102 @@
+package statsd
+
+import (
+	"bytes"
+	"strings"
+
+	"github.com/coder-van/v-stats/parser"
+)
+
+/*
+ tag 以 name=value 形式出现, 同一个 metric 的 tags 经过规整(去重, 排序)后拼接到 key 中,
+ 形如 Graphite 1.1 的 tagged series:
+ <name>;<tag1>=<v1>;<tag2>=<v2>
+ 这样只有 tags 不同的两行数据会进入 registry 中不同的条目
+*/
+const TagSeparator = ";"
+
+// keyBuilder builds registry keys from parsed lines, reusing its buffers so
+// that the hot path doesn't allocate. Tags are trimmed, deduplicated by
+// name with the last value winning, and sorted.
+type keyBuilder struct {
+	key   []byte
+	tags  []byte
+	spans []tagSpan
+}
+
+// tagSpan locates a tag in keyBuilder.tags, nameEnd is the end of its name.
+type tagSpan struct {
+	start, nameEnd, end int
+}
+
+// build returns the key of name and the body of a "#tag1=v1,tag2=v2"
+// section, see parser.ParsedMetric.Tags. ';' in name and tags becomes '_'.
+// The key is valid until the next call.
+func (kb *keyBuilder) build(name, tags []byte) []byte {
+	kb.tags = kb.tags[:0]
+	kb.spans = kb.spans[:0]
+	for tag, rest := parser.NextTag(tags); tag != nil; tag, rest = parser.NextTag(rest) {
+		start := len(kb.tags)
+		for _, c := range tag {
+			if c == TagSeparator[0] {
+				c = '_'
+			}
+			kb.tags = append(kb.tags, c)
+		}
+		nameEnd := bytes.IndexByte(kb.tags[start:], '=')
+		if nameEnd < 0 {
+			nameEnd = len(kb.tags) - start
+		}
+		if nameEnd == 0 {
+			kb.tags = kb.tags[:start]
+			continue
+		}
+		sp := tagSpan{start: start, nameEnd: start + nameEnd, end: len(kb.tags)}
+		kb.add(sp)
+	}
+	// 一行的 tags 很少, 插入排序即可
+	for i := 1; i < len(kb.spans); i++ {
+		for j := i; j > 0 && bytes.Compare(kb.tag(kb.spans[j]), kb.tag(kb.spans[j-1])) < 0; j-- {
+			kb.spans[j], kb.spans[j-1] = kb.spans[j-1], kb.spans[j]
+		}
+	}
+
+	// 名字中的 ; 会被 splitSeriesKey 当作 tag 的开始, 和 tag 中的一样替换掉
+	kb.key = kb.key[:0]
+	for _, c := range name {
+		if c == TagSeparator[0] {
+			c = '_'
+		}
+		kb.key = append(kb.key, c)
+	}
+	for _, sp := range kb.spans {
+		kb.key = append(kb.key, TagSeparator...)
+		kb.key = append(kb.key, kb.tag(sp)...)
+	}
+	return kb.key
+}
+
+// add appends sp, replacing an earlier tag of the same name.
+func (kb *keyBuilder) add(sp tagSpan) {
+	name := kb.tags[sp.start:sp.nameEnd]
+	for i, old := range kb.spans {
+		if bytes.Equal(kb.tags[old.start:old.nameEnd], name) {
+			kb.spans[i] = sp
+			return
+		}
+	}
+	kb.spans = append(kb.spans, sp)
+}
+
+func (kb *keyBuilder) tag(sp tagSpan) []byte {
+	return kb.tags[sp.start:sp.end]
+}
+
+// splitSeriesKey splits a key built by keyBuilder into the name and tags.
+func splitSeriesKey(key string) (string, []string) {
+	i := strings.Index(key, TagSeparator)
+	if i < 0 {
+		return key, nil
+	}
+	return key[:i], strings.Split(key[i+1:], TagSeparator)
+}
@@ -0,0 +1,50 @@
+package statsd
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestKeyBuilder(t *testing.T) {
+	tests := []struct {
+		name, tags string
+		key        string
+		series     string
+		split      []string
+	}{
+		{"api", "", "api", "api", nil},
+		{"api", " host=a , env=prod,,", "api;env=prod;host=a", "api", []string{"env=prod", "host=a"}},
+		{"api", "host=a,host=b,=x", "api;host=b", "api", []string{"host=b"}},
+		{"api", "path=/a;b", "api;path=/a_b", "api", []string{"path=/a_b"}},
+		// 名字中的 ; 不能变成 tag
+		{"a;b=c", "", "a_b=c", "a_b=c", nil},
+		{"a;b=c", "host=a", "a_b=c;host=a", "a_b=c", []string{"host=a"}},
+	}
+	var kb keyBuilder
+	for _, tt := range tests {
+		key := string(kb.build([]byte(tt.name), []byte(tt.tags)))
+		if key != tt.key {
+			t.Errorf("build(%q, %q) = %q, want %q", tt.name, tt.tags, key, tt.key)
+			continue
+		}
+		series, tags := splitSeriesKey(key)
+		if series != tt.series || !reflect.DeepEqual(tags, tt.split) {
+			t.Errorf("splitSeriesKey(%q) = %q, %q", key, series, tags)
+		}
+	}
+}
+
+func TestNameSeparator(t *testing.T) {
+	agg := newTestAggregator(1, SetModeExact)
+	defer runShards(agg)()
+
+	agg.HandlePackets([]byte("a;b=c:1|c"))
+	values := flushValues(agg, 10*time.Second)
+	if values["a_b=c.count"] != 1 {
+		t.Errorf("got %v", values)
+	}
+	if _, ok := values["a.count;b=c"]; ok {
+		t.Error("the name was split into a series with a fake tag")
+	}
+}